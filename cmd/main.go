@@ -6,7 +6,10 @@ import (
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
+	"os"
+	"webserver/croc"
 	"webserver/internal/api"
+	"webserver/internal/auth"
 	"webserver/internal/config"
 	"webserver/internal/webrtc"
 	"webserver/internal/websocket"
@@ -29,27 +32,92 @@ func main() {
 
 	defer pool.DB.Close()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(pool, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := pool.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
 	config.InitDatabase(pool)
 
+	if err := websocket.StartPresence(); err != nil {
+		log.Fatal(err)
+	}
+
+	croc.ArchiveInactiveThreads()
+
+	auth.OnSessionRevoked(websocket.CloseSession)
+	auth.OnSessionRevoked(webrtc.CloseSession)
+
 	router := mux.NewRouter()
 
 	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "Authorization"})
 	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
 	handler := handlers.CORS(headersOk, originsOk, methodsOk)(router)
 
 	apiRouter := router.PathPrefix("/api").Subrouter()
-	createRouter := apiRouter.PathPrefix("/create").Subrouter()
-	createRouter.HandleFunc("/server", api.Create).Methods("POST")
-	createRouter.HandleFunc("/invitelink", api.CreateInviteLink).Methods("POST")
-	apiRouter.HandleFunc("/{userId}/server", api.UserServer).Methods("GET")
-	apiRouter.HandleFunc("/{serverId}/channels", api.Channels).Methods("GET")
-	apiRouter.HandleFunc("/{serverId}/members", api.ServerMembers).Methods("GET")
-	apiRouter.HandleFunc("/{userId}/joinServer/{inviteId}", api.JoinServer).Methods("GET")
 	apiRouter.HandleFunc("/auth/login", api.LoginHandler).Methods("POST")
 	apiRouter.HandleFunc("/auth/register", api.RegisterHandler).Methods("POST")
-
-	router.HandleFunc("/invite/{code}/{userId}", api.JoinServer).Methods("GET")
+	apiRouter.HandleFunc("/auth/refresh", api.RefreshHandler).Methods("POST")
+
+	// Every other API route requires a valid token
+	protectedRouter := apiRouter.NewRoute().Subrouter()
+	protectedRouter.Use(api.AuthMiddleware)
+	protectedRouter.HandleFunc("/auth/logout", api.LogoutHandler).Methods("POST")
+	protectedRouter.HandleFunc("/auth/sessions", api.SessionsHandler).Methods("GET")
+	protectedRouter.HandleFunc("/auth/sessions/{sessionId}", api.RevokeSessionHandler).Methods("DELETE")
+	createRouter := protectedRouter.PathPrefix("/create").Subrouter()
+	createRouter.HandleFunc("/server", api.Create).Methods("POST")
+	createRouter.HandleFunc("/invitelink", api.CreateInviteLink).Methods("POST")
+	protectedRouter.HandleFunc("/me/server", api.UserServer).Methods("GET")
+	protectedRouter.HandleFunc("/me/dms", api.PrivateChannels).Methods("GET")
+	protectedRouter.HandleFunc("/me/dms", api.CreatePrivateChannel).Methods("POST")
+	protectedRouter.HandleFunc("/dms/{channelId}", api.UpdateGroupDm).Methods("PATCH")
+	protectedRouter.HandleFunc("/dms/{channelId}/recipients/{userId}", api.AddDmRecipient).Methods("PUT")
+	protectedRouter.HandleFunc("/dms/{channelId}/recipients/{userId}", api.RemoveDmRecipient).Methods("DELETE")
+	protectedRouter.HandleFunc("/{serverId}/channels", api.Channels).Methods("GET")
+	protectedRouter.HandleFunc("/{serverId}/channels", api.CreateChannel).Methods("POST")
+	protectedRouter.HandleFunc("/{serverId}/channels", api.ReorderChannels).Methods("PATCH")
+	protectedRouter.HandleFunc("/channels/{channelId}", api.UpdateChannel).Methods("PATCH")
+	protectedRouter.HandleFunc("/channels/{channelId}", api.DeleteChannel).Methods("DELETE")
+	protectedRouter.HandleFunc("/{serverId}/members", api.ServerMembers).Methods("GET")
+	protectedRouter.HandleFunc("/{channelId}/messages", api.Messages).Methods("GET")
+	protectedRouter.HandleFunc("/messages/{messageId}", api.EditMessage).Methods("PATCH")
+	protectedRouter.HandleFunc("/messages/{messageId}", api.DeleteMessage).Methods("DELETE")
+	protectedRouter.HandleFunc("/messages/{messageId}/edits", api.MessageEdits).Methods("GET")
+	protectedRouter.HandleFunc("/channels/{channelId}/messages/{messageId}/ack", api.AckMessage).Methods("POST")
+	protectedRouter.HandleFunc("/channels/{channelId}/messages/{messageId}/reactions/{emoji}", api.AddReaction).Methods("PUT")
+	protectedRouter.HandleFunc("/channels/{channelId}/messages/{messageId}/reactions/{emoji}", api.RemoveReaction).Methods("DELETE")
+	protectedRouter.HandleFunc("/channels/{channelId}/messages/{messageId}/threads", api.CreateThread).Methods("POST")
+	protectedRouter.HandleFunc("/channels/{channelId}/threads", api.Threads).Methods("GET")
+	protectedRouter.HandleFunc("/threads/{threadId}", api.UpdateThread).Methods("PATCH")
+	protectedRouter.HandleFunc("/threads/{threadId}/members", api.ThreadMembers).Methods("GET")
+	protectedRouter.HandleFunc("/threads/{threadId}/members/@me", api.JoinThread).Methods("PUT")
+	protectedRouter.HandleFunc("/threads/{threadId}/members/@me", api.LeaveThread).Methods("DELETE")
+	protectedRouter.HandleFunc("/{serverId}/roles", api.Roles).Methods("GET")
+	protectedRouter.HandleFunc("/{serverId}/roles", api.CreateRole).Methods("POST")
+	protectedRouter.HandleFunc("/{serverId}/roles", api.ReorderRoles).Methods("PATCH")
+	protectedRouter.HandleFunc("/{serverId}/roles/{roleId}", api.UpdateRole).Methods("PATCH")
+	protectedRouter.HandleFunc("/{serverId}/roles/{roleId}", api.DeleteRole).Methods("DELETE")
+	protectedRouter.HandleFunc("/{serverId}/members/{userId}/roles/{roleId}", api.AddMemberRole).Methods("PUT")
+	protectedRouter.HandleFunc("/{serverId}/members/{userId}/roles/{roleId}", api.RemoveMemberRole).Methods("DELETE")
+	protectedRouter.HandleFunc("/{serverId}/emojis", api.Emojis).Methods("GET")
+	protectedRouter.HandleFunc("/{serverId}/emojis", api.CreateEmoji).Methods("POST")
+	protectedRouter.HandleFunc("/{serverId}/emojis/{emojiId}", api.DeleteEmoji).Methods("DELETE")
+	protectedRouter.HandleFunc("/{serverId}/voice-states", api.VoiceStates).Methods("GET")
+	protectedRouter.HandleFunc("/{serverId}/voice-states/{userId}", api.UpdateVoiceState).Methods("PATCH")
+	protectedRouter.HandleFunc("/channels/{channelId}/permissions", api.ChannelOverwrites).Methods("GET")
+	protectedRouter.HandleFunc("/channels/{channelId}/permissions/{targetId}", api.SetChannelOverwrite).Methods("PUT")
+	protectedRouter.HandleFunc("/channels/{channelId}/permissions/{targetId}", api.DeleteChannelOverwrite).Methods("DELETE")
+	protectedRouter.HandleFunc("/joinServer/{code}", api.JoinServer).Methods("GET")
+
+	router.Handle("/invite/{code}", api.AuthMiddleware(http.HandlerFunc(api.JoinServer))).Methods("GET")
 
 	router.PathPrefix("/public/").Handler(http.StripPrefix("/public/", http.FileServer(http.Dir("../public"))))
 
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"webserver/internal/config"
+)
+
+const migrateUsage = "usage: migrate [up [steps] | down [steps] | status]"
+
+// runMigrateCommand handles the migrate subcommand, e.g. `go run . migrate down 1`.
+func runMigrateCommand(pool *config.DatabasePool, args []string) error {
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	steps := 0
+	if len(args) > 1 {
+		var err error
+		steps, err = strconv.Atoi(args[1])
+		if err != nil || steps < 1 {
+			return fmt.Errorf("invalid number of steps %q, %s", args[1], migrateUsage)
+		}
+	}
+
+	switch action {
+	case "up":
+		done, err := pool.MigrateUp(steps)
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			log.Println("Database is up to date")
+		}
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		_, err := pool.MigrateDown(steps)
+		if err != nil {
+			return err
+		}
+	case "status":
+		status, err := pool.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, migration := range status {
+			state := "pending"
+			if migration.Applied {
+				state = "applied " + migration.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", migration.Version, migration.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate action %q, %s", action, migrateUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package croc
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"webserver/internal/websocket"
+)
+
+// ArchiveInactiveThreads archives inactive threads once a minute. Unlike DeleteExpiredInviteLinks
+// it returns right after starting the scheduler.
+func ArchiveInactiveThreads() {
+	c := cron.New()
+
+	_, err := c.AddFunc("* * * * *", func() {
+		websocket.ArchiveInactiveThreads()
+	})
+	if err != nil {
+		fmt.Println("Error scheduling cron job:", err)
+		return
+	}
+
+	c.Start()
+}
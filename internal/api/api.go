@@ -17,8 +17,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"time"
+	"webserver/internal/auth"
 	"webserver/internal/config"
 	"webserver/internal/helper"
+	"webserver/internal/permissions"
+	"webserver/internal/websocket"
 )
 
 type serverData struct {
@@ -31,6 +34,8 @@ type serverData struct {
 		ServerOwner  bool      `json:"ServerOwner"`
 		MembershipId int       `json:"membershipId"`
 	} `json:"userData"`
+	// ReadStates holds the read state of every channel of the server the user can view
+	ReadStates []websocket.ReadState `json:"readStates"`
 }
 
 type userData struct {
@@ -45,6 +50,8 @@ type userData struct {
 	Pronouns    string    `json:"pronouns"`
 	Img         string    `json:"img"`
 	Online      bool      `json:"online"`
+	Presence    string    `json:"presence"`
+	Roles       []string  `json:"roles"`
 }
 
 type channelData struct {
@@ -52,7 +59,15 @@ type channelData struct {
 	ServerId  string    `json:"serverId"`
 	Type      uint8     `json:"type"`
 	Name      string    `json:"name"`
+	ParentId  *string   `json:"parentId"`
+	Position  int       `json:"position"`
+	Topic     string    `json:"topic"`
+	Nsfw      bool      `json:"nsfw"`
 	CreatedAt time.Time `json:"createdAt"`
+
+	LastReadMessageId string `json:"lastReadMessageId,omitempty"`
+	UnreadCount       int    `json:"unreadCount"`
+	MentionCount      int    `json:"mentionCount"`
 }
 
 type createRes struct {
@@ -63,8 +78,7 @@ type createRes struct {
 }
 
 func UserServer(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userId := vars["userId"]
+	userId := auth.UserIdFromContext(r.Context())
 	var data []serverData
 
 	tx, err := config.UseDBPool().DB.Begin()
@@ -122,6 +136,13 @@ func UserServer(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		readStates, err := visibleReadStates(tx, serverId, userId)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+			return
+		}
+
 		server := serverData{
 			ServerId:  serverId,
 			Name:      serverName,
@@ -136,6 +157,7 @@ func UserServer(w http.ResponseWriter, r *http.Request) {
 				ServerOwner:  serverOwner,
 				MembershipId: membershipId,
 			},
+			ReadStates: readStates,
 		}
 		data = append(data, server)
 	}
@@ -153,7 +175,11 @@ func UserServer(w http.ResponseWriter, r *http.Request) {
 
 func Channels(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	id := vars["serverId"]
+	id, err := strconv.ParseInt(vars["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
 	var data []channelData
 
 	tx, err := config.UseDBPool().DB.Begin()
@@ -167,7 +193,26 @@ func Channels(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	rows, err := tx.Query("SELECT * FROM channels WHERE server_id = ?", id)
+	userId := auth.UserIdFromContext(r.Context())
+	channelPermissions, err := permissions.ServerChannelPermissions(tx, id, userId)
+	if errors.Is(err, permissions.ErrNotMember) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+
+	readStates, err := websocket.ServerReadStates(tx, userId, id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+
+	// Threads are listed per channel, see Threads
+	rows, err := tx.Query("SELECT channel_id, server_id, type, channel_name, parent_id, position, COALESCE(topic, ''), nsfw, created_at FROM channels WHERE server_id = ? AND type != ? ORDER BY position, channel_id", id, websocket.ChannelTypeThread)
 	if err != nil {
 		http.Error(w, "Failed to execute query", 500)
 		return
@@ -187,19 +232,38 @@ func Channels(w http.ResponseWriter, r *http.Request) {
 		var serverId string
 		var channelType uint8
 		var name string
+		var parentId sql.NullString
+		var position int
+		var topic string
+		var nsfw bool
 		var createdAt time.Time
-		err = rows.Scan(&id, &serverId, &channelType, &name, &createdAt)
+		err = rows.Scan(&id, &serverId, &channelType, &name, &parentId, &position, &topic, &nsfw, &createdAt)
 		if err != nil {
 			http.Error(w, "Failed to scan row", 500)
 			return
 		}
 
+		channelId, _ := strconv.ParseInt(id, 10, 64)
+		if !channelPermissions[channelId].Has(permissions.ViewChannel) {
+			continue
+		}
+
 		row := channelData{
 			Id:        id,
 			ServerId:  serverId,
 			Type:      channelType,
 			Name:      name,
+			Position:  position,
+			Topic:     topic,
+			Nsfw:      nsfw,
 			CreatedAt: createdAt,
+
+			LastReadMessageId: readStates[channelId].LastReadMessageId,
+			UnreadCount:       readStates[channelId].UnreadCount,
+			MentionCount:      readStates[channelId].MentionCount,
+		}
+		if parentId.Valid {
+			row.ParentId = &parentId.String
 		}
 		data = append(data, row)
 	}
@@ -226,7 +290,7 @@ func Create(w http.ResponseWriter, r *http.Request) {
 	var serverId = helper.GenerateUniqueId()
 	log.Println("FD:", formData)
 	var serverName = formData.Value["name"][0]
-	var userId, _ = strconv.ParseInt(formData.Value["userId"][0], 10, 64)
+	var userId = auth.UserIdFromContext(r.Context())
 	file, _, err := r.FormFile("img")
 	var filename = strconv.Itoa(int(serverId)) + ".jpg"
 	var generalChannelId = helper.GenerateUniqueId()
@@ -278,7 +342,7 @@ func Create(w http.ResponseWriter, r *http.Request) {
 		log.Printf("A new server has been added with ID %v, and the owner has been added. \n", serverId)
 	}
 
-	_, err = tx.Exec("INSERT INTO channels (server_id, channel_name, type, channel_id) VALUES (?, 'General', 1, ?), (?, 'General', 2, ?)", serverId, generalChannelId, serverId, generalVoiceId)
+	_, err = tx.Exec("INSERT INTO channels (server_id, channel_name, type, channel_id, position) VALUES (?, 'General', 1, ?, 0), (?, 'General', 2, ?, 1)", serverId, generalChannelId, serverId, generalVoiceId)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Failed add channels into database", http.StatusInternalServerError)
@@ -287,6 +351,13 @@ func Create(w http.ResponseWriter, r *http.Request) {
 		log.Println(`Standard channels 'general' and 'general' (voice) have been created.`)
 	}
 
+	_, err = tx.Exec("INSERT INTO roles (role_id, server_id, role_name, permissions, position) VALUES (?, ?, '@everyone', ?, 0)", serverId, serverId, int64(permissions.Default))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed add roles into database", http.StatusInternalServerError)
+		return
+	}
+
 	_, err = tx.Exec("INSERT INTO server_members ( server_id, user_id, server_owner) VALUES (?, ?, true)", serverId, userId)
 	if err != nil {
 		log.Println(err)
@@ -294,6 +365,8 @@ func Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	websocket.SubscribeUserToServer(userId, serverId)
+
 	var data = [1]createRes{{ServerId: strconv.Itoa(int(serverId)), ServerName: serverName, Img: imgCdnPath, GeneralChannelId: strconv.Itoa(int(generalChannelId))}}
 	res, err := json.Marshal(data)
 	w.Header().Set("Content-Type", "application/json")
@@ -309,7 +382,12 @@ func CreateInviteLink(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
-	serverId := body["serverId"].(string)
+	serverIdStr, _ := body["serverId"].(string)
+	serverId, err := strconv.ParseInt(serverIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
 	randomString, err := helper.GenerateRandomString(8)
 	inviteURL := "https://" + "localhost:3000" + "/invite/" + randomString
 	if err != nil {
@@ -330,6 +408,15 @@ func CreateInviteLink(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	status, err := checkServerPermission(tx, serverId, auth.UserIdFromContext(r.Context()), permissions.CreateInvite)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	_, err = tx.Exec("INSERT INTO invite_links (invite_code, server_id) VALUES (?, ?)", randomString, serverId)
 	if err != nil {
 		log.Println(err)
@@ -351,7 +438,7 @@ func CreateInviteLink(w http.ResponseWriter, r *http.Request) {
 func JoinServer(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	inviteCode := vars["code"]
-	userId, _ := strconv.ParseInt(vars["userId"], 10, 64)
+	userId := auth.UserIdFromContext(r.Context())
 	var serverName string
 	var img string
 	var createdAt time.Time
@@ -416,6 +503,9 @@ func JoinServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	joinedServerId, _ := strconv.ParseInt(serverId, 10, 64)
+	websocket.SubscribeUserToServer(userId, joinedServerId)
+
 	server := serverData{
 		ServerId:  serverId,
 		Name:      serverName,
@@ -445,7 +535,11 @@ func JoinServer(w http.ResponseWriter, r *http.Request) {
 
 func ServerMembers(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	serverId := vars["serverId"]
+	serverId, err := strconv.ParseInt(vars["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
 	var data []userData
 
 	tx, err := config.UseDBPool().DB.Begin()
@@ -460,7 +554,17 @@ func ServerMembers(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	rows, err := tx.Query("SELECT users.user_id, users.username, users.display_name, users.appearance, users.bio, users.status, users.last_seen, users.joined_at, users.pronouns, users.img_url, users.online FROM server_members JOIN users ON server_members.user_id = users.user_id WHERE server_members.server_id = ?", serverId)
+	requesterId := auth.UserIdFromContext(r.Context())
+	status, err := checkServerPermission(tx, serverId, requesterId, 0)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	rows, err := tx.Query("SELECT users.user_id, users.username, users.display_name, users.appearance, users.bio, users.status, users.last_seen, users.joined_at, users.pronouns, users.img_url FROM server_members JOIN users ON server_members.user_id = users.user_id WHERE server_members.server_id = ?", serverId)
 	if err != nil {
 		return
 	}
@@ -476,20 +580,38 @@ func ServerMembers(w http.ResponseWriter, r *http.Request) {
 		var lastSeen time.Time
 		var pronouns string
 		var img string
-		var online bool
 
-		err := rows.Scan(&userId, &username, &displayName, &appearance, &bio, &status, &lastSeen, &joinedAt, &pronouns, &img, &online)
+		err := rows.Scan(&userId, &username, &displayName, &appearance, &bio, &status, &lastSeen, &joinedAt, &pronouns, &img)
 		if err != nil {
 			log.Println(err)
 			http.Error(w, "Failed to scan row", http.StatusInternalServerError)
 			return
 		}
 
-		user := userData{UserId: userId, Username: username, DisplayName: displayName, Appearance: appearance, Bio: bio, JoinedAt: joinedAt, LastSeen: lastSeen, Pronouns: pronouns, Img: img, Online: online}
+		// The stored online flag would give away invisible users, so the live presence is used instead
+		memberId, _ := strconv.ParseInt(userId, 10, 64)
+		presence := websocket.PresenceOf(memberId)
+		if appearance == websocket.AppearanceInvisible && memberId != requesterId {
+			appearance = websocket.AppearanceOnline
+		}
+
+		user := userData{UserId: userId, Username: username, DisplayName: displayName, Appearance: appearance, Bio: bio, JoinedAt: joinedAt, LastSeen: lastSeen, Pronouns: pronouns, Img: img, Online: presence != websocket.StatusOffline, Presence: presence, Roles: []string{}}
 
 		data = append(data, user)
 	}
 
+	memberRoles, err := serverMemberRoles(tx, serverId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+	for i := range data {
+		if roles, ok := memberRoles[data[i].UserId]; ok {
+			data[i].Roles = roles
+		}
+	}
+
 	res, err := json.Marshal(data)
 	if err != nil {
 		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
@@ -500,3 +622,89 @@ func ServerMembers(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write(res)
 }
+
+// serverMemberRoles maps the user IDs of a server's members to the IDs of their roles.
+func serverMemberRoles(tx *sql.Tx, serverId int64) (map[string][]string, error) {
+	rows, err := tx.Query("SELECT user_id, role_id FROM member_roles WHERE server_id = ?", serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}(rows)
+
+	memberRoles := make(map[string][]string)
+	for rows.Next() {
+		var userId, roleId int64
+		if err := rows.Scan(&userId, &roleId); err != nil {
+			return nil, err
+		}
+		key := strconv.FormatInt(userId, 10)
+		memberRoles[key] = append(memberRoles[key], strconv.FormatInt(roleId, 10))
+	}
+	return memberRoles, rows.Err()
+}
+
+// visibleReadStates returns the read states of the channels of a server the user can view, in channel order.
+func visibleReadStates(tx *sql.Tx, serverId string, userId int64) ([]websocket.ReadState, error) {
+	id, err := strconv.ParseInt(serverId, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	channelPermissions, err := permissions.ServerChannelPermissions(tx, id, userId)
+	if err != nil {
+		return nil, err
+	}
+	states, err := websocket.ServerReadStates(tx, userId, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT channel_id FROM channels WHERE server_id = ? ORDER BY position, channel_id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readStates := []websocket.ReadState{}
+	for rows.Next() {
+		var channelId int64
+		if err := rows.Scan(&channelId); err != nil {
+			return nil, err
+		}
+		if state, ok := states[channelId]; ok && channelPermissions[channelId].Has(permissions.ViewChannel) {
+			readStates = append(readStates, state)
+		}
+	}
+	return readStates, rows.Err()
+}
+
+// checkServerPermission makes sure the user is a member of the server and has all of the given permissions.
+// On failure the returned status code describes the error.
+func checkServerPermission(tx *sql.Tx, serverId int64, userId int64, flags permissions.Permission) (int, error) {
+	err := permissions.CheckServerPermission(tx, serverId, userId, flags)
+	if errors.Is(err, permissions.ErrNotMember) || errors.Is(err, permissions.ErrMissingPermission) {
+		return http.StatusForbidden, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	res, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(res)
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"webserver/internal/auth"
+	"webserver/internal/websocket"
+)
+
+func CreateChannel(w http.ResponseWriter, r *http.Request) {
+	serverId, err := strconv.ParseInt(mux.Vars(r)["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	var fields websocket.ChannelFields
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	channel, err := websocket.CreateChannel(auth.UserIdFromContext(r.Context()), serverId, fields)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, channel)
+}
+
+func UpdateChannel(w http.ResponseWriter, r *http.Request) {
+	channelId, err := strconv.ParseInt(mux.Vars(r)["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	var fields websocket.ChannelFields
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	channel, err := websocket.UpdateChannel(auth.UserIdFromContext(r.Context()), channelId, fields)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, channel)
+}
+
+func DeleteChannel(w http.ResponseWriter, r *http.Request) {
+	channelId, err := strconv.ParseInt(mux.Vars(r)["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	err = websocket.DeleteChannel(auth.UserIdFromContext(r.Context()), channelId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReorderChannels takes a list of {channelId, position, parentId} entries and returns the moved channels.
+func ReorderChannels(w http.ResponseWriter, r *http.Request) {
+	serverId, err := strconv.ParseInt(mux.Vars(r)["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	var positions []websocket.ChannelPosition
+	if err := json.NewDecoder(r.Body).Decode(&positions); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	channels, err := websocket.ReorderChannels(auth.UserIdFromContext(r.Context()), serverId, positions)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, channels)
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"webserver/internal/auth"
+	"webserver/internal/websocket"
+)
+
+type createDmRequest struct {
+	Recipients []string `json:"recipients"`
+	Name       string   `json:"name"`
+}
+
+// PrivateChannels lists the DMs and group DMs of the authenticated user.
+func PrivateChannels(w http.ResponseWriter, r *http.Request) {
+	channels, err := websocket.ListPrivateChannels(auth.UserIdFromContext(r.Context()))
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, channels)
+}
+
+// CreatePrivateChannel opens a DM for a single recipient or creates a group DM for several.
+// An already existing DM is returned with 200 instead of 201.
+func CreatePrivateChannel(w http.ResponseWriter, r *http.Request) {
+	var body createDmRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	recipientIds := make([]int64, 0, len(body.Recipients))
+	for _, recipient := range body.Recipients {
+		recipientId, err := strconv.ParseInt(recipient, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		recipientIds = append(recipientIds, recipientId)
+	}
+
+	channel, created, err := websocket.CreatePrivateChannel(auth.UserIdFromContext(r.Context()), recipientIds, body.Name)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, channel)
+}
+
+// UpdateGroupDm takes a multipart form with an optional name and an optional img file as icon.
+func UpdateGroupDm(w http.ResponseWriter, r *http.Request) {
+	channelId, err := strconv.ParseInt(mux.Vars(r)["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	var name *string
+	if values, ok := r.MultipartForm.Value["name"]; ok && len(values) > 0 {
+		name = &values[0]
+	}
+
+	var iconUrl *string
+	file, _, err := r.FormFile("img")
+	if err == nil {
+		defer file.Close()
+
+		buf := bytes.NewBuffer(nil)
+		if _, err := io.Copy(buf, file); err != nil {
+			log.Println("Error copying file:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		wd, _ := os.Getwd()
+		filename := strconv.FormatInt(channelId, 10) + ".jpg"
+		imgDir := filepath.Join(wd, "../", "public", "img", "dmicon")
+		if err := os.MkdirAll(imgDir, 0755); err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(imgDir, filename), buf.Bytes(), 0644); err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		imgCdnPath := fmt.Sprintf("https://%s%s", r.Host, path.Join("/public/img/dmicon/", filename))
+		iconUrl = &imgCdnPath
+	}
+
+	channel, err := websocket.UpdateGroupDm(auth.UserIdFromContext(r.Context()), channelId, name, iconUrl)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, channel)
+}
+
+func AddDmRecipient(w http.ResponseWriter, r *http.Request) {
+	channelId, recipientId, ok := parseRecipientVars(w, r)
+	if !ok {
+		return
+	}
+
+	channel, err := websocket.AddRecipient(auth.UserIdFromContext(r.Context()), channelId, recipientId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, channel)
+}
+
+// RemoveDmRecipient removes a recipient from a group DM; removing yourself leaves it.
+func RemoveDmRecipient(w http.ResponseWriter, r *http.Request) {
+	channelId, recipientId, ok := parseRecipientVars(w, r)
+	if !ok {
+		return
+	}
+
+	err := websocket.RemoveRecipient(auth.UserIdFromContext(r.Context()), channelId, recipientId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseRecipientVars(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	vars := mux.Vars(r)
+	channelId, err := strconv.ParseInt(vars["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	recipientId, err := strconv.ParseInt(vars["userId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return channelId, recipientId, true
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"webserver/internal/auth"
+	"webserver/internal/helper"
+	"webserver/internal/websocket"
+)
+
+// maxEmojiSize is the largest image accepted for a custom emoji.
+const maxEmojiSize = 256 << 10
+
+// emojiExtensions maps the accepted image types of custom emoji to their file extension.
+var emojiExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+func Emojis(w http.ResponseWriter, r *http.Request) {
+	serverId, err := strconv.ParseInt(mux.Vars(r)["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	emojis, err := websocket.ListEmojis(auth.UserIdFromContext(r.Context()), serverId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, emojis)
+}
+
+// CreateEmoji uploads a custom emoji. The multipart form holds its name and a PNG, GIF or WebP image in img.
+func CreateEmoji(w http.ResponseWriter, r *http.Request) {
+	serverId, err := strconv.ParseInt(mux.Vars(r)["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	name := r.MultipartForm.Value["name"]
+	if len(name) == 0 {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if err := websocket.ValidateEmojiName(name[0]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("img")
+	if err != nil {
+		http.Error(w, "img is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buf, io.LimitReader(file, maxEmojiSize+1)); err != nil {
+		log.Println("Error copying file:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if buf.Len() > maxEmojiSize {
+		http.Error(w, "The image must not exceed 256 KiB", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(buf.Bytes())
+	extension, ok := emojiExtensions[contentType]
+	if !ok {
+		http.Error(w, "The image must be a PNG, GIF or WebP", http.StatusBadRequest)
+		return
+	}
+
+	emojiId := helper.GenerateUniqueId()
+	filename := strconv.FormatInt(emojiId, 10) + extension
+	imgPath := filepath.Join(emojiDir(), filename)
+	if err := os.MkdirAll(emojiDir(), 0755); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(imgPath, buf.Bytes(), 0644); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	imgCdnPath := fmt.Sprintf("https://%s%s", r.Host, path.Join("/public/img/emoji/", filename))
+	emoji, err := websocket.CreateEmoji(auth.UserIdFromContext(r.Context()), serverId, emojiId, name[0], imgCdnPath, isAnimated(contentType, buf.Bytes()))
+	if err != nil {
+		removeEmojiImage(imgPath)
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, emoji)
+}
+
+// isAnimated reports whether an emoji image is animated: every GIF counts as animated, and a WebP
+// if it has the ANIM or ANMF chunks of the animation extension.
+func isAnimated(contentType string, img []byte) bool {
+	switch contentType {
+	case "image/gif":
+		return true
+	case "image/webp":
+		// A WebP is a RIFF container: "RIFF", the file size and "WEBP", followed by chunks of a
+		// FourCC, a little-endian payload size and the payload, padded to an even length.
+		for offset := 12; offset+8 <= len(img); {
+			fourCC := string(img[offset : offset+4])
+			if fourCC == "ANIM" || fourCC == "ANMF" {
+				return true
+			}
+			size := int(binary.LittleEndian.Uint32(img[offset+4 : offset+8]))
+			if size < 0 || size > len(img) {
+				return false
+			}
+			offset += 8 + size + size&1
+		}
+	}
+	return false
+}
+
+func DeleteEmoji(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverId, err := strconv.ParseInt(vars["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+	emojiId, err := strconv.ParseInt(vars["emojiId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid emoji ID", http.StatusBadRequest)
+		return
+	}
+
+	emoji, err := websocket.DeleteEmoji(auth.UserIdFromContext(r.Context()), serverId, emojiId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	removeEmojiImage(filepath.Join(emojiDir(), path.Base(emoji.Url)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func emojiDir() string {
+	wd, _ := os.Getwd()
+	return filepath.Join(wd, "../", "public", "img", "emoji")
+}
+
+func removeEmojiImage(imgPath string) {
+	if err := os.Remove(imgPath); err != nil && !os.IsNotExist(err) {
+		log.Println("Error removing emoji image:", err)
+	}
+}
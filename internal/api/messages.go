@@ -0,0 +1,509 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"webserver/internal/auth"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/websocket"
+)
+
+const (
+	defaultMessageLimit = 50
+	maxMessageLimit     = 100
+)
+
+type messageAuthor struct {
+	UserId      string `json:"userId"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Img         string `json:"img"`
+}
+
+type messageData struct {
+	MessageId string        `json:"messageId"`
+	ChannelId string        `json:"channelId"`
+	Author    messageAuthor `json:"author"`
+	Message   string        `json:"message"`
+	SentAt    time.Time     `json:"sentAt"`
+	EditedAt  *time.Time    `json:"editedAt"`
+	Deleted   bool          `json:"deleted"`
+
+	ReplyTo  *websocket.MessageReference `json:"replyTo"`
+	Mentions websocket.Mentions          `json:"mentions"`
+
+	Reactions []websocket.Reaction `json:"reactions"`
+	// Emojis resolves the custom emoji used in Message
+	Emojis []websocket.CustomEmoji `json:"emojis"`
+	// Thread is the thread started on the message, if any
+	Thread *websocket.Thread `json:"thread"`
+}
+
+type messageEditRequest struct {
+	Message string `json:"message"`
+}
+
+const messageColumns = `SELECT m.message_id, m.channel_id, m.user_id, COALESCE(u.username, ''), COALESCE(u.display_name, ''), COALESCE(u.img_url, ''), m.message_text, m.sent_at, m.edited_at, m.deleted_at IS NOT NULL, m.reply_to_message_id
+	FROM messages m LEFT JOIN users u ON u.user_id = m.user_id`
+
+// Messages returns a page of a channel's history in chronological order.
+// The page is selected with one of the before, after or around query parameters,
+// each holding a message ID; without any of them the latest messages are returned.
+func Messages(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelId, err := strconv.ParseInt(vars["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	userId := auth.UserIdFromContext(r.Context())
+
+	query := r.URL.Query()
+	limit := defaultMessageLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxMessageLimit {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var anchorParam, anchorValue string
+	for _, param := range []string{"before", "after", "around"} {
+		if value := query.Get(param); value != "" {
+			if anchorParam != "" {
+				http.Error(w, "Only one of before, after and around may be set", http.StatusBadRequest)
+				return
+			}
+			anchorParam, anchorValue = param, value
+		}
+	}
+
+	var anchorId int64
+	if anchorParam != "" {
+		anchorId, err = strconv.ParseInt(anchorValue, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := config.UseDBPool().DB.Begin()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := config.UseDBPool().RollbackOrCommit(tx, err == nil); err != nil {
+			log.Println("Error rolling back transaction:", err)
+		}
+	}()
+
+	status, err := checkChannelPermission(tx, channelId, userId, permissions.ViewChannel|permissions.ReadMessageHistory)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if anchorParam != "" {
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM messages WHERE message_id = ? AND channel_id = ?)", anchorId, channelId).Scan(&exists)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			err = errors.New("anchor message not found")
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	var data []messageData
+	switch anchorParam {
+	case "before":
+		data, err = queryOlderMessages(tx, channelId, anchorId, false, limit)
+	case "after":
+		data, err = queryNewerMessages(tx, channelId, anchorId, false, limit)
+	case "around":
+		var older []messageData
+		older, err = queryOlderMessages(tx, channelId, anchorId, false, limit/2)
+		if err == nil {
+			data, err = queryNewerMessages(tx, channelId, anchorId, true, limit-len(older))
+			data = append(older, data...)
+		}
+	default:
+		data, err = queryLatestMessages(tx, channelId, limit)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+
+	if data == nil {
+		data = []messageData{}
+	}
+
+	err = attachReactions(tx, userId, data)
+	if err == nil {
+		err = attachReplies(tx, data)
+	}
+	if err == nil {
+		err = attachMentions(tx, data)
+	}
+	if err == nil {
+		err = attachEmojis(tx, data)
+	}
+	if err == nil {
+		err = attachThreads(tx, data)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
+
+func EditMessage(w http.ResponseWriter, r *http.Request) {
+	messageId, err := strconv.ParseInt(mux.Vars(r)["messageId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var body messageEditRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err = websocket.EditMessage(auth.UserIdFromContext(r.Context()), messageId, body.Message)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	messageId, err := strconv.ParseInt(mux.Vars(r)["messageId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	err = websocket.DeleteMessage(auth.UserIdFromContext(r.Context()), messageId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MessageEdits returns the edit history of a message, oldest version first.
+func MessageEdits(w http.ResponseWriter, r *http.Request) {
+	messageId, err := strconv.ParseInt(mux.Vars(r)["messageId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	edits, err := websocket.MessageEdits(auth.UserIdFromContext(r.Context()), messageId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, edits)
+}
+
+// AckMessage marks a channel as read up to and including a message and returns the new read state.
+func AckMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelId, err := strconv.ParseInt(vars["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+	messageId, err := strconv.ParseInt(vars["messageId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	state, err := websocket.AckMessage(auth.UserIdFromContext(r.Context()), channelId, messageId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, state)
+}
+
+// AddReaction reacts to a message with the emoji of the route, either a Unicode emoji or the ID of a custom emoji.
+func AddReaction(w http.ResponseWriter, r *http.Request) {
+	channelId, messageId, ok := parseReactionVars(w, r)
+	if !ok {
+		return
+	}
+
+	err := websocket.AddReaction(auth.UserIdFromContext(r.Context()), channelId, messageId, mux.Vars(r)["emoji"])
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveReaction removes the user's own reaction with the emoji of the route.
+func RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	channelId, messageId, ok := parseReactionVars(w, r)
+	if !ok {
+		return
+	}
+
+	err := websocket.RemoveReaction(auth.UserIdFromContext(r.Context()), channelId, messageId, mux.Vars(r)["emoji"])
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseReactionVars(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	vars := mux.Vars(r)
+	channelId, err := strconv.ParseInt(vars["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	messageId, err := strconv.ParseInt(vars["messageId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return channelId, messageId, true
+}
+
+// checkChannelPermission makes sure the channel exists and the user has all of the given permissions on it.
+// On failure the returned status code describes the error.
+func checkChannelPermission(tx *sql.Tx, channelId int64, userId int64, flags permissions.Permission) (int, error) {
+	_, err := permissions.CheckChannelPermission(tx, channelId, userId, flags)
+	if errors.Is(err, permissions.ErrChannelNotFound) {
+		return http.StatusNotFound, err
+	} else if errors.Is(err, permissions.ErrNotMember) || errors.Is(err, permissions.ErrMissingPermission) {
+		return http.StatusForbidden, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func queryLatestMessages(tx *sql.Tx, channelId int64, limit int) ([]messageData, error) {
+	data, err := queryMessages(tx, messageColumns+` WHERE m.channel_id = ?
+		ORDER BY m.sent_at DESC, m.message_id DESC LIMIT ?`, channelId, limit)
+	reverseMessages(data)
+	return data, err
+}
+
+func queryOlderMessages(tx *sql.Tx, channelId int64, anchorId int64, inclusive bool, limit int) ([]messageData, error) {
+	operator := "<"
+	if inclusive {
+		operator = "<="
+	}
+	data, err := queryMessages(tx, messageColumns+` WHERE m.channel_id = ?
+		AND (m.sent_at, m.message_id) `+operator+` (SELECT sent_at, message_id FROM messages WHERE message_id = ?)
+		ORDER BY m.sent_at DESC, m.message_id DESC LIMIT ?`, channelId, anchorId, limit)
+	reverseMessages(data)
+	return data, err
+}
+
+func queryNewerMessages(tx *sql.Tx, channelId int64, anchorId int64, inclusive bool, limit int) ([]messageData, error) {
+	operator := ">"
+	if inclusive {
+		operator = ">="
+	}
+	return queryMessages(tx, messageColumns+` WHERE m.channel_id = ?
+		AND (m.sent_at, m.message_id) `+operator+` (SELECT sent_at, message_id FROM messages WHERE message_id = ?)
+		ORDER BY m.sent_at ASC, m.message_id ASC LIMIT ?`, channelId, anchorId, limit)
+}
+
+func queryMessages(tx *sql.Tx, query string, args ...interface{}) ([]messageData, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}(rows)
+
+	var data []messageData
+	for rows.Next() {
+		var messageId, channelId, userId int64
+		var editedAt sql.NullTime
+		var replyToId sql.NullInt64
+		var message messageData
+		err = rows.Scan(&messageId, &channelId, &userId, &message.Author.Username, &message.Author.DisplayName, &message.Author.Img, &message.Message, &message.SentAt, &editedAt, &message.Deleted, &replyToId)
+		if err != nil {
+			return nil, err
+		}
+		if editedAt.Valid {
+			message.EditedAt = &editedAt.Time
+		}
+		if replyToId.Valid {
+			// Filled in by attachReplies
+			message.ReplyTo = &websocket.MessageReference{MessageId: strconv.FormatInt(replyToId.Int64, 10)}
+		}
+		message.MessageId = strconv.FormatInt(messageId, 10)
+		message.ChannelId = strconv.FormatInt(channelId, 10)
+		message.Author.UserId = strconv.FormatInt(userId, 10)
+		data = append(data, message)
+	}
+
+	return data, rows.Err()
+}
+
+// attachReactions fills in the reactions of the messages as seen by userId.
+func attachReactions(tx *sql.Tx, userId int64, data []messageData) error {
+	messageIds := make([]int64, len(data))
+	for i, message := range data {
+		messageIds[i], _ = strconv.ParseInt(message.MessageId, 10, 64)
+	}
+
+	reactions, err := websocket.MessageReactions(tx, userId, messageIds)
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		data[i].Reactions = reactions[messageIds[i]]
+		if data[i].Reactions == nil {
+			data[i].Reactions = []websocket.Reaction{}
+		}
+	}
+	return nil
+}
+
+// attachReplies fills in the messages replied to. Deleted messages keep their ID and author only.
+func attachReplies(tx *sql.Tx, data []messageData) error {
+	var replyToIds []int64
+	for _, message := range data {
+		if message.ReplyTo != nil {
+			replyToId, _ := strconv.ParseInt(message.ReplyTo.MessageId, 10, 64)
+			replyToIds = append(replyToIds, replyToId)
+		}
+	}
+
+	references, err := websocket.MessageReferences(tx, replyToIds)
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		if data[i].ReplyTo == nil {
+			continue
+		}
+		replyToId, _ := strconv.ParseInt(data[i].ReplyTo.MessageId, 10, 64)
+		if reference, ok := references[replyToId]; ok {
+			data[i].ReplyTo = reference
+		}
+	}
+	return nil
+}
+
+// attachMentions fills in the mentions stored with the messages.
+func attachMentions(tx *sql.Tx, data []messageData) error {
+	messageIds := make([]int64, len(data))
+	for i, message := range data {
+		messageIds[i], _ = strconv.ParseInt(message.MessageId, 10, 64)
+	}
+
+	mentions, err := websocket.MessageMentions(tx, messageIds)
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		data[i].Mentions = mentions[messageIds[i]]
+	}
+	return nil
+}
+
+// attachEmojis fills in the custom emoji used in the text of the messages.
+// Emoji that have since been deleted are left out.
+func attachEmojis(tx *sql.Tx, data []messageData) error {
+	var emojiIds []int64
+	for _, message := range data {
+		emojiIds = append(emojiIds, websocket.ParseEmojiTokens(message.Message)...)
+	}
+
+	emojis, err := websocket.ResolveEmojis(tx, emojiIds)
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		data[i].Emojis = []websocket.CustomEmoji{}
+		for _, emojiId := range websocket.ParseEmojiTokens(data[i].Message) {
+			if emoji, ok := emojis[emojiId]; ok {
+				data[i].Emojis = append(data[i].Emojis, emoji)
+			}
+		}
+	}
+	return nil
+}
+
+// attachThreads fills in the threads started on the messages, with their reply counts.
+func attachThreads(tx *sql.Tx, data []messageData) error {
+	messageIds := make([]int64, len(data))
+	for i, message := range data {
+		messageIds[i], _ = strconv.ParseInt(message.MessageId, 10, 64)
+	}
+
+	threads, err := websocket.MessageThreads(tx, messageIds)
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		if thread, ok := threads[messageIds[i]]; ok {
+			data[i].Thread = &thread
+		}
+	}
+	return nil
+}
+
+func reverseMessages(data []messageData) {
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"webserver/internal/auth"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/websocket"
+)
+
+type overwriteRequest struct {
+	Type  int                    `json:"type"`
+	Allow permissions.Permission `json:"allow"`
+	Deny  permissions.Permission `json:"deny"`
+}
+
+// ChannelOverwrites lists the permission overwrites of a channel.
+func ChannelOverwrites(w http.ResponseWriter, r *http.Request) {
+	channelId, err := strconv.ParseInt(mux.Vars(r)["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	db := config.UseDBPool().DB
+	_, err = permissions.CheckChannelPermission(db, channelId, auth.UserIdFromContext(r.Context()), permissions.ViewChannel)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	overwrites, err := permissions.ListOverwrites(db, channelId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, overwrites)
+}
+
+// SetChannelOverwrite creates or replaces the overwrite of a role (type 0) or member (type 1) on a channel.
+func SetChannelOverwrite(w http.ResponseWriter, r *http.Request) {
+	channelId, targetId, ok := parseOverwriteVars(w, r)
+	if !ok {
+		return
+	}
+
+	var body overwriteRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	overwrite, err := permissions.SetOverwrite(auth.UserIdFromContext(r.Context()), channelId, targetId, body.Type, body.Allow, body.Deny)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	broadcastOverwrites(channelId)
+	writeJSON(w, http.StatusOK, overwrite)
+}
+
+func DeleteChannelOverwrite(w http.ResponseWriter, r *http.Request) {
+	channelId, targetId, ok := parseOverwriteVars(w, r)
+	if !ok {
+		return
+	}
+
+	err := permissions.DeleteOverwrite(auth.UserIdFromContext(r.Context()), channelId, targetId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	broadcastOverwrites(channelId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// broadcastOverwrites tells the server that the overwrites of a channel changed,
+// so clients can re-evaluate which channels they are able to see.
+func broadcastOverwrites(channelId int64) {
+	db := config.UseDBPool().DB
+	var serverId int64
+	if err := db.QueryRow("SELECT server_id FROM channels WHERE channel_id = ?", channelId).Scan(&serverId); err != nil {
+		return
+	}
+	overwrites, err := permissions.ListOverwrites(db, channelId)
+	if err != nil {
+		return
+	}
+
+	websocket.BroadcastToServer(serverId, "channel-overwrites-updated", map[string]interface{}{
+		"channelId":  strconv.FormatInt(channelId, 10),
+		"serverId":   strconv.FormatInt(serverId, 10),
+		"overwrites": overwrites,
+	})
+}
+
+func parseOverwriteVars(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	vars := mux.Vars(r)
+	channelId, err := strconv.ParseInt(vars["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	targetId, err := strconv.ParseInt(vars["targetId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid target ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return channelId, targetId, true
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"webserver/internal/auth"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/websocket"
+)
+
+type memberRolesData struct {
+	ServerId string   `json:"serverId"`
+	UserId   string   `json:"userId"`
+	Roles    []string `json:"roles"`
+}
+
+func Roles(w http.ResponseWriter, r *http.Request) {
+	serverId, err := strconv.ParseInt(mux.Vars(r)["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	db := config.UseDBPool().DB
+	err = permissions.CheckServerPermission(db, serverId, auth.UserIdFromContext(r.Context()), 0)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	roles, err := permissions.ListRoles(db, serverId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, roles)
+}
+
+func CreateRole(w http.ResponseWriter, r *http.Request) {
+	serverId, err := strconv.ParseInt(mux.Vars(r)["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	var fields permissions.RoleUpdate
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	role, err := permissions.CreateRole(auth.UserIdFromContext(r.Context()), serverId, fields)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	websocket.BroadcastToServer(serverId, "role-created", role)
+	writeJSON(w, http.StatusCreated, role)
+}
+
+func UpdateRole(w http.ResponseWriter, r *http.Request) {
+	serverId, roleId, ok := parseRoleVars(w, r)
+	if !ok {
+		return
+	}
+
+	var fields permissions.RoleUpdate
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	role, err := permissions.UpdateRole(auth.UserIdFromContext(r.Context()), serverId, roleId, fields)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	websocket.BroadcastToServer(serverId, "role-updated", role)
+	writeJSON(w, http.StatusOK, role)
+}
+
+func DeleteRole(w http.ResponseWriter, r *http.Request) {
+	serverId, roleId, ok := parseRoleVars(w, r)
+	if !ok {
+		return
+	}
+
+	err := permissions.DeleteRole(auth.UserIdFromContext(r.Context()), serverId, roleId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	websocket.BroadcastToServer(serverId, "role-deleted", map[string]interface{}{"serverId": strconv.FormatInt(serverId, 10), "roleId": strconv.FormatInt(roleId, 10)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReorderRoles takes a list of {roleId, position} pairs and returns all roles of the server.
+func ReorderRoles(w http.ResponseWriter, r *http.Request) {
+	serverId, err := strconv.ParseInt(mux.Vars(r)["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	var positions []permissions.RolePosition
+	if err := json.NewDecoder(r.Body).Decode(&positions); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	roles, err := permissions.ReorderRoles(auth.UserIdFromContext(r.Context()), serverId, positions)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	moved := make(map[string]bool)
+	for _, position := range positions {
+		moved[position.RoleId] = true
+	}
+	for _, role := range roles {
+		if moved[role.RoleId] {
+			websocket.BroadcastToServer(serverId, "role-updated", role)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, roles)
+}
+
+func AddMemberRole(w http.ResponseWriter, r *http.Request) {
+	setMemberRole(w, r, true)
+}
+
+func RemoveMemberRole(w http.ResponseWriter, r *http.Request) {
+	setMemberRole(w, r, false)
+}
+
+func setMemberRole(w http.ResponseWriter, r *http.Request, assign bool) {
+	serverId, roleId, ok := parseRoleVars(w, r)
+	if !ok {
+		return
+	}
+	userId, err := strconv.ParseInt(mux.Vars(r)["userId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	err = permissions.SetMemberRole(auth.UserIdFromContext(r.Context()), serverId, userId, roleId, assign)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	roles, err := permissions.MemberRoleIds(config.UseDBPool().DB, serverId, userId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	data := memberRolesData{ServerId: strconv.FormatInt(serverId, 10), UserId: strconv.FormatInt(userId, 10), Roles: roles}
+	websocket.BroadcastToServer(serverId, "member-roles-updated", data)
+	writeJSON(w, http.StatusOK, data)
+}
+
+func parseRoleVars(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	vars := mux.Vars(r)
+	serverId, err := strconv.ParseInt(vars["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	roleId, err := strconv.ParseInt(vars["roleId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid role ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return serverId, roleId, true
+}
+
+// writePermissionError answers a failed request with the status websocket.ErrorStatus maps its error to.
+func writePermissionError(w http.ResponseWriter, err error) {
+	status := websocket.ErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Println(err)
+		http.Error(w, "Database operation could not be executed", status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"webserver/internal/auth"
+	"webserver/internal/websocket"
+)
+
+type threadCreateRequest struct {
+	Name               string `json:"name"`
+	AutoArchiveMinutes int    `json:"autoArchiveMinutes"`
+}
+
+// CreateThread starts a thread on a message. autoArchiveMinutes defaults to a day.
+func CreateThread(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelId, err := strconv.ParseInt(vars["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+	messageId, err := strconv.ParseInt(vars["messageId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var body threadCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	thread, err := websocket.CreateThread(auth.UserIdFromContext(r.Context()), channelId, messageId, body.Name, body.AutoArchiveMinutes)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, thread)
+}
+
+// Threads lists the active threads of a channel, or the archived ones with ?archived=true.
+func Threads(w http.ResponseWriter, r *http.Request) {
+	channelId, err := strconv.ParseInt(mux.Vars(r)["channelId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	archived := r.URL.Query().Get("archived") == "true"
+	threads, err := websocket.ListThreads(auth.UserIdFromContext(r.Context()), channelId, archived)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, threads)
+}
+
+func UpdateThread(w http.ResponseWriter, r *http.Request) {
+	threadId, err := strconv.ParseInt(mux.Vars(r)["threadId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid thread ID", http.StatusBadRequest)
+		return
+	}
+
+	var fields websocket.ThreadFields
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	thread, err := websocket.UpdateThread(auth.UserIdFromContext(r.Context()), threadId, fields)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, thread)
+}
+
+func ThreadMembers(w http.ResponseWriter, r *http.Request) {
+	threadId, err := strconv.ParseInt(mux.Vars(r)["threadId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid thread ID", http.StatusBadRequest)
+		return
+	}
+
+	members, err := websocket.ThreadMembers(auth.UserIdFromContext(r.Context()), threadId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, members)
+}
+
+func JoinThread(w http.ResponseWriter, r *http.Request) {
+	setThreadMembership(w, r, true)
+}
+
+func LeaveThread(w http.ResponseWriter, r *http.Request) {
+	setThreadMembership(w, r, false)
+}
+
+func setThreadMembership(w http.ResponseWriter, r *http.Request, join bool) {
+	threadId, err := strconv.ParseInt(mux.Vars(r)["threadId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid thread ID", http.StatusBadRequest)
+		return
+	}
+
+	userId := auth.UserIdFromContext(r.Context())
+	if join {
+		err = websocket.JoinThread(userId, threadId)
+	} else {
+		err = websocket.LeaveThread(userId, threadId)
+	}
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,12 +3,15 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
-	"github.com/dgrijalva/jwt-go"
+	"errors"
+	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
+	"webserver/internal/auth"
 	"webserver/internal/config"
 	"webserver/internal/helper"
 )
@@ -23,18 +26,18 @@ type user struct {
 	DisplayName    string `json:"displayName"`
 }
 
-type JWTClaims struct {
-	UserID   int64  `json:"userId"`
-	Username string `json:"username"`
-	jwt.StandardClaims
+type authResponse struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refreshToken"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	DisplayName  string    `json:"displayName"`
+	Username     string    `json:"username"`
+	UserId       string    `json:"userId"`
+	Img          string    `json:"img"`
 }
 
-type authResponse struct {
-	Token       string `json:"token"`
-	DisplayName string `json:"displayName"`
-	Username    string `json:"username"`
-	UserId      string `json:"userId"`
-	Img         string `json:"img"`
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
 }
 
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -59,13 +62,14 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := generateJWTToken(userCredentials)
+	tokens, err := auth.CreateSession(user.Id, user.Username, r.UserAgent(), clientIp(r))
 	if err != nil {
+		log.Println(err)
 		http.Error(w, "Error generating JWT token", http.StatusInternalServerError)
 		return
 	}
 
-	var data = authResponse{Token: token, DisplayName: user.DisplayName, Username: user.Username, UserId: strconv.FormatInt(user.Id, 10), Img: user.ImgUrl}
+	var data = authResponse{Token: tokens.AccessToken, RefreshToken: tokens.RefreshToken, ExpiresAt: tokens.ExpiresAt, DisplayName: user.DisplayName, Username: user.Username, UserId: strconv.FormatInt(user.Id, 10), Img: user.ImgUrl}
 	res, err := json.Marshal(data)
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
@@ -95,13 +99,14 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := generateJWTToken(user)
+	tokens, err := auth.CreateSession(user.Id, user.Username, r.UserAgent(), clientIp(r))
 	if err != nil {
+		log.Println(err)
 		http.Error(w, "Error generating JWT token", http.StatusInternalServerError)
 		return
 	}
 
-	var data = authResponse{Token: token, DisplayName: user.DisplayName, Username: user.Username, UserId: strconv.FormatInt(user.Id, 10), Img: user.ImgUrl}
+	var data = authResponse{Token: tokens.AccessToken, RefreshToken: tokens.RefreshToken, ExpiresAt: tokens.ExpiresAt, DisplayName: user.DisplayName, Username: user.Username, UserId: strconv.FormatInt(user.Id, 10), Img: user.ImgUrl}
 	res, err := json.Marshal(data)
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(res)
@@ -110,25 +115,101 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// AuthMiddleware rejects requests without a valid JWT of an active session and stores the claims of
+// the authenticated user in the request context, see auth.UserIdFromContext.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
+		claims, err := auth.Authenticate(auth.TokenFromHeader(r))
+		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return config.JwtKey, nil
-		})
+		next.ServeHTTP(w, r.WithContext(auth.WithClaims(r.Context(), claims)))
+	})
+}
 
-		if err != nil || !token.Valid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+// RefreshHandler exchanges a refresh token for a new access and refresh token.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var body refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
 
-		next.ServeHTTP(w, r)
-	})
+	tokens, err := auth.RefreshSession(body.RefreshToken)
+	if errors.Is(err, auth.ErrRefreshTokenInvalid) || errors.Is(err, auth.ErrSessionRevoked) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error refreshing session", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := json.Marshal(authResponse{Token: tokens.AccessToken, RefreshToken: tokens.RefreshToken, ExpiresAt: tokens.ExpiresAt})
+	if err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
+
+// LogoutHandler revokes the session the request was authenticated with.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.ClaimsFromContext(r.Context())
+
+	err := auth.RevokeSession(claims.UserID, claims.SessionID)
+	if err != nil && !errors.Is(err, auth.ErrSessionNotFound) {
+		log.Println(err)
+		http.Error(w, "Error revoking session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionsHandler lists the active sessions of the authenticated user.
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.ClaimsFromContext(r.Context())
+
+	sessions, err := auth.ListSessions(claims.UserID, claims.SessionID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := json.Marshal(sessions)
+	if err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
+
+// RevokeSessionHandler revokes one of the sessions of the authenticated user, e.g. a lost device.
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionId := mux.Vars(r)["sessionId"]
+	userId := auth.UserIdFromContext(r.Context())
+
+	err := auth.RevokeSession(userId, sessionId)
+	if errors.Is(err, auth.ErrSessionNotFound) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error revoking session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func validateUserCredentials(credentials user) (bool, user, error) {
@@ -162,7 +243,7 @@ func validateUserCredentials(credentials user) (bool, user, error) {
 	var displayName string
 
 	for rows.Next() {
-		err = rows.Scan(&userId, &username, &displayName, &password)
+		err = rows.Scan(&userId, &username, &password, &displayName)
 	}
 
 	log.Println(userId, username, displayName, password)
@@ -227,20 +308,10 @@ func checkIfUserExists(tx *sql.Tx, username, email string) (bool, error) {
 	return count > 0, nil
 }
 
-func generateJWTToken(user user) (string, error) {
-	claims := JWTClaims{
-		UserID:   user.Id,
-		Username: user.Username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Hour * 24).Unix(), // Token expires in 24 hours
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(config.JwtKey)
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return "", err
+		return r.RemoteAddr
 	}
-
-	return tokenString, nil
+	return host
 }
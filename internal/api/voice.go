@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"webserver/internal/auth"
+	"webserver/internal/webrtc"
+)
+
+// VoiceStates lists who is connected to the voice channels of a server.
+func VoiceStates(w http.ResponseWriter, r *http.Request) {
+	serverId, err := strconv.ParseInt(mux.Vars(r)["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	states, err := webrtc.VoiceStates(auth.UserIdFromContext(r.Context()), serverId)
+	if err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, states)
+}
+
+// UpdateVoiceState server mutes or deafens a member.
+func UpdateVoiceState(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverId, err := strconv.ParseInt(vars["serverId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+	userId, err := strconv.ParseInt(vars["userId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var fields webrtc.ServerVoiceFields
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := webrtc.UpdateServerVoiceState(auth.UserIdFromContext(r.Context()), serverId, userId, fields); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
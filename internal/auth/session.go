@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/helper"
+)
+
+const (
+	AccessTokenLifetime  = 15 * time.Minute
+	RefreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+var (
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrSessionRevoked      = errors.New("session has been revoked or is expired")
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid")
+)
+
+// Session is a login of a user on one device, kept alive by its refresh token.
+type Session struct {
+	SessionId  string    `json:"sessionId"`
+	UserAgent  string    `json:"userAgent"`
+	IpAddress  string    `json:"ipAddress"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+// TokenPair is handed to the client on login and on every refresh.
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+var revocationListeners struct {
+	mu        sync.Mutex
+	listeners []func(sessionId string)
+}
+
+// OnSessionRevoked registers a function that is called after a session has been revoked,
+// e.g. to close the WebSocket connections that were opened with it.
+func OnSessionRevoked(listener func(sessionId string)) {
+	revocationListeners.mu.Lock()
+	revocationListeners.listeners = append(revocationListeners.listeners, listener)
+	revocationListeners.mu.Unlock()
+}
+
+func notifySessionRevoked(sessionId string) {
+	revocationListeners.mu.Lock()
+	listeners := append([]func(string){}, revocationListeners.listeners...)
+	revocationListeners.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(sessionId)
+	}
+}
+
+// Authenticate validates an access token and makes sure its session has not been revoked.
+func Authenticate(tokenString string) (*JWTClaims, error) {
+	claims, err := ParseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := IsSessionActive(claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, ErrSessionRevoked
+	}
+
+	return claims, nil
+}
+
+// CreateSession starts a new session for a user that just logged in or registered.
+func CreateSession(userId int64, username string, userAgent string, ipAddress string) (TokenPair, error) {
+	sessionId := uuid.NewString()
+	refreshToken, refreshTokenHash, err := newRefreshToken(sessionId)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	tx, err := config.UseDBPool().DB.Begin()
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	var accessToken string
+	var expiresAt time.Time
+	_, err = tx.Exec("INSERT INTO sessions (session_id, user_id, refresh_token_hash, user_agent, ip_address, expires_at) VALUES (?,?,?,?,?,?)",
+		sessionId, userId, refreshTokenHash, userAgent, ipAddress, time.Now().Add(RefreshTokenLifetime).UTC())
+	if err == nil {
+		accessToken, expiresAt, err = newAccessToken(userId, username, sessionId)
+	}
+
+	if err := config.UseDBPool().RollbackOrCommit(tx, err == nil); err != nil {
+		return TokenPair{}, err
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{AccessToken: accessToken, RefreshToken: refreshToken, ExpiresAt: expiresAt}, nil
+}
+
+// RefreshSession exchanges a refresh token for a new token pair. Every refresh token can only be
+// used once; presenting an already rotated token revokes the whole session, since it means the
+// token has leaked.
+func RefreshSession(refreshToken string) (TokenPair, error) {
+	sessionId, _, found := strings.Cut(refreshToken, ".")
+	if !found {
+		return TokenPair{}, ErrRefreshTokenInvalid
+	}
+
+	tx, err := config.UseDBPool().DB.Begin()
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	tokens, reused, err := rotateRefreshToken(tx, sessionId, refreshToken)
+
+	// The revocation of a reused token is committed even though the refresh fails
+	if err := config.UseDBPool().RollbackOrCommit(tx, err == nil || reused); err != nil {
+		return TokenPair{}, err
+	}
+	if reused {
+		notifySessionRevoked(sessionId)
+	}
+	return tokens, err
+}
+
+// rotateRefreshToken replaces the refresh token of a session inside tx. If the presented token
+// is the one that was replaced last, the session is revoked instead and reused is true.
+func rotateRefreshToken(tx *sql.Tx, sessionId string, refreshToken string) (tokens TokenPair, reused bool, err error) {
+	var userId int64
+	var username string
+	var currentHash string
+	var previousHash sql.NullString
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+
+	err = tx.QueryRow("SELECT s.user_id, u.username, s.refresh_token_hash, s.previous_token_hash, s.expires_at, s.revoked_at FROM sessions s JOIN users u ON u.user_id = s.user_id WHERE s.session_id = ?", sessionId).
+		Scan(&userId, &username, &currentHash, &previousHash, &expiresAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TokenPair{}, false, ErrRefreshTokenInvalid
+	} else if err != nil {
+		return TokenPair{}, false, err
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return TokenPair{}, false, ErrSessionRevoked
+	}
+
+	presentedHash := hashRefreshToken(refreshToken)
+	if previousHash.Valid && hashesEqual(presentedHash, previousHash.String) {
+		log.Printf("Refresh token of session %s was reused, revoking the session \n", sessionId)
+		if _, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE session_id = ?", time.Now().UTC(), sessionId); err != nil {
+			return TokenPair{}, false, err
+		}
+		return TokenPair{}, true, ErrSessionRevoked
+	}
+	if !hashesEqual(presentedHash, currentHash) {
+		return TokenPair{}, false, ErrRefreshTokenInvalid
+	}
+
+	newToken, newHash, err := newRefreshToken(sessionId)
+	if err != nil {
+		return TokenPair{}, false, err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET refresh_token_hash = ?, previous_token_hash = ?, last_used_at = ?, expires_at = ? WHERE session_id = ?",
+		newHash, currentHash, time.Now().UTC(), time.Now().Add(RefreshTokenLifetime).UTC(), sessionId)
+	if err != nil {
+		return TokenPair{}, false, err
+	}
+
+	accessToken, accessExpiresAt, err := newAccessToken(userId, username, sessionId)
+	if err != nil {
+		return TokenPair{}, false, err
+	}
+
+	return TokenPair{AccessToken: accessToken, RefreshToken: newToken, ExpiresAt: accessExpiresAt}, false, nil
+}
+
+// RevokeSession revokes a session of the given user and notifies all revocation listeners.
+func RevokeSession(userId int64, sessionId string) error {
+	tx, err := config.UseDBPool().DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE session_id = ? AND user_id = ? AND revoked_at IS NULL", time.Now().UTC(), sessionId, userId)
+	if err == nil {
+		var affected int64
+		affected, err = res.RowsAffected()
+		if err == nil && affected == 0 {
+			err = ErrSessionNotFound
+		}
+	}
+
+	if err := config.UseDBPool().RollbackOrCommit(tx, err == nil); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	notifySessionRevoked(sessionId)
+	return nil
+}
+
+// IsSessionActive reports whether the session exists, is not revoked and has not expired.
+func IsSessionActive(sessionId string) (bool, error) {
+	var active bool
+	err := config.UseDBPool().DB.QueryRow("SELECT EXISTS(SELECT 1 FROM sessions WHERE session_id = ? AND revoked_at IS NULL AND expires_at > ?)", sessionId, time.Now().UTC()).Scan(&active)
+	if err != nil {
+		return false, err
+	}
+	return active, nil
+}
+
+// ListSessions returns the active sessions of a user, marking the one with the given ID as current.
+func ListSessions(userId int64, currentSessionId string) ([]Session, error) {
+	rows, err := config.UseDBPool().DB.Query("SELECT session_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_used_at, expires_at FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_used_at DESC", userId, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}(rows)
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.SessionId, &session.UserAgent, &session.IpAddress, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		session.Current = session.SessionId == currentSessionId
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func newAccessToken(userId int64, username string, sessionId string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(AccessTokenLifetime)
+	claims := JWTClaims{
+		UserID:    userId,
+		Username:  username,
+		SessionID: sessionId,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expiresAt.Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(config.JwtKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return tokenString, expiresAt, nil
+}
+
+// newRefreshToken creates an opaque refresh token of the form <sessionId>.<random> and its hash.
+// Only the hash is stored, so a database leak does not leak usable tokens.
+func newRefreshToken(sessionId string) (string, string, error) {
+	randomString, err := helper.GenerateRandomString(43)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := sessionId + "." + randomString
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashesEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
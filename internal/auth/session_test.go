@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"webserver/internal/config"
+)
+
+// newTestDB creates a database with a user that has the ID 1 and makes it the one the package uses.
+func newTestDB(t *testing.T) *config.DatabasePool {
+	t.Helper()
+	pool, err := config.NewDatabasePool(config.DatabaseConfig{Driver: "sqlite3", Source: filepath.Join(t.TempDir(), "test.sqlite"), MaxConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.DB.Close() })
+	if err := pool.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.DB.Exec("INSERT INTO users (user_id, username, email, password) VALUES (1, 'user', 'user@example.com', '')"); err != nil {
+		t.Fatal(err)
+	}
+	config.InitDatabase(pool)
+	config.JwtKey = []byte("test key")
+	revocations.once.Do(func() {
+		OnSessionRevoked(func(sessionId string) {
+			revocations.Lock()
+			revocations.sessionIds = append(revocations.sessionIds, sessionId)
+			revocations.Unlock()
+		})
+	})
+	return pool
+}
+
+// revocations records the sessions revocation listeners are notified about.
+var revocations struct {
+	sync.Mutex
+	once       sync.Once
+	sessionIds []string
+}
+
+func wasRevoked(sessionId string) bool {
+	revocations.Lock()
+	defer revocations.Unlock()
+	for _, id := range revocations.sessionIds {
+		if id == sessionId {
+			return true
+		}
+	}
+	return false
+}
+
+func sessionIdOf(t *testing.T, tokens TokenPair) string {
+	t.Helper()
+	claims, err := Authenticate(tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.SessionID
+}
+
+func TestRefreshSessionRotates(t *testing.T) {
+	newTestDB(t)
+	first, err := CreateSession(1, "user", "agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId := sessionIdOf(t, first)
+
+	tokens := first
+	for i := 0; i < 3; i++ {
+		next, err := RefreshSession(tokens.RefreshToken)
+		if err != nil {
+			t.Fatalf("refresh %d: %v", i, err)
+		}
+		if next.RefreshToken == tokens.RefreshToken {
+			t.Fatalf("refresh %d returned the same refresh token", i)
+		}
+		if !strings.HasPrefix(next.RefreshToken, sessionId+".") {
+			t.Errorf("refresh %d returned a token of another session: %s", i, next.RefreshToken)
+		}
+		if id := sessionIdOf(t, next); id != sessionId {
+			t.Errorf("refresh %d returned an access token for session %s, want %s", i, id, sessionId)
+		}
+		tokens = next
+	}
+
+	if active, err := IsSessionActive(sessionId); err != nil || !active {
+		t.Errorf("IsSessionActive() = %v, %v after refreshing, want true", active, err)
+	}
+	if wasRevoked(sessionId) {
+		t.Error("refreshing notified revocation listeners")
+	}
+}
+
+func TestRefreshSessionReuse(t *testing.T) {
+	tests := []struct {
+		name string
+		// reused picks the token that is presented again from the tokens issued so far, oldest first.
+		reused      func(issued []TokenPair) TokenPair
+		wantErr     error
+		wantRevoked bool
+	}{
+		{"token of the previous refresh", func(issued []TokenPair) TokenPair { return issued[len(issued)-2] }, ErrSessionRevoked, true},
+		// Only the previous token is remembered, older ones are just invalid
+		{"token of the login", func(issued []TokenPair) TokenPair { return issued[0] }, ErrRefreshTokenInvalid, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestDB(t)
+			tokens, err := CreateSession(1, "user", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessionId := sessionIdOf(t, tokens)
+			issued := []TokenPair{tokens}
+			for i := 0; i < 2; i++ {
+				tokens, err = RefreshSession(tokens.RefreshToken)
+				if err != nil {
+					t.Fatal(err)
+				}
+				issued = append(issued, tokens)
+			}
+
+			if _, err := RefreshSession(test.reused(issued).RefreshToken); !errors.Is(err, test.wantErr) {
+				t.Fatalf("RefreshSession() with a reused token = %v, want %v", err, test.wantErr)
+			}
+			if revoked := wasRevoked(sessionId); revoked != test.wantRevoked {
+				t.Errorf("revocation listeners notified: %v, want %v", revoked, test.wantRevoked)
+			}
+			if active, err := IsSessionActive(sessionId); err != nil || active == test.wantRevoked {
+				t.Errorf("IsSessionActive() = %v, %v after reuse, want %v", active, err, !test.wantRevoked)
+			}
+			if !test.wantRevoked {
+				return
+			}
+			// The newest token belongs to the same session, which may have been stolen
+			if _, err := RefreshSession(tokens.RefreshToken); !errors.Is(err, ErrSessionRevoked) {
+				t.Errorf("RefreshSession() with the newest token = %v, want %v", err, ErrSessionRevoked)
+			}
+			if _, err := Authenticate(tokens.AccessToken); !errors.Is(err, ErrSessionRevoked) {
+				t.Errorf("Authenticate() = %v, want %v", err, ErrSessionRevoked)
+			}
+		})
+	}
+}
+
+func TestRefreshSessionRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		// token returns the refresh token to present for a fresh session.
+		token       func(t *testing.T, pool *config.DatabasePool, tokens TokenPair, sessionId string) string
+		wantErr     error
+		wantRevoked bool
+	}{
+		{"malformed", func(*testing.T, *config.DatabasePool, TokenPair, string) string { return "garbage" }, ErrRefreshTokenInvalid, false},
+		{"unknown session", func(*testing.T, *config.DatabasePool, TokenPair, string) string { return "unknown.secret" }, ErrRefreshTokenInvalid, false},
+		{"wrong secret", func(_ *testing.T, _ *config.DatabasePool, _ TokenPair, sessionId string) string {
+			return sessionId + ".guess"
+		}, ErrRefreshTokenInvalid, false},
+		{"revoked session", func(t *testing.T, _ *config.DatabasePool, tokens TokenPair, sessionId string) string {
+			if err := RevokeSession(1, sessionId); err != nil {
+				t.Fatal(err)
+			}
+			return tokens.RefreshToken
+		}, ErrSessionRevoked, true},
+		{"expired session", func(t *testing.T, pool *config.DatabasePool, tokens TokenPair, sessionId string) string {
+			if _, err := pool.DB.Exec("UPDATE sessions SET expires_at = ? WHERE session_id = ?", time.Now().Add(-time.Minute).UTC(), sessionId); err != nil {
+				t.Fatal(err)
+			}
+			return tokens.RefreshToken
+		}, ErrSessionRevoked, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestDB(t)
+			tokens, err := CreateSession(1, "user", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessionId := sessionIdOf(t, tokens)
+
+			if _, err := RefreshSession(test.token(t, pool, tokens, sessionId)); !errors.Is(err, test.wantErr) {
+				t.Fatalf("RefreshSession() = %v, want %v", err, test.wantErr)
+			}
+			if revoked := wasRevoked(sessionId); revoked != test.wantRevoked {
+				t.Errorf("revocation listeners notified: %v, want %v", revoked, test.wantRevoked)
+			}
+			if test.wantErr == ErrRefreshTokenInvalid {
+				// Guessing doesn't end the session of the rightful owner
+				if _, err := RefreshSession(tokens.RefreshToken); err != nil {
+					t.Errorf("RefreshSession() with the valid token = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	newTestDB(t)
+	tokens, err := CreateSession(1, "user", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId := sessionIdOf(t, tokens)
+
+	if err := RevokeSession(2, sessionId); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("RevokeSession() by another user = %v, want %v", err, ErrSessionNotFound)
+	}
+	if err := RevokeSession(1, sessionId); err != nil {
+		t.Fatal(err)
+	}
+	if !wasRevoked(sessionId) {
+		t.Error("revocation listeners were not notified")
+	}
+	if _, err := Authenticate(tokens.AccessToken); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("Authenticate() = %v, want %v", err, ErrSessionRevoked)
+	}
+	if err := RevokeSession(1, sessionId); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("RevokeSession() twice = %v, want %v", err, ErrSessionNotFound)
+	}
+}
+
+func TestRefreshSessionCommitFails(t *testing.T) {
+	tests := []struct {
+		name string
+		// presented picks the refresh token to present from the login token and the token of a refresh.
+		presented func(login TokenPair, refreshed TokenPair) TokenPair
+	}{
+		{"rotation", func(_ TokenPair, refreshed TokenPair) TokenPair { return refreshed }},
+		{"reuse", func(login TokenPair, _ TokenPair) TokenPair { return login }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestDB(t)
+			login, err := CreateSession(1, "user", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessionId := sessionIdOf(t, login)
+			refreshed, err := RefreshSession(login.RefreshToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Every update of a session now violates a deferred foreign key, which fails the commit
+			for _, query := range []string{
+				"PRAGMA foreign_keys = ON",
+				"CREATE TABLE parents (parent_id INTEGER PRIMARY KEY)",
+				"CREATE TABLE children (parent_id INTEGER REFERENCES parents (parent_id) DEFERRABLE INITIALLY DEFERRED)",
+				"CREATE TRIGGER fail_commit AFTER UPDATE ON sessions BEGIN INSERT INTO children (parent_id) VALUES (1); END",
+			} {
+				if _, err := pool.DB.Exec(query); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tokens, err := RefreshSession(test.presented(login, refreshed).RefreshToken)
+			if err == nil || errors.Is(err, ErrSessionRevoked) || tokens != (TokenPair{}) {
+				t.Fatalf("RefreshSession() = %+v, %v, want the commit error", tokens, err)
+			}
+			if wasRevoked(sessionId) {
+				t.Error("revocation listeners were notified about an uncommitted revocation")
+			}
+
+			if _, err := pool.DB.Exec("DROP TRIGGER fail_commit"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := RefreshSession(refreshed.RefreshToken); err != nil {
+				t.Errorf("RefreshSession() with the token of the last committed refresh = %v", err)
+			}
+		})
+	}
+}
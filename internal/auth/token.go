@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"strings"
+	"webserver/internal/config"
+)
+
+// Subprotocol is the WebSocket subprotocol browsers use to pass a token during the handshake,
+// since they cannot set an Authorization header: Sec-WebSocket-Protocol: bearer, <token>
+const Subprotocol = "bearer"
+
+type JWTClaims struct {
+	UserID    int64  `json:"userId"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid"`
+	jwt.StandardClaims
+}
+
+type contextKey int
+
+const claimsKey contextKey = iota
+
+// ParseToken validates a signed JWT and returns its claims.
+func ParseToken(tokenString string) (*JWTClaims, error) {
+	if tokenString == "" {
+		return nil, errors.New("no token provided")
+	}
+
+	claims := &JWTClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return config.JwtKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	return claims, nil
+}
+
+// TokenFromHeader returns the token of the Authorization header, with or without the Bearer scheme.
+func TokenFromHeader(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// TokenFromWebSocketRequest looks for a token in the Authorization header, the
+// Sec-WebSocket-Protocol header and the token query parameter, in that order.
+// If the token was sent as a subprotocol, the subprotocol to accept is returned as well.
+func TokenFromWebSocketRequest(r *http.Request) (token string, subprotocol string) {
+	if token := TokenFromHeader(r); token != "" {
+		return token, ""
+	}
+
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			protocols = append(protocols, strings.TrimSpace(protocol))
+		}
+	}
+	for i := 0; i < len(protocols)-1; i++ {
+		if protocols[i] == Subprotocol {
+			return protocols[i+1], Subprotocol
+		}
+	}
+
+	return r.URL.Query().Get("token"), ""
+}
+
+// WithClaims returns a copy of ctx that carries the claims of the authenticated user.
+func WithClaims(ctx context.Context, claims *JWTClaims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext returns the claims stored by WithClaims.
+func ClaimsFromContext(ctx context.Context) (*JWTClaims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*JWTClaims)
+	return claims, ok
+}
+
+// UserIdFromContext returns the ID of the authenticated user, or 0 if the request is not authenticated.
+func UserIdFromContext(ctx context.Context) int64 {
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		return claims.UserID
+	}
+	return 0
+}
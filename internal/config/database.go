@@ -2,6 +2,7 @@ package config
 
 import (
 	"database/sql"
+	"log"
 )
 
 type DatabaseConfig struct {
@@ -40,6 +41,23 @@ func (pool *DatabasePool) RollbackOrCommit(tx *sql.Tx, success bool) error {
 	return nil
 }
 
+// WithTx runs fn in a transaction, which is committed if fn succeeds and rolled back otherwise.
+// It returns the error of fn or, if fn succeeded, the error of the commit.
+func (pool *DatabasePool) WithTx(fn func(tx *sql.Tx) error) error {
+	tx, err := pool.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		if err := tx.Rollback(); err != nil {
+			log.Println("Error rolling back transaction:", err)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
 var dbPool *DatabasePool
 
 func InitDatabase(pool *DatabasePool) {
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestWithTx(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name string
+		// child is inserted into the children table; only the parent with the ID 1 exists.
+		child      int
+		fnErr      error
+		wantErr    bool
+		wantStored bool
+	}{
+		{"commit", 1, nil, false, true},
+		{"rollback", 1, errFailed, true, false},
+		{"failed commit", 2, nil, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestPool(t)
+			// The foreign key is only checked on commit
+			for _, query := range []string{
+				"PRAGMA foreign_keys = ON",
+				"CREATE TABLE parents (parent_id INTEGER PRIMARY KEY)",
+				"CREATE TABLE children (parent_id INTEGER REFERENCES parents (parent_id) DEFERRABLE INITIALLY DEFERRED)",
+				"INSERT INTO parents (parent_id) VALUES (1)",
+			} {
+				if _, err := pool.DB.Exec(query); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := pool.WithTx(func(tx *sql.Tx) error {
+				if _, err := tx.Exec("INSERT INTO children (parent_id) VALUES (?)", test.child); err != nil {
+					return err
+				}
+				return test.fnErr
+			})
+			if (err != nil) != test.wantErr || (test.fnErr != nil && !errors.Is(err, test.fnErr)) {
+				t.Errorf("WithTx() = %v, want error %v", err, test.wantErr)
+			}
+
+			var stored int
+			if err := pool.DB.QueryRow("SELECT COUNT(*) FROM children").Scan(&stored); err != nil {
+				t.Fatal(err)
+			}
+			if (stored == 1) != test.wantStored {
+				t.Errorf("stored %d rows, want stored %v", stored, test.wantStored)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCutDirection(t *testing.T) {
+	tests := []struct {
+		fileName  string
+		base      string
+		direction string
+		ok        bool
+	}{
+		{"0001_initial_schema.up.sql", "0001_initial_schema", "up", true},
+		{"0001_initial_schema.down.sql", "0001_initial_schema", "down", true},
+		{"0001_initial_schema.sql", "", "", false},
+		{"0001_initial_schema.up.txt", "", "", false},
+	}
+
+	for _, test := range tests {
+		base, direction, ok := cutDirection(test.fileName)
+		if base != test.base || direction != test.direction || ok != test.ok {
+			t.Errorf("cutDirection(%q) = %q, %q, %v, want %q, %q, %v", test.fileName, base, direction, ok, test.base, test.direction, test.ok)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %d_%s has version %d, want %d", migration.Version, migration.Name, migration.Version, i+1)
+		}
+	}
+}
+
+// TestMigrationsUpDown applies every migration, reverts it and applies it again, checking that
+// reverting restores the schema the migration started from.
+func TestMigrationsUpDown(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newTestPool(t)
+
+	for _, migration := range migrations {
+		name := fmt.Sprintf("%04d_%s", migration.Version, migration.Name)
+		before := schema(t, pool)
+
+		if done, err := pool.MigrateUp(1); err != nil || len(done) != 1 || done[0].Version != migration.Version {
+			t.Fatalf("%s: up applied %v, %v", name, done, err)
+		}
+		if done, err := pool.MigrateDown(1); err != nil || len(done) != 1 || done[0].Version != migration.Version {
+			t.Fatalf("%s: down reverted %v, %v", name, done, err)
+		}
+		if after := schema(t, pool); after != before {
+			t.Errorf("%s: down doesn't restore the schema\nbefore:\n%s\nafter:\n%s", name, before, after)
+		}
+		if _, err := pool.MigrateUp(1); err != nil {
+			t.Fatalf("%s: up after down: %v", name, err)
+		}
+	}
+
+	status, err := pool.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if !s.Applied {
+			t.Errorf("migration %04d_%s is not applied", s.Version, s.Name)
+		}
+	}
+
+	if _, err := pool.MigrateDown(len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestPool(t *testing.T) *DatabasePool {
+	t.Helper()
+	pool, err := NewDatabasePool(DatabaseConfig{Driver: "sqlite3", Source: filepath.Join(t.TempDir(), "test.sqlite"), MaxConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.DB.Close() })
+	if err := pool.ensureMigrationsTable(); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// schema describes the tables with their columns and the indexes of the database, leaving out the migration bookkeeping.
+func schema(t *testing.T, pool *DatabasePool) string {
+	t.Helper()
+	rows, err := pool.DB.Query("SELECT type, name, tbl_name FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' AND tbl_name != 'schema_migrations'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var objects []string
+	var tables []string
+	for rows.Next() {
+		var objectType, name, table string
+		if err := rows.Scan(&objectType, &name, &table); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, objectType+" "+name+" on "+table)
+		if objectType == "table" {
+			tables = append(tables, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range tables {
+		columns, err := pool.DB.Query("SELECT name, type, \"notnull\", COALESCE(dflt_value, '') FROM pragma_table_info(?)", table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for columns.Next() {
+			var name, columnType, defaultValue string
+			var notNull bool
+			if err := columns.Scan(&name, &columnType, &notNull, &defaultValue); err != nil {
+				t.Fatal(err)
+			}
+			objects = append(objects, fmt.Sprintf("column %s.%s %s notnull=%v default=%s", table, name, columnType, notNull, defaultValue))
+		}
+		columns.Close()
+	}
+
+	sort.Strings(objects)
+	return strings.Join(objects, "\n")
+}
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS invite_links;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS channels;
+DROP TABLE IF EXISTS server_members;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS servers;
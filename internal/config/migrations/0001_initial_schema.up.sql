@@ -0,0 +1,81 @@
+CREATE TABLE IF NOT EXISTS servers
+(
+    server_id   INTEGER PRIMARY KEY,
+    server_name TEXT NOT NULL,
+    img         TEXT,
+    created_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS users
+(
+    user_id      INTEGER PRIMARY KEY,
+    username     TEXT NOT NULL,
+    display_name TEXT,
+    password     TEXT,
+    email        TEXT,
+    language     TEXT,
+    appearance   INTEGER,
+    bio          TEXT,
+    status       TEXT,
+    last_seen    DATETIME DEFAULT CURRENT_TIMESTAMP,
+    joined_at    DATETIME DEFAULT CURRENT_TIMESTAMP,
+    pronouns     TEXT,
+    img_url      TEXT,
+    online       BOOLEAN
+);
+
+CREATE TABLE IF NOT EXISTS server_members
+(
+    membership_id INTEGER PRIMARY KEY,
+    server_id     INTEGER,
+    user_id       INTEGER,
+    server_owner  BOOLEAN,
+    joined_at     DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (server_id) REFERENCES servers (server_id),
+    FOREIGN KEY (user_id) REFERENCES users (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS channels
+(
+    channel_id   INTEGER PRIMARY KEY,
+    server_id    INTEGER,
+    type         INTEGER,
+    channel_name TEXT NOT NULL,
+    created_at   DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (server_id) REFERENCES servers (server_id)
+);
+
+CREATE TABLE IF NOT EXISTS messages
+(
+    message_id   INTEGER PRIMARY KEY,
+    channel_id   INTEGER,
+    user_id      INTEGER,
+    message_text TEXT NOT NULL,
+    sent_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (channel_id) REFERENCES channels (channel_id),
+    FOREIGN KEY (user_id) REFERENCES users (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS invite_links
+(
+    id          INTEGER PRIMARY KEY,
+    invite_code TEXT    NOT NULL,
+    server_id   INTEGER NOT NULL,
+    created_at  TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (server_id) REFERENCES servers (server_id)
+);
+
+CREATE TABLE IF NOT EXISTS sessions
+(
+    session_id          TEXT PRIMARY KEY,
+    user_id             INTEGER NOT NULL,
+    refresh_token_hash  TEXT    NOT NULL,
+    previous_token_hash TEXT,
+    user_agent          TEXT,
+    ip_address          TEXT,
+    created_at          DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at        DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at          DATETIME NOT NULL,
+    revoked_at          DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users (user_id)
+);
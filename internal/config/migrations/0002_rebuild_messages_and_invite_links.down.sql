@@ -0,0 +1,2 @@
+-- The previous table definitions were broken, there is nothing worth restoring.
+SELECT 1;
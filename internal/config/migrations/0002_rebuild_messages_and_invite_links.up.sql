@@ -0,0 +1,39 @@
+-- Databases created with setup.js have a UNIQUE constraint on messages.user_id, which
+-- allowed a single message per user, and a malformed invite_code column. SQLite cannot
+-- alter constraints in place, so both tables are rebuilt.
+
+CREATE TABLE messages_new
+(
+    message_id   INTEGER PRIMARY KEY,
+    channel_id   INTEGER,
+    user_id      INTEGER,
+    message_text TEXT NOT NULL,
+    sent_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (channel_id) REFERENCES channels (channel_id),
+    FOREIGN KEY (user_id) REFERENCES users (user_id)
+);
+
+INSERT INTO messages_new (message_id, channel_id, user_id, message_text, sent_at)
+SELECT message_id, channel_id, user_id, message_text, sent_at
+FROM messages;
+
+DROP TABLE messages;
+ALTER TABLE messages_new RENAME TO messages;
+
+CREATE TABLE invite_links_new
+(
+    id          INTEGER PRIMARY KEY,
+    invite_code TEXT    NOT NULL,
+    server_id   INTEGER NOT NULL,
+    created_at  TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (server_id) REFERENCES servers (server_id)
+);
+
+INSERT INTO invite_links_new (id, invite_code, server_id, created_at)
+SELECT id, invite_code, server_id, created_at
+FROM invite_links
+WHERE invite_code IS NOT NULL
+  AND server_id IS NOT NULL;
+
+DROP TABLE invite_links;
+ALTER TABLE invite_links_new RENAME TO invite_links;
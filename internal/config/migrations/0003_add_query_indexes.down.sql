@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_sessions_user_id;
+DROP INDEX IF EXISTS idx_invite_links_invite_code;
+DROP INDEX IF EXISTS idx_messages_channel_id;
+DROP INDEX IF EXISTS idx_channels_server_id;
+DROP INDEX IF EXISTS idx_server_members_server_id;
+DROP INDEX IF EXISTS idx_server_members_user_id;
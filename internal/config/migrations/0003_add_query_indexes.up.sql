@@ -0,0 +1,6 @@
+CREATE INDEX IF NOT EXISTS idx_server_members_user_id ON server_members (user_id);
+CREATE INDEX IF NOT EXISTS idx_server_members_server_id ON server_members (server_id);
+CREATE INDEX IF NOT EXISTS idx_channels_server_id ON channels (server_id);
+CREATE INDEX IF NOT EXISTS idx_messages_channel_id ON messages (channel_id, sent_at, message_id);
+CREATE INDEX IF NOT EXISTS idx_invite_links_invite_code ON invite_links (invite_code);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
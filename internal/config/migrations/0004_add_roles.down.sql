@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_member_roles_server_user;
+DROP INDEX IF EXISTS idx_roles_server_id;
+DROP TABLE IF EXISTS member_roles;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS roles
+(
+    role_id     INTEGER PRIMARY KEY,
+    server_id   INTEGER NOT NULL,
+    role_name   TEXT    NOT NULL,
+    color       INTEGER NOT NULL DEFAULT 0,
+    permissions INTEGER NOT NULL DEFAULT 0,
+    position    INTEGER NOT NULL DEFAULT 0,
+    hoist       BOOLEAN NOT NULL DEFAULT false,
+    mentionable BOOLEAN NOT NULL DEFAULT false,
+    created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (server_id) REFERENCES servers (server_id)
+);
+
+CREATE TABLE IF NOT EXISTS member_roles
+(
+    server_id INTEGER NOT NULL,
+    user_id   INTEGER NOT NULL,
+    role_id   INTEGER NOT NULL,
+    PRIMARY KEY (role_id, user_id),
+    FOREIGN KEY (server_id) REFERENCES servers (server_id),
+    FOREIGN KEY (user_id) REFERENCES users (user_id),
+    FOREIGN KEY (role_id) REFERENCES roles (role_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_roles_server_id ON roles (server_id);
+CREATE INDEX IF NOT EXISTS idx_member_roles_server_user ON member_roles (server_id, user_id);
+
+-- Every server gets its @everyone role, which shares the server ID.
+-- 29718 = view channel | send messages | read message history | create invite | connect | speak | video
+INSERT OR IGNORE INTO roles (role_id, server_id, role_name, permissions, position)
+SELECT server_id, server_id, '@everyone', 29718, 0
+FROM servers;
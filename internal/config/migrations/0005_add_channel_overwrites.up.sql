@@ -0,0 +1,11 @@
+-- target_type: 0 = role, 1 = member
+CREATE TABLE IF NOT EXISTS channel_overwrites
+(
+    channel_id  INTEGER NOT NULL,
+    target_id   INTEGER NOT NULL,
+    target_type INTEGER NOT NULL,
+    allow       INTEGER NOT NULL DEFAULT 0,
+    deny        INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (channel_id, target_id),
+    FOREIGN KEY (channel_id) REFERENCES channels (channel_id)
+);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_channels_parent_id;
+
+ALTER TABLE channels DROP COLUMN nsfw;
+ALTER TABLE channels DROP COLUMN topic;
+ALTER TABLE channels DROP COLUMN parent_id;
+ALTER TABLE channels DROP COLUMN position;
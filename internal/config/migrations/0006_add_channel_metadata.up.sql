@@ -0,0 +1,13 @@
+ALTER TABLE channels ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE channels ADD COLUMN parent_id INTEGER REFERENCES channels (channel_id);
+ALTER TABLE channels ADD COLUMN topic TEXT;
+ALTER TABLE channels ADD COLUMN nsfw BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS idx_channels_parent_id ON channels (parent_id);
+
+-- Existing channels keep their creation order
+UPDATE channels
+SET position = (SELECT COUNT(*)
+                FROM channels AS earlier
+                WHERE earlier.server_id = channels.server_id
+                  AND earlier.channel_id < channels.channel_id);
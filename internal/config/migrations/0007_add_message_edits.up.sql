@@ -0,0 +1,14 @@
+ALTER TABLE messages ADD COLUMN edited_at DATETIME;
+ALTER TABLE messages ADD COLUMN deleted_at DATETIME;
+
+-- Previous versions of edited messages, removed together with the message text on deletion
+CREATE TABLE IF NOT EXISTS message_edits
+(
+    edit_id      INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id   INTEGER  NOT NULL,
+    message_text TEXT     NOT NULL,
+    edited_at    DATETIME NOT NULL,
+    FOREIGN KEY (message_id) REFERENCES messages (message_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits (message_id, edited_at);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_channel_recipients_user_id;
+DROP TABLE IF EXISTS channel_recipients;
+
+DELETE FROM message_edits WHERE message_id IN (SELECT message_id FROM messages WHERE channel_id IN (SELECT channel_id FROM channels WHERE server_id IS NULL));
+DELETE FROM messages WHERE channel_id IN (SELECT channel_id FROM channels WHERE server_id IS NULL);
+DELETE FROM channels WHERE server_id IS NULL;
+
+ALTER TABLE channels DROP COLUMN icon_url;
+ALTER TABLE channels DROP COLUMN owner_id;
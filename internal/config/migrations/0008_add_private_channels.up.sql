@@ -0,0 +1,16 @@
+-- Direct messages and group DMs are channels without a server. Their members are
+-- kept in channel_recipients; group DMs additionally have an owner and an icon.
+ALTER TABLE channels ADD COLUMN owner_id INTEGER REFERENCES users (user_id);
+ALTER TABLE channels ADD COLUMN icon_url TEXT;
+
+CREATE TABLE IF NOT EXISTS channel_recipients
+(
+    channel_id INTEGER NOT NULL,
+    user_id    INTEGER NOT NULL,
+    added_at   DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel_id, user_id),
+    FOREIGN KEY (channel_id) REFERENCES channels (channel_id),
+    FOREIGN KEY (user_id) REFERENCES users (user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_channel_recipients_user_id ON channel_recipients (user_id);
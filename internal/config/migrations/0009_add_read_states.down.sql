@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_read_states_channel_id;
+DROP TABLE IF EXISTS read_states;
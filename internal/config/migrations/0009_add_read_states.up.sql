@@ -0,0 +1,13 @@
+-- The last message each user has read in a channel. Unread and mention counts are derived from it.
+CREATE TABLE IF NOT EXISTS read_states
+(
+    user_id         INTEGER  NOT NULL,
+    channel_id      INTEGER  NOT NULL,
+    last_message_id INTEGER  NOT NULL,
+    updated_at      DATETIME NOT NULL,
+    PRIMARY KEY (user_id, channel_id),
+    FOREIGN KEY (user_id) REFERENCES users (user_id),
+    FOREIGN KEY (channel_id) REFERENCES channels (channel_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_read_states_channel_id ON read_states (channel_id);
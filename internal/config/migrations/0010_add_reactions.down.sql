@@ -0,0 +1,4 @@
+UPDATE roles SET permissions = permissions & ~262144;
+UPDATE channel_overwrites SET allow = allow & ~262144, deny = deny & ~262144;
+
+DROP TABLE IF EXISTS message_reactions;
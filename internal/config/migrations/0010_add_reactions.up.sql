@@ -0,0 +1,16 @@
+-- A custom server emoji is stored by its ID and a Unicode emoji by itself in emoji_name;
+-- the other column keeps its default.
+CREATE TABLE IF NOT EXISTS message_reactions
+(
+    message_id INTEGER  NOT NULL,
+    user_id    INTEGER  NOT NULL,
+    emoji_id   INTEGER  NOT NULL DEFAULT 0,
+    emoji_name TEXT     NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (message_id, emoji_id, emoji_name, user_id),
+    FOREIGN KEY (message_id) REFERENCES messages (message_id),
+    FOREIGN KEY (user_id) REFERENCES users (user_id)
+);
+
+-- 262144 = add reactions, granted to the @everyone role of every existing server
+UPDATE roles SET permissions = permissions | 262144 WHERE role_id = server_id;
@@ -0,0 +1,6 @@
+-- 524288 = manage emojis
+UPDATE roles SET permissions = permissions & ~524288;
+UPDATE channel_overwrites SET allow = allow & ~524288, deny = deny & ~524288;
+
+DROP INDEX IF EXISTS idx_emojis_server_name;
+DROP TABLE IF EXISTS emojis;
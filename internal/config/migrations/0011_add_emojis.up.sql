@@ -0,0 +1,15 @@
+-- Custom emoji uploaded to a server, used in messages as <:name:id> and in reactions by ID
+CREATE TABLE IF NOT EXISTS emojis
+(
+    emoji_id   INTEGER PRIMARY KEY,
+    server_id  INTEGER NOT NULL,
+    name       TEXT    NOT NULL,
+    img_url    TEXT    NOT NULL,
+    animated   BOOLEAN NOT NULL DEFAULT false,
+    user_id    INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (server_id) REFERENCES servers (server_id),
+    FOREIGN KEY (user_id) REFERENCES users (user_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_emojis_server_name ON emojis (server_id, name);
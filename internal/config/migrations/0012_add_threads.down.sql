@@ -0,0 +1,12 @@
+DELETE FROM message_reactions WHERE message_id IN (SELECT message_id FROM messages WHERE channel_id IN (SELECT thread_id FROM threads));
+DELETE FROM message_edits WHERE message_id IN (SELECT message_id FROM messages WHERE channel_id IN (SELECT thread_id FROM threads));
+DELETE FROM messages WHERE channel_id IN (SELECT thread_id FROM threads);
+DELETE FROM read_states WHERE channel_id IN (SELECT thread_id FROM threads);
+DELETE FROM channel_overwrites WHERE channel_id IN (SELECT thread_id FROM threads);
+DELETE FROM channels WHERE channel_id IN (SELECT thread_id FROM threads);
+
+DROP INDEX IF EXISTS idx_thread_members_user_id;
+DROP TABLE IF EXISTS thread_members;
+DROP INDEX IF EXISTS idx_threads_archived_last_activity;
+DROP INDEX IF EXISTS idx_threads_parent_channel_id;
+DROP TABLE IF EXISTS threads;
@@ -0,0 +1,33 @@
+-- Threads are channels of type 6 anchored to a message of a server text channel.
+-- They inherit the permissions of that channel and are archived after auto_archive_minutes
+-- without a new message.
+CREATE TABLE IF NOT EXISTS threads
+(
+    thread_id            INTEGER PRIMARY KEY,
+    parent_channel_id    INTEGER  NOT NULL,
+    parent_message_id    INTEGER  NOT NULL UNIQUE,
+    owner_id             INTEGER  NOT NULL,
+    auto_archive_minutes INTEGER  NOT NULL DEFAULT 1440,
+    archived             BOOLEAN  NOT NULL DEFAULT false,
+    archived_at          DATETIME,
+    last_activity_at     DATETIME NOT NULL,
+    FOREIGN KEY (thread_id) REFERENCES channels (channel_id),
+    FOREIGN KEY (parent_channel_id) REFERENCES channels (channel_id),
+    FOREIGN KEY (parent_message_id) REFERENCES messages (message_id),
+    FOREIGN KEY (owner_id) REFERENCES users (user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_threads_parent_channel_id ON threads (parent_channel_id);
+CREATE INDEX IF NOT EXISTS idx_threads_archived_last_activity ON threads (archived, last_activity_at);
+
+CREATE TABLE IF NOT EXISTS thread_members
+(
+    thread_id INTEGER NOT NULL,
+    user_id   INTEGER NOT NULL,
+    joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (thread_id, user_id),
+    FOREIGN KEY (thread_id) REFERENCES threads (thread_id),
+    FOREIGN KEY (user_id) REFERENCES users (user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_thread_members_user_id ON thread_members (user_id);
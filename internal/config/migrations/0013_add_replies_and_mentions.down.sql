@@ -0,0 +1,7 @@
+UPDATE roles SET permissions = permissions & ~1048576;
+UPDATE channel_overwrites SET allow = allow & ~1048576, deny = deny & ~1048576;
+
+DROP INDEX IF EXISTS idx_message_mentions_target;
+DROP TABLE IF EXISTS message_mentions;
+
+ALTER TABLE messages DROP COLUMN reply_to_message_id;
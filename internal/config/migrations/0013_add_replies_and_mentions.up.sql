@@ -0,0 +1,19 @@
+ALTER TABLE messages ADD COLUMN reply_to_message_id INTEGER REFERENCES messages (message_id);
+
+-- Mentions parsed from the text of a message when it is sent or edited.
+-- mention_type is 0 for users, 1 for roles, 2 for channels, 3 for @everyone and 4 for @here;
+-- target_id is the mentioned user, role or channel and 0 for @everyone and @here.
+CREATE TABLE IF NOT EXISTS message_mentions
+(
+    message_id   INTEGER NOT NULL,
+    mention_type INTEGER NOT NULL,
+    target_id    INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (message_id, mention_type, target_id),
+    FOREIGN KEY (message_id) REFERENCES messages (message_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_mentions_target ON message_mentions (mention_type, target_id);
+
+-- 1048576 = mention everyone, which also covers roles. Roles that can manage messages
+-- keep being able to reach everyone; others have to be granted it.
+UPDATE roles SET permissions = permissions | 1048576 WHERE permissions & 8 != 0;
@@ -0,0 +1,2 @@
+ALTER TABLE server_members DROP COLUMN server_deaf;
+ALTER TABLE server_members DROP COLUMN server_mute;
@@ -0,0 +1,3 @@
+-- Set by moderators and kept across voice connections, so leaving and rejoining doesn't lift them.
+ALTER TABLE server_members ADD COLUMN server_mute BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE server_members ADD COLUMN server_deaf BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1 @@
+UPDATE channels SET type = 4 WHERE channel_id IN (SELECT thread_id FROM threads);
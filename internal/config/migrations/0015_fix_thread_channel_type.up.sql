@@ -0,0 +1,2 @@
+-- Threads were created with type 4, which is also the type of DMs.
+UPDATE channels SET type = 6 WHERE channel_id IN (SELECT thread_id FROM threads);
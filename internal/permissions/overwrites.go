@@ -0,0 +1,309 @@
+package permissions
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"webserver/internal/config"
+)
+
+const (
+	OverwriteRole   = 0
+	OverwriteMember = 1
+)
+
+var (
+	ErrChannelNotFound  = errors.New("channel not found")
+	ErrInvalidOverwrite = errors.New("invalid permission overwrite")
+
+	// ErrNotRecipient matches ErrNotMember, so callers can treat both the same.
+	ErrNotRecipient error = notRecipientError{}
+)
+
+// Overwrite allows or denies permissions on a single channel for a role or a member,
+// on top of the permissions the target has on the server.
+type Overwrite struct {
+	ChannelId string     `json:"channelId"`
+	TargetId  string     `json:"targetId"`
+	Type      int        `json:"type"`
+	Allow     Permission `json:"allow"`
+	Deny      Permission `json:"deny"`
+}
+
+type overwriteRow struct {
+	channelId  int64
+	targetId   int64
+	targetType int
+	allow      Permission
+	deny       Permission
+}
+
+// ChannelPermissions resolves the permissions of a user in a channel and returns them
+// together with the ID of the server the channel belongs to. Private channels (DMs and
+// group DMs) have no server; their recipients get Private and the returned server ID is 0.
+// Threads have no overwrites of their own and resolve to the permissions of their parent channel.
+func ChannelPermissions(q Querier, channelId int64, userId int64) (Permission, int64, error) {
+	var nullServerId sql.NullInt64
+	var overwriteChannelId int64
+	err := q.QueryRow(`SELECT c.server_id, COALESCE(t.parent_channel_id, c.channel_id)
+		FROM channels c LEFT JOIN threads t ON t.thread_id = c.channel_id WHERE c.channel_id = ?`, channelId).Scan(&nullServerId, &overwriteChannelId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, ErrChannelNotFound
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if !nullServerId.Valid {
+		return privateChannelPermissions(q, channelId, userId)
+	}
+	serverId := nullServerId.Int64
+
+	base, err := ServerPermissions(q, serverId, userId)
+	if err != nil {
+		return 0, serverId, err
+	}
+
+	overwrites, err := queryOverwrites(q, "SELECT channel_id, target_id, target_type, allow, deny FROM channel_overwrites WHERE channel_id = ?", overwriteChannelId)
+	if err != nil {
+		return 0, serverId, err
+	}
+	roleIds, err := memberRoleSet(q, serverId, userId)
+	if err != nil {
+		return 0, serverId, err
+	}
+
+	return applyOverwrites(base, serverId, userId, roleIds, overwrites), serverId, nil
+}
+
+// ServerChannelPermissions resolves the permissions of a user in every channel of a server at once.
+func ServerChannelPermissions(q Querier, serverId int64, userId int64) (map[int64]Permission, error) {
+	base, err := ServerPermissions(q, serverId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	overwrites, err := queryOverwrites(q, `SELECT o.channel_id, o.target_id, o.target_type, o.allow, o.deny FROM channel_overwrites o
+		JOIN channels c ON c.channel_id = o.channel_id WHERE c.server_id = ?`, serverId)
+	if err != nil {
+		return nil, err
+	}
+	roleIds, err := memberRoleSet(q, serverId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	byChannel := make(map[int64][]overwriteRow)
+	for _, overwrite := range overwrites {
+		byChannel[overwrite.channelId] = append(byChannel[overwrite.channelId], overwrite)
+	}
+
+	rows, err := q.Query(`SELECT c.channel_id, COALESCE(t.parent_channel_id, c.channel_id)
+		FROM channels c LEFT JOIN threads t ON t.thread_id = c.channel_id WHERE c.server_id = ?`, serverId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int64]Permission)
+	for rows.Next() {
+		var channelId, overwriteChannelId int64
+		if err := rows.Scan(&channelId, &overwriteChannelId); err != nil {
+			return nil, err
+		}
+		result[channelId] = applyOverwrites(base, serverId, userId, roleIds, byChannel[overwriteChannelId])
+	}
+	return result, rows.Err()
+}
+
+// CheckChannelPermission returns an error unless the user has all flags in the channel.
+// The ID of the server the channel belongs to is returned in either case.
+func CheckChannelPermission(q Querier, channelId int64, userId int64, flags Permission) (int64, error) {
+	permissions, serverId, err := ChannelPermissions(q, channelId, userId)
+	if err != nil {
+		return serverId, err
+	}
+	if !permissions.Has(flags) {
+		return serverId, ErrMissingPermission
+	}
+	return serverId, nil
+}
+
+type notRecipientError struct{}
+
+func (notRecipientError) Error() string { return "you are not a recipient of this conversation" }
+
+func (notRecipientError) Is(target error) bool { return target == ErrNotMember }
+
+func privateChannelPermissions(q Querier, channelId int64, userId int64) (Permission, int64, error) {
+	var recipient bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM channel_recipients WHERE channel_id = ? AND user_id = ?)", channelId, userId).Scan(&recipient)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !recipient {
+		return 0, 0, ErrNotRecipient
+	}
+	return Private, 0, nil
+}
+
+// applyOverwrites layers the overwrites of a channel on top of the server permissions:
+// first @everyone, then the combined role overwrites, then the member's own overwrite.
+// Without ViewChannel a member cannot do anything else in the channel.
+func applyOverwrites(base Permission, serverId int64, userId int64, roleIds map[int64]bool, overwrites []overwriteRow) Permission {
+	if base&Administrator != 0 {
+		return All
+	}
+
+	permissions := base
+	var roleAllow, roleDeny Permission
+	var member *overwriteRow
+	for i, overwrite := range overwrites {
+		switch {
+		case overwrite.targetType == OverwriteRole && overwrite.targetId == serverId:
+			permissions = permissions&^overwrite.deny | overwrite.allow
+		case overwrite.targetType == OverwriteRole && roleIds[overwrite.targetId]:
+			roleAllow |= overwrite.allow
+			roleDeny |= overwrite.deny
+		case overwrite.targetType == OverwriteMember && overwrite.targetId == userId:
+			member = &overwrites[i]
+		}
+	}
+	permissions = permissions&^roleDeny | roleAllow
+	if member != nil {
+		permissions = permissions&^member.deny | member.allow
+	}
+
+	if !permissions.Has(ViewChannel) {
+		return 0
+	}
+	return permissions & All
+}
+
+// ListOverwrites returns the permission overwrites of a channel.
+func ListOverwrites(q Querier, channelId int64) ([]Overwrite, error) {
+	rows, err := queryOverwrites(q, "SELECT channel_id, target_id, target_type, allow, deny FROM channel_overwrites WHERE channel_id = ?", channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	overwrites := make([]Overwrite, 0, len(rows))
+	for _, row := range rows {
+		overwrites = append(overwrites, row.toOverwrite())
+	}
+	return overwrites, nil
+}
+
+// SetOverwrite creates or replaces the overwrite of a role or member on a channel.
+// The actor needs ManageRoles in the channel and cannot allow or deny permissions they do not have.
+func SetOverwrite(actorId int64, channelId int64, targetId int64, targetType int, allow Permission, deny Permission) (overwrite Overwrite, err error) {
+	if targetType != OverwriteRole && targetType != OverwriteMember {
+		return Overwrite{}, fmt.Errorf("%w: unknown overwrite type %d", ErrInvalidOverwrite, targetType)
+	}
+	if (allow|deny)&^All != 0 {
+		return Overwrite{}, fmt.Errorf("%w: unknown permission bits", ErrInvalidOverwrite)
+	}
+
+	err = config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		actorPermissions, serverId, err := ChannelPermissions(tx, channelId, actorId)
+		if err != nil {
+			return err
+		}
+		if !actorPermissions.Has(ManageRoles) {
+			return ErrMissingPermission
+		}
+		if actorPermissions&Administrator == 0 && (allow|deny)&^actorPermissions != 0 {
+			return ErrMissingPermission
+		}
+
+		var isThread bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM threads WHERE thread_id = ?)", channelId).Scan(&isThread); err != nil {
+			return err
+		}
+		if isThread {
+			return fmt.Errorf("%w: threads use the overwrites of their parent channel", ErrInvalidOverwrite)
+		}
+
+		var exists bool
+		if targetType == OverwriteRole {
+			err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM roles WHERE role_id = ? AND server_id = ?)", targetId, serverId).Scan(&exists)
+		} else {
+			err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM server_members WHERE user_id = ? AND server_id = ?)", targetId, serverId).Scan(&exists)
+		}
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: the overwrite target does not exist on this server", ErrInvalidOverwrite)
+		}
+
+		_, err = tx.Exec(`INSERT INTO channel_overwrites (channel_id, target_id, target_type, allow, deny) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (channel_id, target_id) DO UPDATE SET target_type = excluded.target_type, allow = excluded.allow, deny = excluded.deny`,
+			channelId, targetId, targetType, int64(allow), int64(deny))
+		return err
+	})
+	if err != nil {
+		return Overwrite{}, err
+	}
+
+	return overwriteRow{channelId: channelId, targetId: targetId, targetType: targetType, allow: allow, deny: deny}.toOverwrite(), nil
+}
+
+// DeleteOverwrite removes the overwrite of a role or member from a channel.
+func DeleteOverwrite(actorId int64, channelId int64, targetId int64) error {
+	return config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if _, err := CheckChannelPermission(tx, channelId, actorId, ManageRoles); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM channel_overwrites WHERE channel_id = ? AND target_id = ?", channelId, targetId)
+		return err
+	})
+}
+
+func (row overwriteRow) toOverwrite() Overwrite {
+	return Overwrite{
+		ChannelId: strconv.FormatInt(row.channelId, 10),
+		TargetId:  strconv.FormatInt(row.targetId, 10),
+		Type:      row.targetType,
+		Allow:     row.allow,
+		Deny:      row.deny,
+	}
+}
+
+func queryOverwrites(q Querier, query string, args ...interface{}) ([]overwriteRow, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overwrites []overwriteRow
+	for rows.Next() {
+		var row overwriteRow
+		var allow, deny int64
+		if err := rows.Scan(&row.channelId, &row.targetId, &row.targetType, &allow, &deny); err != nil {
+			return nil, err
+		}
+		row.allow = Permission(allow)
+		row.deny = Permission(deny)
+		overwrites = append(overwrites, row)
+	}
+	return overwrites, rows.Err()
+}
+
+func memberRoleSet(q Querier, serverId int64, userId int64) (map[int64]bool, error) {
+	rows, err := q.Query("SELECT role_id FROM member_roles WHERE server_id = ? AND user_id = ?", serverId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roleIds := make(map[int64]bool)
+	for rows.Next() {
+		var roleId int64
+		if err := rows.Scan(&roleId); err != nil {
+			return nil, err
+		}
+		roleIds[roleId] = true
+	}
+	return roleIds, rows.Err()
+}
@@ -0,0 +1,100 @@
+package permissions
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApplyOverwrites(t *testing.T) {
+	const (
+		serverId  = 10
+		channelId = 100
+		userId    = 1
+		roleA     = 20
+		roleB     = 21
+		otherRole = 22
+		otherUser = 2
+	)
+	base := Default
+	roles := map[int64]bool{roleA: true, roleB: true}
+
+	everyone := func(allow, deny Permission) overwriteRow {
+		return overwriteRow{channelId: channelId, targetId: serverId, targetType: OverwriteRole, allow: allow, deny: deny}
+	}
+	role := func(roleId int64, allow, deny Permission) overwriteRow {
+		return overwriteRow{channelId: channelId, targetId: roleId, targetType: OverwriteRole, allow: allow, deny: deny}
+	}
+	member := func(memberId int64, allow, deny Permission) overwriteRow {
+		return overwriteRow{channelId: channelId, targetId: memberId, targetType: OverwriteMember, allow: allow, deny: deny}
+	}
+
+	tests := []struct {
+		name       string
+		base       Permission
+		overwrites []overwriteRow
+		want       Permission
+	}{
+		{"no overwrites", base, nil, base},
+		{"administrator ignores overwrites", Administrator, []overwriteRow{everyone(0, ViewChannel)}, All},
+		{"@everyone deny", base, []overwriteRow{everyone(0, SendMessages)}, base &^ SendMessages},
+		{"@everyone allow", base, []overwriteRow{everyone(ManageMessages, 0)}, base | ManageMessages},
+		{"role allow beats @everyone deny", base, []overwriteRow{everyone(0, SendMessages), role(roleA, SendMessages, 0)}, base},
+		{"role allow beats another role's deny", base, []overwriteRow{role(roleA, 0, SendMessages), role(roleB, SendMessages, 0)}, base},
+		{"roles the member lacks are ignored", base, []overwriteRow{role(otherRole, 0, SendMessages)}, base},
+		{"member deny beats role allow", base, []overwriteRow{role(roleA, ManageMessages, 0), member(userId, 0, ManageMessages)}, base},
+		{"member allow beats role deny", base, []overwriteRow{role(roleA, 0, SendMessages), member(userId, SendMessages, 0)}, base},
+		{"other members are ignored", base, []overwriteRow{member(otherUser, 0, SendMessages)}, base},
+		{"role overwrite of the member's ID is ignored", base, []overwriteRow{role(userId, 0, SendMessages)}, base},
+		{"member overwrite of a role ID is ignored", base, []overwriteRow{member(roleA, 0, SendMessages)}, base},
+		{"without ViewChannel nothing is left", base, []overwriteRow{everyone(0, ViewChannel)}, 0},
+		{"ViewChannel restored for a role", base, []overwriteRow{everyone(0, ViewChannel), role(roleB, ViewChannel, 0)}, base},
+		{"unknown bits are dropped", base, []overwriteRow{everyone(MentionEveryone<<1, 0)}, base},
+	}
+
+	for _, test := range tests {
+		if got := applyOverwrites(test.base, serverId, userId, roles, test.overwrites); got != test.want {
+			t.Errorf("%s: applyOverwrites() = %b, want %b", test.name, got, test.want)
+		}
+	}
+}
+
+func TestChannelPermissions(t *testing.T) {
+	db := newTestDB(t)
+	exec(t, db, "INSERT INTO servers (server_id, server_name) VALUES (10, 's')")
+	exec(t, db, "INSERT INTO roles (role_id, server_id, role_name, permissions, position) VALUES (10, 10, '@everyone', ?, 0), (20, 10, 'mod', ?, 1)",
+		int64(Default), int64(ManageMessages))
+	exec(t, db, "INSERT INTO server_members (server_id, user_id, server_owner) VALUES (10, 1, true), (10, 2, false), (10, 3, false)")
+	exec(t, db, "INSERT INTO member_roles (server_id, user_id, role_id) VALUES (10, 3, 20)")
+	exec(t, db, "INSERT INTO channels (channel_id, server_id, channel_name, type) VALUES (100, 10, 'general', 1), (101, 10, 'staff', 1)")
+	exec(t, db, "INSERT INTO channel_overwrites (channel_id, target_id, target_type, allow, deny) VALUES (101, 10, ?, 0, ?), (101, 20, ?, ?, 0)",
+		OverwriteRole, int64(ViewChannel), OverwriteRole, int64(ViewChannel))
+
+	tests := []struct {
+		name      string
+		channelId int64
+		userId    int64
+		want      Permission
+		wantErr   error
+	}{
+		{"owner", 101, 1, All, nil},
+		{"member without overwrites", 100, 2, Default, nil},
+		{"member hidden by @everyone", 101, 2, 0, nil},
+		{"role allowed to view", 101, 3, Default | ManageMessages, nil},
+		{"not a member", 100, 4, 0, ErrNotMember},
+		{"unknown channel", 999, 2, 0, ErrChannelNotFound},
+	}
+
+	for _, test := range tests {
+		got, serverId, err := ChannelPermissions(db, test.channelId, test.userId)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: ChannelPermissions() error = %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: ChannelPermissions() = %b, want %b", test.name, got, test.want)
+		}
+		if err == nil && serverId != 10 {
+			t.Errorf("%s: ChannelPermissions() server ID = %d, want 10", test.name, serverId)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package permissions
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Permission is a bitmask of the actions a member may perform on a server.
+type Permission uint64
+
+const (
+	// Administrator grants every permission.
+	Administrator Permission = 1 << iota
+	ViewChannel
+	SendMessages
+	ManageMessages
+	ReadMessageHistory
+	ManageChannels
+	ManageRoles
+	ManageServer
+	KickMembers
+	BanMembers
+	CreateInvite
+	ManageInvites
+	Connect
+	Speak
+	Video
+	MuteMembers
+	DeafenMembers
+	MoveMembers
+	AddReactions
+	ManageEmojis
+	// MentionEveryone allows mentioning @everyone, @here and roles.
+	MentionEveryone
+
+	// All is the union of every permission above.
+	All = MentionEveryone<<1 - 1
+)
+
+// Default is granted to the @everyone role of new servers.
+// Keep in sync with the @everyone backfills in migrations 0004_add_roles and 0010_add_reactions.
+const Default = ViewChannel | SendMessages | ReadMessageHistory | CreateInvite | Connect | Speak | Video | AddReactions
+
+// Private is granted to every recipient of a DM or group DM.
+const Private = ViewChannel | SendMessages | ReadMessageHistory | Connect | Speak | Video | AddReactions
+
+var (
+	ErrNotMember         = errors.New("you are not a member of this server")
+	ErrMissingPermission = errors.New("missing permission")
+)
+
+// Querier is satisfied by *sql.DB and *sql.Tx, so permissions can be resolved inside a running transaction.
+type Querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Has reports whether all flags are set. Administrator implies every flag.
+func (p Permission) Has(flags Permission) bool {
+	return p&Administrator != 0 || p&flags == flags
+}
+
+// ServerPermissions resolves the permissions of a member: the union of the @everyone role and
+// every role assigned to the member. Server owners and administrators get All.
+// ErrNotMember is returned if the user is not a member of the server.
+func ServerPermissions(q Querier, serverId int64, userId int64) (Permission, error) {
+	var serverOwner bool
+	err := q.QueryRow("SELECT COALESCE(server_owner, false) FROM server_members WHERE server_id = ? AND user_id = ?", serverId, userId).Scan(&serverOwner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotMember
+	} else if err != nil {
+		return 0, err
+	}
+	if serverOwner {
+		return All, nil
+	}
+
+	rows, err := q.Query(`SELECT permissions FROM roles
+		WHERE server_id = ? AND (role_id = ? OR role_id IN (SELECT role_id FROM member_roles WHERE server_id = ? AND user_id = ?))`,
+		serverId, serverId, serverId, userId)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var permissions Permission
+	for rows.Next() {
+		var rolePermissions int64
+		if err := rows.Scan(&rolePermissions); err != nil {
+			return 0, err
+		}
+		permissions |= Permission(rolePermissions)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return normalize(permissions), nil
+}
+
+// CheckServerPermission returns ErrNotMember or ErrMissingPermission unless the user has all flags on the server.
+func CheckServerPermission(q Querier, serverId int64, userId int64, flags Permission) error {
+	permissions, err := ServerPermissions(q, serverId, userId)
+	if err != nil {
+		return err
+	}
+	if !permissions.Has(flags) {
+		return ErrMissingPermission
+	}
+	return nil
+}
+
+func normalize(p Permission) Permission {
+	if p&Administrator != 0 {
+		return All
+	}
+	return p & All
+}
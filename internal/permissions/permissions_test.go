@@ -0,0 +1,88 @@
+package permissions
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"testing"
+	"webserver/internal/config"
+)
+
+func TestHas(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permission
+		flags       Permission
+		want        bool
+	}{
+		{"no flags", 0, 0, true},
+		{"single flag set", ViewChannel, ViewChannel, true},
+		{"single flag missing", ViewChannel, SendMessages, false},
+		{"all of several flags", ViewChannel | SendMessages | Connect, ViewChannel | Connect, true},
+		{"one of several flags missing", ViewChannel | SendMessages, ViewChannel | Connect, false},
+		{"administrator implies every flag", Administrator, ManageServer | MentionEveryone, true},
+		{"default lacks management", Default, ManageChannels, false},
+		{"private allows messaging", Private, ViewChannel | SendMessages | AddReactions, true},
+		{"private lacks invites", Private, CreateInvite, false},
+	}
+
+	for _, test := range tests {
+		if got := test.permissions.Has(test.flags); got != test.want {
+			t.Errorf("%s: %b.Has(%b) = %v, want %v", test.name, test.permissions, test.flags, got, test.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permission
+		want        Permission
+	}{
+		{"empty", 0, 0},
+		{"known bits are kept", ViewChannel | SendMessages, ViewChannel | SendMessages},
+		{"unknown bits are dropped", ViewChannel | MentionEveryone<<1 | 1<<63, ViewChannel},
+		{"administrator expands to all", Administrator, All},
+		{"administrator with unknown bits", Administrator | 1<<40, All},
+	}
+
+	for _, test := range tests {
+		if got := normalize(test.permissions); got != test.want {
+			t.Errorf("%s: normalize(%b) = %b, want %b", test.name, test.permissions, got, test.want)
+		}
+	}
+}
+
+func TestAll(t *testing.T) {
+	for flag := Administrator; flag <= MentionEveryone; flag <<= 1 {
+		if All&flag == 0 {
+			t.Errorf("All is missing %b", flag)
+		}
+	}
+	if All&(MentionEveryone<<1) != 0 {
+		t.Errorf("All has bits beyond MentionEveryone: %b", All)
+	}
+}
+
+// newTestDB migrates a fresh database and makes it the one the package uses.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	pool, err := config.NewDatabasePool(config.DatabaseConfig{Driver: "sqlite3", Source: filepath.Join(t.TempDir(), "test.sqlite"), MaxConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.DB.Close() })
+	if err := pool.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	config.InitDatabase(pool)
+	return pool.DB
+}
+
+// exec runs setup statements for a test.
+func exec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,360 @@
+package permissions
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/helper"
+)
+
+var (
+	ErrRoleNotFound  = errors.New("role not found")
+	ErrRoleHierarchy = errors.New("you can only manage roles below your highest role")
+	ErrInvalidRole   = errors.New("invalid role")
+)
+
+// Role is a named set of permissions. Every server has an @everyone role whose ID equals
+// the server ID; it is implicitly assigned to every member and always has position 0.
+type Role struct {
+	RoleId      string     `json:"roleId"`
+	ServerId    string     `json:"serverId"`
+	Name        string     `json:"name"`
+	Color       int        `json:"color"`
+	Permissions Permission `json:"permissions"`
+	Position    int        `json:"position"`
+	Hoist       bool       `json:"hoist"`
+	Mentionable bool       `json:"mentionable"`
+	CreatedAt   time.Time  `json:"createdAt"`
+}
+
+// RoleUpdate holds the fields to change on a role; nil fields are left untouched.
+type RoleUpdate struct {
+	Name        *string     `json:"name"`
+	Color       *int        `json:"color"`
+	Permissions *Permission `json:"permissions"`
+	Hoist       *bool       `json:"hoist"`
+	Mentionable *bool       `json:"mentionable"`
+}
+
+type RolePosition struct {
+	RoleId   string `json:"roleId"`
+	Position int    `json:"position"`
+}
+
+// MarshalJSON encodes permissions as a string, JavaScript numbers cannot hold all 64 bits.
+func (p Permission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(p), 10))
+}
+
+// UnmarshalJSON accepts permissions as a string or a number.
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid permissions %s", data)
+	}
+	*p = Permission(parsed)
+	return nil
+}
+
+const roleColumns = "SELECT role_id, server_id, role_name, color, permissions, position, hoist, mentionable, created_at FROM roles"
+
+// ListRoles returns the roles of a server ordered from the lowest to the highest position.
+func ListRoles(q Querier, serverId int64) ([]Role, error) {
+	rows, err := q.Query(roleColumns+" WHERE server_id = ? ORDER BY position, role_id", serverId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// MemberRoleIds returns the IDs of the roles assigned to a member, not including @everyone.
+func MemberRoleIds(q Querier, serverId int64, userId int64) ([]string, error) {
+	rows, err := q.Query("SELECT role_id FROM member_roles WHERE server_id = ? AND user_id = ?", serverId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roleIds := []string{}
+	for rows.Next() {
+		var roleId int64
+		if err := rows.Scan(&roleId); err != nil {
+			return nil, err
+		}
+		roleIds = append(roleIds, strconv.FormatInt(roleId, 10))
+	}
+	return roleIds, rows.Err()
+}
+
+// CreateRole creates a role directly above @everyone on behalf of the actor.
+func CreateRole(actorId int64, serverId int64, fields RoleUpdate) (role Role, err error) {
+	if fields.Name == nil || *fields.Name == "" {
+		fields.Name = new(string)
+		*fields.Name = "new role"
+	}
+
+	err = config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		actorPermissions, err := requireManageRoles(tx, serverId, actorId)
+		if err != nil {
+			return err
+		}
+		if err := validateRoleFields(fields, actorPermissions); err != nil {
+			return err
+		}
+
+		roleId := helper.GenerateUniqueId()
+		if _, err := tx.Exec("UPDATE roles SET position = position + 1 WHERE server_id = ? AND position >= 1", serverId); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO roles (role_id, server_id, role_name, permissions, position) VALUES (?, ?, ?, 0, 1)", roleId, serverId, *fields.Name)
+		if err != nil {
+			return err
+		}
+
+		role, err = applyRoleUpdate(tx, serverId, roleId, fields)
+		return err
+	})
+	return role, err
+}
+
+// UpdateRole changes a role below the actor's highest role.
+func UpdateRole(actorId int64, serverId int64, roleId int64, fields RoleUpdate) (role Role, err error) {
+	err = config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		actorPermissions, err := requireManageRoles(tx, serverId, actorId)
+		if err != nil {
+			return err
+		}
+		if err := requireBelowActor(tx, serverId, actorId, roleId); err != nil {
+			return err
+		}
+		if roleId == serverId && fields.Name != nil {
+			return fmt.Errorf("%w: the @everyone role cannot be renamed", ErrInvalidRole)
+		}
+		if err := validateRoleFields(fields, actorPermissions); err != nil {
+			return err
+		}
+
+		role, err = applyRoleUpdate(tx, serverId, roleId, fields)
+		return err
+	})
+	return role, err
+}
+
+// DeleteRole deletes a role below the actor's highest role and removes it from all members
+// and from the overwrites of every channel.
+func DeleteRole(actorId int64, serverId int64, roleId int64) error {
+	return config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if _, err := requireManageRoles(tx, serverId, actorId); err != nil {
+			return err
+		}
+		if roleId == serverId {
+			return fmt.Errorf("%w: the @everyone role cannot be deleted", ErrInvalidRole)
+		}
+		if err := requireBelowActor(tx, serverId, actorId, roleId); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM member_roles WHERE role_id = ?", roleId); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM channel_overwrites WHERE target_id = ? AND target_type = ?", roleId, OverwriteRole); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM roles WHERE role_id = ? AND server_id = ?", roleId, serverId)
+		return err
+	})
+}
+
+// ReorderRoles moves roles to new positions. Both the old and the new position of every
+// moved role must be below the actor's highest role; @everyone cannot be moved.
+func ReorderRoles(actorId int64, serverId int64, positions []RolePosition) (roles []Role, err error) {
+	err = config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if _, err := requireManageRoles(tx, serverId, actorId); err != nil {
+			return err
+		}
+		actorPosition, err := HighestPosition(tx, serverId, actorId)
+		if err != nil {
+			return err
+		}
+
+		for _, position := range positions {
+			roleId, err := strconv.ParseInt(position.RoleId, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: invalid role ID %q", ErrInvalidRole, position.RoleId)
+			}
+			if roleId == serverId || position.Position < 1 {
+				return fmt.Errorf("%w: the @everyone role always stays at position 0", ErrInvalidRole)
+			}
+			if err := requireBelowActor(tx, serverId, actorId, roleId); err != nil {
+				return err
+			}
+			if position.Position >= actorPosition {
+				return ErrRoleHierarchy
+			}
+			if _, err := tx.Exec("UPDATE roles SET position = ? WHERE role_id = ? AND server_id = ?", position.Position, roleId, serverId); err != nil {
+				return err
+			}
+		}
+
+		roles, err = ListRoles(tx, serverId)
+		return err
+	})
+	return roles, err
+}
+
+// SetMemberRole assigns a role to or removes it from a member.
+func SetMemberRole(actorId int64, serverId int64, userId int64, roleId int64, assign bool) error {
+	return config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if _, err := requireManageRoles(tx, serverId, actorId); err != nil {
+			return err
+		}
+		if roleId == serverId {
+			return fmt.Errorf("%w: the @everyone role is assigned implicitly", ErrInvalidRole)
+		}
+		if err := requireBelowActor(tx, serverId, actorId, roleId); err != nil {
+			return err
+		}
+
+		var isMember bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM server_members WHERE server_id = ? AND user_id = ?)", serverId, userId).Scan(&isMember)
+		if err != nil {
+			return err
+		}
+		if !isMember {
+			return ErrNotMember
+		}
+
+		if assign {
+			_, err = tx.Exec("INSERT OR IGNORE INTO member_roles (server_id, user_id, role_id) VALUES (?, ?, ?)", serverId, userId, roleId)
+		} else {
+			_, err = tx.Exec("DELETE FROM member_roles WHERE server_id = ? AND user_id = ? AND role_id = ?", serverId, userId, roleId)
+		}
+		return err
+	})
+}
+
+// HighestPosition returns the position of the highest role of a member; owners rank above every role.
+func HighestPosition(q Querier, serverId int64, userId int64) (int, error) {
+	var serverOwner bool
+	err := q.QueryRow("SELECT COALESCE(server_owner, false) FROM server_members WHERE server_id = ? AND user_id = ?", serverId, userId).Scan(&serverOwner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotMember
+	} else if err != nil {
+		return 0, err
+	}
+	if serverOwner {
+		return math.MaxInt32, nil
+	}
+
+	var position int
+	err = q.QueryRow(`SELECT COALESCE(MAX(r.position), 0) FROM member_roles mr JOIN roles r ON r.role_id = mr.role_id
+		WHERE mr.server_id = ? AND mr.user_id = ?`, serverId, userId).Scan(&position)
+	return position, err
+}
+
+func requireManageRoles(q Querier, serverId int64, actorId int64) (Permission, error) {
+	permissions, err := ServerPermissions(q, serverId, actorId)
+	if err != nil {
+		return 0, err
+	}
+	if !permissions.Has(ManageRoles) {
+		return 0, ErrMissingPermission
+	}
+	return permissions, nil
+}
+
+func requireBelowActor(q Querier, serverId int64, actorId int64, roleId int64) error {
+	var position int
+	err := q.QueryRow("SELECT position FROM roles WHERE role_id = ? AND server_id = ?", roleId, serverId).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRoleNotFound
+	} else if err != nil {
+		return err
+	}
+
+	actorPosition, err := HighestPosition(q, serverId, actorId)
+	if err != nil {
+		return err
+	}
+	// The @everyone role sits below every other role, so anyone allowed to manage roles may edit it
+	if roleId != serverId && position >= actorPosition {
+		return ErrRoleHierarchy
+	}
+	return nil
+}
+
+// validateRoleFields makes sure the actor does not grant permissions they do not have themselves.
+func validateRoleFields(fields RoleUpdate, actorPermissions Permission) error {
+	if fields.Name != nil && (len(*fields.Name) == 0 || len(*fields.Name) > 100) {
+		return fmt.Errorf("%w: the name must be between 1 and 100 characters", ErrInvalidRole)
+	}
+	if fields.Permissions != nil {
+		if *fields.Permissions&^All != 0 {
+			return fmt.Errorf("%w: unknown permission bits", ErrInvalidRole)
+		}
+		if actorPermissions&Administrator == 0 && *fields.Permissions&^actorPermissions != 0 {
+			return ErrMissingPermission
+		}
+	}
+	return nil
+}
+
+func applyRoleUpdate(tx *sql.Tx, serverId int64, roleId int64, fields RoleUpdate) (Role, error) {
+	var err error
+	if fields.Name != nil {
+		_, err = tx.Exec("UPDATE roles SET role_name = ? WHERE role_id = ?", *fields.Name, roleId)
+	}
+	if err == nil && fields.Color != nil {
+		_, err = tx.Exec("UPDATE roles SET color = ? WHERE role_id = ?", *fields.Color, roleId)
+	}
+	if err == nil && fields.Permissions != nil {
+		_, err = tx.Exec("UPDATE roles SET permissions = ? WHERE role_id = ?", int64(*fields.Permissions), roleId)
+	}
+	if err == nil && fields.Hoist != nil {
+		_, err = tx.Exec("UPDATE roles SET hoist = ? WHERE role_id = ?", *fields.Hoist, roleId)
+	}
+	if err == nil && fields.Mentionable != nil {
+		_, err = tx.Exec("UPDATE roles SET mentionable = ? WHERE role_id = ?", *fields.Mentionable, roleId)
+	}
+	if err != nil {
+		return Role{}, err
+	}
+
+	return scanRole(tx.QueryRow(roleColumns+" WHERE role_id = ? AND server_id = ?", roleId, serverId))
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRole(row rowScanner) (Role, error) {
+	var role Role
+	var roleId, serverId, permissions int64
+	err := row.Scan(&roleId, &serverId, &role.Name, &role.Color, &permissions, &role.Position, &role.Hoist, &role.Mentionable, &role.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Role{}, ErrRoleNotFound
+	} else if err != nil {
+		return Role{}, err
+	}
+	role.RoleId = strconv.FormatInt(roleId, 10)
+	role.ServerId = strconv.FormatInt(serverId, 10)
+	role.Permissions = Permission(permissions)
+	return role, nil
+}
@@ -0,0 +1,90 @@
+package permissions
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeleteRole(t *testing.T) {
+	const (
+		serverId  = 10
+		channelId = 100
+		ownerId   = 1
+		managerId = 2
+		memberId  = 3
+		// managerRoleId allows managing roles and sits above roleId.
+		managerRoleId = 20
+		roleId        = 21
+		unknownRoleId = 99
+	)
+
+	tests := []struct {
+		name    string
+		actorId int64
+		roleId  int64
+		wantErr error
+	}{
+		{"@everyone", ownerId, serverId, ErrInvalidRole},
+		{"unknown role", ownerId, unknownRoleId, ErrRoleNotFound},
+		{"not a member", 4, roleId, ErrNotMember},
+		{"without ManageRoles", memberId, roleId, ErrMissingPermission},
+		{"own highest role", managerId, managerRoleId, ErrRoleHierarchy},
+		{"below the actor", managerId, roleId, nil},
+		{"by the owner", ownerId, managerRoleId, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestDB(t)
+			exec(t, db, "INSERT INTO servers (server_id, server_name) VALUES (?, 's')", serverId)
+			exec(t, db, "INSERT INTO roles (role_id, server_id, role_name, permissions, position) VALUES (?, ?, '@everyone', ?, 0), (?, ?, 'manager', ?, 2), (?, ?, 'role', 0, 1)",
+				serverId, serverId, int64(Default), managerRoleId, serverId, int64(ManageRoles), roleId, serverId)
+			exec(t, db, "INSERT INTO server_members (server_id, user_id, server_owner) VALUES (?, ?, true), (?, ?, false), (?, ?, false)",
+				serverId, ownerId, serverId, managerId, serverId, memberId)
+			exec(t, db, "INSERT INTO member_roles (server_id, user_id, role_id) VALUES (?, ?, ?), (?, ?, ?)",
+				serverId, managerId, managerRoleId, serverId, memberId, roleId)
+			exec(t, db, "INSERT INTO channels (channel_id, server_id, channel_name, type) VALUES (?, ?, 'general', 1)", channelId, serverId)
+			exec(t, db, "INSERT INTO channel_overwrites (channel_id, target_id, target_type, allow, deny) VALUES (?, ?, ?, 0, ?), (?, ?, ?, ?, 0), (?, ?, ?, ?, 0), (?, ?, ?, ?, 0)",
+				channelId, serverId, OverwriteRole, int64(SendMessages),
+				channelId, managerRoleId, OverwriteRole, int64(SendMessages),
+				channelId, roleId, OverwriteRole, int64(SendMessages),
+				channelId, memberId, OverwriteMember, int64(AddReactions))
+
+			err := DeleteRole(test.actorId, serverId, test.roleId)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("DeleteRole() = %v, want %v", err, test.wantErr)
+			}
+
+			deleted := test.wantErr == nil
+			var roles, memberRoles, overwrites, otherOverwrites int
+			if err := db.QueryRow("SELECT COUNT(*) FROM roles WHERE role_id = ?", test.roleId).Scan(&roles); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.QueryRow("SELECT COUNT(*) FROM member_roles WHERE role_id = ?", test.roleId).Scan(&memberRoles); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.QueryRow("SELECT COUNT(*) FROM channel_overwrites WHERE target_id = ?", test.roleId).Scan(&overwrites); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.QueryRow("SELECT COUNT(*) FROM channel_overwrites WHERE target_id != ?", test.roleId).Scan(&otherOverwrites); err != nil {
+				t.Fatal(err)
+			}
+
+			if deleted && (roles != 0 || memberRoles != 0 || overwrites != 0) {
+				t.Errorf("left %d roles, %d member roles and %d overwrites of the deleted role", roles, memberRoles, overwrites)
+			}
+			// Every role but unknownRoleId starts out with one overwrite
+			known := test.roleId != unknownRoleId
+			if known && !deleted && (roles != 1 || overwrites != 1) {
+				t.Errorf("found %d roles and %d overwrites of the role after a failed delete, want 1 each", roles, overwrites)
+			}
+			wantOther := 4
+			if known {
+				wantOther = 3
+			}
+			if otherOverwrites != wantOther {
+				t.Errorf("found %d overwrites of other targets, want %d", otherOverwrites, wantOther)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"errors"
+	"webserver/internal/permissions"
+)
+
+// Payloads of the requests sent over /wss, named after their request type.
+
+const maxMessageLength = 4000
+
+type UpdateAppearance struct {
+	Appearance uint8 `json:"appearance"`
+}
+
+func (p *UpdateAppearance) Validate() error {
+	if p.Appearance < 1 || p.Appearance > 4 {
+		return errors.New("appearance must be 1 (online), 2 (idle), 3 (dnd) or 4 (invisible)")
+	}
+	return nil
+}
+
+type UpdateStatus struct {
+	Status string `json:"status"`
+}
+
+func (p *UpdateStatus) Validate() error {
+	if len(p.Status) > 128 {
+		return errors.New("status message exceeds the amount of 128 characters")
+	}
+	return nil
+}
+
+type UpdatePronouns struct {
+	Pronouns string `json:"pronouns"`
+}
+
+func (p *UpdatePronouns) Validate() error {
+	if len(p.Pronouns) > 40 {
+		return errors.New("pronouns exceed the number of 40 characters")
+	}
+	return nil
+}
+
+// SendMessage sends a message to a channel, optionally as a reply to another message of the channel.
+type SendMessage struct {
+	ChannelId        ID     `json:"channelId"`
+	Message          string `json:"message"`
+	ReplyToMessageId ID     `json:"replyToMessageId"`
+}
+
+func (p *SendMessage) Validate() error {
+	if err := requireId("channelId", p.ChannelId); err != nil {
+		return err
+	}
+	return ValidateMessageText(p.Message)
+}
+
+type EditMessage struct {
+	MessageId ID     `json:"messageId"`
+	Message   string `json:"message"`
+}
+
+func (p *EditMessage) Validate() error {
+	if err := requireId("messageId", p.MessageId); err != nil {
+		return err
+	}
+	return ValidateMessageText(p.Message)
+}
+
+type DeleteMessage struct {
+	MessageId ID `json:"messageId"`
+}
+
+func (p *DeleteMessage) Validate() error {
+	return requireId("messageId", p.MessageId)
+}
+
+type UpdateRole struct {
+	ServerId ID `json:"serverId"`
+	RoleId   ID `json:"roleId"`
+	permissions.RoleUpdate
+}
+
+func (p *UpdateRole) Validate() error {
+	if err := requireId("serverId", p.ServerId); err != nil {
+		return err
+	}
+	return requireId("roleId", p.RoleId)
+}
+
+// NewChannel carries the same fields as POST /api/{serverId}/channels.
+type NewChannel struct {
+	ServerId ID      `json:"serverId"`
+	Type     *uint8  `json:"type"`
+	Name     *string `json:"name"`
+	ParentId *string `json:"parentId"`
+	Position *int    `json:"position"`
+	Topic    *string `json:"topic"`
+	Nsfw     *bool   `json:"nsfw"`
+}
+
+func (p *NewChannel) Validate() error {
+	return requireId("serverId", p.ServerId)
+}
+
+type UserProfile struct {
+	UserId ID `json:"userId"`
+}
+
+func (p *UserProfile) Validate() error {
+	return requireId("userId", p.UserId)
+}
+
+type TypingStart struct {
+	ChannelId ID `json:"channelId"`
+}
+
+func (p *TypingStart) Validate() error {
+	return requireId("channelId", p.ChannelId)
+}
+
+// AckMessage is the payload of ack, which marks a channel as read up to a message.
+type AckMessage struct {
+	ChannelId ID `json:"channelId"`
+	MessageId ID `json:"messageId"`
+}
+
+func (p *AckMessage) Validate() error {
+	if err := requireId("channelId", p.ChannelId); err != nil {
+		return err
+	}
+	return requireId("messageId", p.MessageId)
+}
+
+// NewThread starts a thread on a message, like POST /api/channels/{channelId}/messages/{messageId}/threads.
+type NewThread struct {
+	ChannelId          ID     `json:"channelId"`
+	MessageId          ID     `json:"messageId"`
+	Name               string `json:"name"`
+	AutoArchiveMinutes int    `json:"autoArchiveMinutes"`
+}
+
+func (p *NewThread) Validate() error {
+	if err := requireId("channelId", p.ChannelId); err != nil {
+		return err
+	}
+	return requireId("messageId", p.MessageId)
+}
+
+// ValidateMessageText checks the text of a new or edited message.
+func ValidateMessageText(message string) error {
+	if message == "" {
+		return errors.New("the message must not be empty")
+	}
+	if len(message) > maxMessageLength {
+		return errors.New("the message must not exceed 4000 characters")
+	}
+	return nil
+}
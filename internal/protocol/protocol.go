@@ -0,0 +1,119 @@
+// Package protocol defines the messages exchanged over the /wss and /webrtc sockets.
+//
+// Clients send a Request with a type, an optional nonce and a type-specific payload.
+// A request with a nonce is answered with an Ack or an Error carrying the same nonce;
+// errors never close the connection. The server pushes everything else as an Event.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Version is the protocol version announced in the handshake. Clients may request a version
+// with the v query parameter when connecting; other versions are rejected.
+const Version = 1
+
+var (
+	ErrInvalidPayload     = errors.New("invalid payload")
+	ErrUnknownRequest     = errors.New("unknown request type")
+	ErrUnsupportedVersion = fmt.Errorf("unsupported protocol version, the server speaks version %d", Version)
+)
+
+// Request is the envelope of every message sent by a client.
+type Request struct {
+	Type  string          `json:"type"`
+	Nonce string          `json:"nonce,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// Event is pushed by the server. Seq numbers the events of a /wss session.
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+	Seq  int64       `json:"seq,omitempty"`
+}
+
+// Ack confirms that the request with the given nonce succeeded.
+type Ack struct {
+	Type  string      `json:"type"`
+	Nonce string      `json:"nonce"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Error tells the client that a request failed. Nonce is empty if the request had none
+// or could not be parsed.
+type Error struct {
+	Type       string `json:"type"`
+	Nonce      string `json:"nonce,omitempty"`
+	Status     int    `json:"status"`
+	StatusText string `json:"statusText"`
+}
+
+func NewAck(nonce string, data interface{}) Ack {
+	return Ack{Type: "ack", Nonce: nonce, Data: data}
+}
+
+func NewError(nonce string, status int, statusText string) Error {
+	return Error{Type: "error", Nonce: nonce, Status: status, StatusText: statusText}
+}
+
+// CheckVersion validates the version requested by a client; an empty version means the current one.
+func CheckVersion(version string) error {
+	if version == "" || version == strconv.Itoa(Version) {
+		return nil
+	}
+	return ErrUnsupportedVersion
+}
+
+// Validator is implemented by payloads that check their fields after decoding.
+type Validator interface {
+	Validate() error
+}
+
+// Decode parses the payload of a request into T and validates it.
+// Every error wraps ErrInvalidPayload.
+func Decode[T any](request Request) (T, error) {
+	var payload T
+	if len(request.Data) > 0 && string(request.Data) != "null" {
+		if err := json.Unmarshal(request.Data, &payload); err != nil {
+			return payload, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+		}
+	}
+
+	if validator, ok := any(&payload).(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return payload, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+		}
+	}
+	return payload, nil
+}
+
+// ID is a snowflake-like ID. It is sent as a string since JavaScript numbers cannot hold every int64.
+type ID int64
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(id), 10))
+}
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("IDs must be sent as strings")
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid ID", value)
+	}
+	*id = ID(parsed)
+	return nil
+}
+
+func requireId(name string, id ID) error {
+	if id == 0 {
+		return fmt.Errorf("%s is required", name)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func decodeAs[T any](data string) error {
+	_, err := Decode[T](Request{Type: "test", Data: json.RawMessage(data)})
+	return err
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		decode  func(data string) error
+		data    string
+		wantErr bool
+	}{
+		{"appearance", decodeAs[UpdateAppearance], `{"appearance":2}`, false},
+		{"appearance out of range", decodeAs[UpdateAppearance], `{"appearance":5}`, true},
+		{"appearance missing", decodeAs[UpdateAppearance], `{}`, true},
+		{"status", decodeAs[UpdateStatus], `{"status":"away"}`, false},
+		{"status too long", decodeAs[UpdateStatus], `{"status":"` + strings.Repeat("a", 129) + `"}`, true},
+		{"pronouns too long", decodeAs[UpdatePronouns], `{"pronouns":"` + strings.Repeat("a", 41) + `"}`, true},
+		{"message", decodeAs[SendMessage], `{"channelId":"1","message":"hi"}`, false},
+		{"reply", decodeAs[SendMessage], `{"channelId":"1","message":"hi","replyToMessageId":"2"}`, false},
+		{"message without channel", decodeAs[SendMessage], `{"message":"hi"}`, true},
+		{"empty message", decodeAs[SendMessage], `{"channelId":"1","message":""}`, true},
+		{"message too long", decodeAs[SendMessage], `{"channelId":"1","message":"` + strings.Repeat("a", maxMessageLength+1) + `"}`, true},
+		{"message of maximum length", decodeAs[SendMessage], `{"channelId":"1","message":"` + strings.Repeat("a", maxMessageLength) + `"}`, false},
+		{"numeric ID", decodeAs[SendMessage], `{"channelId":1,"message":"hi"}`, true},
+		{"malformed ID", decodeAs[SendMessage], `{"channelId":"x","message":"hi"}`, true},
+		{"negative ID", decodeAs[DeleteMessage], `{"messageId":"-42"}`, false},
+		{"edit without message ID", decodeAs[EditMessage], `{"message":"hi"}`, true},
+		{"role", decodeAs[UpdateRole], `{"serverId":"1","roleId":"2","name":"mod"}`, false},
+		{"role without role ID", decodeAs[UpdateRole], `{"serverId":"1"}`, true},
+		{"ack", decodeAs[AckMessage], `{"channelId":"1","messageId":"2"}`, false},
+		{"ack without message ID", decodeAs[AckMessage], `{"channelId":"1"}`, true},
+		{"thread", decodeAs[NewThread], `{"channelId":"1","messageId":"2","name":"t"}`, false},
+		{"missing data", decodeAs[UserProfile], ``, true},
+		{"null data", decodeAs[UserProfile], `null`, true},
+		{"data of the wrong type", decodeAs[UserProfile], `[]`, true},
+		{"voice target", decodeAs[JoinChannel], `{"channelId":"1","socketId":"2"}`, false},
+		{"voice target without socket", decodeAs[Disconnect], `{"channelId":"1"}`, true},
+		{"layer", decodeAs[SetLayer], `{"channelId":"1","socketId":"2","trackId":"t","layer":"m"}`, false},
+		{"unknown layer", decodeAs[SetLayer], `{"channelId":"1","socketId":"2","trackId":"t","layer":"x"}`, true},
+		{"layer without track", decodeAs[SetLayer], `{"channelId":"1","socketId":"2","layer":"l"}`, true},
+		{"offer", decodeAs[Offer], `{"channelId":"1","socketId":"2","offer":{"type":"offer","sdp":"v=0"}}`, false},
+		{"answer sent as offer", decodeAs[Offer], `{"channelId":"1","socketId":"2","offer":{"type":"answer","sdp":"v=0"}}`, true},
+		{"answer without SDP", decodeAs[Answer], `{"channelId":"1","socketId":"2","answer":{"type":"answer"}}`, true},
+		{"empty candidate", decodeAs[ICECandidate], `{"channelId":"1","socketId":"2","candidate":{}}`, true},
+	}
+
+	for _, test := range tests {
+		err := test.decode(test.data)
+		if test.wantErr != (err != nil) {
+			t.Errorf("%s: Decode(%s) error = %v, want error %v", test.name, test.data, err, test.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s: Decode(%s) error = %v, want it to wrap ErrInvalidPayload", test.name, test.data, err)
+		}
+	}
+}
+
+func TestIDJSON(t *testing.T) {
+	tests := []struct {
+		id   ID
+		json string
+	}{
+		{0, `"0"`},
+		{42, `"42"`},
+		{-7, `"-7"`},
+		{9007199254740993, `"9007199254740993"`},
+	}
+
+	for _, test := range tests {
+		data, err := json.Marshal(test.id)
+		if err != nil || string(data) != test.json {
+			t.Errorf("json.Marshal(%d) = %s, %v, want %s", test.id, data, err, test.json)
+		}
+		var id ID
+		if err := json.Unmarshal([]byte(test.json), &id); err != nil || id != test.id {
+			t.Errorf("json.Unmarshal(%s) = %d, %v, want %d", test.json, id, err, test.id)
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		wantErr error
+	}{
+		{"", nil},
+		{"1", nil},
+		{"2", ErrUnsupportedVersion},
+		{"v1", ErrUnsupportedVersion},
+	}
+
+	for _, test := range tests {
+		if err := CheckVersion(test.version); !errors.Is(err, test.wantErr) {
+			t.Errorf("CheckVersion(%q) = %v, want %v", test.version, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"errors"
+	"github.com/pion/webrtc/v3"
+)
+
+// Payloads of the requests sent over /webrtc, named after their request type.
+
+// VoiceTarget identifies the connection of a client in a voice channel.
+type VoiceTarget struct {
+	ChannelId ID `json:"channelId"`
+	SocketId  ID `json:"socketId"`
+}
+
+func (p *VoiceTarget) Validate() error {
+	if err := requireId("channelId", p.ChannelId); err != nil {
+		return err
+	}
+	return requireId("socketId", p.SocketId)
+}
+
+// JoinChannel is the payload of joinChannel.
+type JoinChannel struct {
+	VoiceTarget
+}
+
+// VoiceStateUpdate is the payload of voice-state, which replaces the voice state the client controls.
+type VoiceStateUpdate struct {
+	VoiceTarget
+	SelfMute  bool `json:"selfMute"`
+	SelfDeaf  bool `json:"selfDeaf"`
+	Streaming bool `json:"streaming"`
+	Video     bool `json:"video"`
+}
+
+// SetLayer is the payload of set-layer, which selects the simulcast layer received for a video track:
+// l, m or h. Until the layer is available, the closest lower one is received.
+type SetLayer struct {
+	VoiceTarget
+	TrackId string `json:"trackId"`
+	Layer   string `json:"layer"`
+}
+
+func (p *SetLayer) Validate() error {
+	if err := p.VoiceTarget.Validate(); err != nil {
+		return err
+	}
+	if p.TrackId == "" {
+		return errors.New("trackId is required")
+	}
+	if p.Layer != "l" && p.Layer != "m" && p.Layer != "h" {
+		return errors.New("layer must be l, m or h")
+	}
+	return nil
+}
+
+// Disconnect is the payload of disconnect.
+type Disconnect struct {
+	VoiceTarget
+}
+
+type Offer struct {
+	VoiceTarget
+	Offer webrtc.SessionDescription `json:"offer"`
+}
+
+func (p *Offer) Validate() error {
+	if err := p.VoiceTarget.Validate(); err != nil {
+		return err
+	}
+	if p.Offer.Type != webrtc.SDPTypeOffer || p.Offer.SDP == "" {
+		return errors.New("offer must be an SDP offer")
+	}
+	return nil
+}
+
+// Answer is the payload of answer, sent in reply to an offer of the server.
+type Answer struct {
+	VoiceTarget
+	Answer webrtc.SessionDescription `json:"answer"`
+}
+
+func (p *Answer) Validate() error {
+	if err := p.VoiceTarget.Validate(); err != nil {
+		return err
+	}
+	if p.Answer.Type != webrtc.SDPTypeAnswer || p.Answer.SDP == "" {
+		return errors.New("answer must be an SDP answer")
+	}
+	return nil
+}
+
+type ICECandidate struct {
+	VoiceTarget
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+func (p *ICECandidate) Validate() error {
+	if err := p.VoiceTarget.Validate(); err != nil {
+		return err
+	}
+	if p.Candidate.Candidate == "" {
+		return errors.New("candidate is required")
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package webrtc
+
+import (
+	"errors"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTrackNotFound is returned for layer requests about a track the peer doesn't receive.
+var ErrTrackNotFound = errors.New("track not found")
+
+// Publishers may send video in up to three qualities, identified by their RID. Tracks without
+// simulcast have a single layer with an empty RID.
+const (
+	layerLow    = "l"
+	layerMedium = "m"
+	layerHigh   = "h"
+)
+
+var layerOrder = map[string]int{layerLow: 0, layerMedium: 1, layerHigh: 2}
+
+// layerTimeout is how long a layer may go without packets before subscribers are moved to another one,
+// e.g. when the publisher stops sending its high layer because its bandwidth dropped.
+const layerTimeout = time.Second
+
+// simulcastExtensions are the RTP header extensions publishers identify their layers with.
+var simulcastExtensions = []string{
+	"urn:ietf:params:rtp-hdrext:sdes:mid",
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+}
+
+// layer is one of the encodings of a published track.
+type layer struct {
+	ssrc uint32
+	// lastPacket is the time the last packet arrived, in Unix nanoseconds.
+	lastPacket atomic.Int64
+}
+
+// subscription is a forwarded track as sent to one peer.
+type subscription struct {
+	local *webrtc.TrackLocalStaticRTP
+	peer  *Peer
+	mu    sync.Mutex
+	// layer is the layer forwarded to the peer and target the one it asked for. While they differ
+	// and the target is available, the peer is switched at the next keyframe of the target.
+	layer    string
+	target   string
+	rewriter sequenceRewriter
+}
+
+// sequenceRewriter keeps the sequence numbers and timestamps sent to a subscriber continuous when it is
+// switched between layers, which each have their own. The SSRC is rewritten by the local track.
+type sequenceRewriter struct {
+	clockRate uint32
+	started   bool
+	resync    bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTs    uint32
+	lastWrite time.Time
+}
+
+func (r *sequenceRewriter) rewrite(packet *rtp.Packet) rtp.Packet {
+	now := time.Now()
+	if r.resync && r.started {
+		// Continue right after the last packet sent, advancing the timestamp by the time that passed
+		elapsed := uint32(now.Sub(r.lastWrite).Seconds() * float64(r.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		r.seqOffset = packet.SequenceNumber - (r.lastSeq + 1)
+		r.tsOffset = packet.Timestamp - (r.lastTs + elapsed)
+	}
+	r.resync = false
+
+	out := *packet
+	out.SequenceNumber = packet.SequenceNumber - r.seqOffset
+	out.Timestamp = packet.Timestamp - r.tsOffset
+	if !r.started || int16(out.SequenceNumber-r.lastSeq) > 0 {
+		r.lastSeq = out.SequenceNumber
+		r.lastTs = out.Timestamp
+		r.lastWrite = now
+	}
+	r.started = true
+	return out
+}
+
+// isKeyframe reports whether a packet starts a keyframe. It is only known for VP8; packets of other
+// codecs are all treated as keyframes, so layer switches happen right away.
+func isKeyframe(codec webrtc.RTPCodecCapability, packet *rtp.Packet) bool {
+	if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8) {
+		return true
+	}
+	var vp8 codecs.VP8Packet
+	if _, err := vp8.Unmarshal(packet.Payload); err != nil {
+		return false
+	}
+	return vp8.S == 1 && vp8.PID == 0 && len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+}
+
+// addLayer registers a layer of the track. It returns false if the layer was already known.
+func (track *forwardedTrack) addLayer(rid string, ssrc uint32) bool {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+
+	if _, ok := track.layers[rid]; ok {
+		return false
+	}
+	track.layers[rid] = &layer{ssrc: ssrc}
+	return true
+}
+
+// removeLayer unregisters a layer of the track and returns the number of layers left.
+func (track *forwardedTrack) removeLayer(rid string) int {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+
+	delete(track.layers, rid)
+	return len(track.layers)
+}
+
+// resolveLayer returns the layer to forward to a subscriber that asked for target: the best active
+// layer up to target, or the lowest active one above it. The track must be locked.
+func (track *forwardedTrack) resolveLayer(target string, now time.Time) string {
+	best, bestOrder := "", -1
+	lowest, lowestOrder := "", len(layerOrder)
+	for rid, l := range track.layers {
+		if len(track.layers) == 1 {
+			return rid
+		}
+		if now.Sub(time.Unix(0, l.lastPacket.Load())) > layerTimeout {
+			continue
+		}
+		order := layerOrder[rid]
+		if order <= layerOrder[target] && order > bestOrder {
+			best, bestOrder = rid, order
+		}
+		if order < lowestOrder {
+			lowest, lowestOrder = rid, order
+		}
+	}
+	if bestOrder >= 0 {
+		return best
+	}
+	return lowest
+}
+
+// requestKeyframe asks the publisher of the track for a keyframe of a layer.
+func (track *forwardedTrack) requestKeyframe(rid string) {
+	track.mu.RLock()
+	l, ok := track.layers[rid]
+	track.mu.RUnlock()
+	if !ok || track.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	err := track.publisher.peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: l.ssrc}})
+	if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		log.Println("Error requesting keyframe:", err)
+	}
+}
+
+// setLayer sets the simulcast layer the peer with the given socket ID prefers for a track it receives.
+func setLayer(channelId int64, socketId int64, trackId string, target string) error {
+	channel, err := lookupChannel(channelId, socketId)
+	if err != nil {
+		return err
+	}
+
+	channel.mu.Lock()
+	track, ok := channel.tracks[trackId]
+	channel.mu.Unlock()
+	if !ok {
+		return ErrTrackNotFound
+	}
+
+	track.mu.RLock()
+	sub, ok := track.subscribers[socketId]
+	next := track.resolveLayer(target, time.Now())
+	track.mu.RUnlock()
+	if !ok {
+		return ErrTrackNotFound
+	}
+
+	sub.mu.Lock()
+	sub.target = target
+	switching := sub.layer != next
+	sub.mu.Unlock()
+
+	if switching {
+		track.requestKeyframe(next)
+	}
+	return nil
+}
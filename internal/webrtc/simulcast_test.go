@@ -0,0 +1,130 @@
+package webrtc
+
+import (
+	"github.com/pion/rtp"
+	"testing"
+	"time"
+)
+
+func TestSequenceRewriter(t *testing.T) {
+	const clockRate = 90000
+
+	type packet struct {
+		seq uint16
+		ts  uint32
+		// resync switches to another layer before the packet.
+		resync  bool
+		wantSeq uint16
+	}
+
+	tests := []struct {
+		name    string
+		packets []packet
+	}{
+		{"first layer passes through", []packet{
+			{seq: 100, ts: 1000, wantSeq: 100},
+			{seq: 101, ts: 4000, wantSeq: 101},
+			{seq: 102, ts: 7000, wantSeq: 102},
+		}},
+		{"switch before the first packet", []packet{
+			{seq: 500, ts: 1000, resync: true, wantSeq: 500},
+			{seq: 501, ts: 4000, wantSeq: 501},
+		}},
+		{"switch continues the sequence", []packet{
+			{seq: 100, ts: 1000, wantSeq: 100},
+			{seq: 101, ts: 4000, wantSeq: 101},
+			{seq: 5000, ts: 900000, resync: true, wantSeq: 102},
+			{seq: 5001, ts: 903000, wantSeq: 103},
+			{seq: 5002, ts: 906000, wantSeq: 104},
+		}},
+		{"switch back", []packet{
+			{seq: 100, ts: 1000, wantSeq: 100},
+			{seq: 5000, ts: 900000, resync: true, wantSeq: 101},
+			{seq: 5001, ts: 903000, wantSeq: 102},
+			{seq: 103, ts: 10000, resync: true, wantSeq: 103},
+			{seq: 104, ts: 13000, wantSeq: 104},
+		}},
+		{"wraparound", []packet{
+			{seq: 65534, ts: 4294964296, wantSeq: 65534},
+			{seq: 65535, ts: 1000, wantSeq: 65535},
+			{seq: 0, ts: 4000, wantSeq: 0},
+			{seq: 10, ts: 50, resync: true, wantSeq: 1},
+			{seq: 11, ts: 3050, wantSeq: 2},
+		}},
+		{"late packet doesn't move the switch point", []packet{
+			{seq: 100, ts: 1000, wantSeq: 100},
+			{seq: 102, ts: 7000, wantSeq: 102},
+			{seq: 101, ts: 4000, wantSeq: 101},
+			{seq: 9000, ts: 5, resync: true, wantSeq: 103},
+		}},
+	}
+
+	for _, test := range tests {
+		r := sequenceRewriter{clockRate: clockRate}
+		// last is the newest packet sent, offset the timestamp offset of the current layer.
+		var last rtp.Packet
+		var offset uint32
+		for i, p := range test.packets {
+			started := i > 0
+			if p.resync {
+				r.resync = true
+			}
+			out := r.rewrite(&rtp.Packet{Header: rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts}})
+			if out.SequenceNumber != p.wantSeq {
+				t.Errorf("%s: packet %d has sequence number %d, want %d", test.name, i, out.SequenceNumber, p.wantSeq)
+			}
+
+			if p.resync && started {
+				// The timestamp advances by the time since the last packet, which is next to nothing here
+				if elapsed := out.Timestamp - last.Timestamp; elapsed == 0 || elapsed > clockRate {
+					t.Errorf("%s: packet %d advances the timestamp by %d after a switch", test.name, i, elapsed)
+				}
+				offset = p.ts - out.Timestamp
+			} else if got := p.ts - out.Timestamp; got != offset {
+				t.Errorf("%s: packet %d has timestamp %d, want %d", test.name, i, out.Timestamp, p.ts-offset)
+			}
+
+			if !started || int16(out.SequenceNumber-last.SequenceNumber) > 0 {
+				last = out
+			}
+		}
+	}
+}
+
+func TestResolveLayer(t *testing.T) {
+	now := time.Now()
+	active := now.Add(-layerTimeout / 2)
+	stale := now.Add(-2 * layerTimeout)
+
+	tests := []struct {
+		name   string
+		layers map[string]time.Time
+		target string
+		want   string
+	}{
+		{"without simulcast", map[string]time.Time{"": active}, layerHigh, ""},
+		{"without simulcast and stale", map[string]time.Time{"": stale}, layerLow, ""},
+		{"high", map[string]time.Time{layerLow: active, layerMedium: active, layerHigh: active}, layerHigh, layerHigh},
+		{"medium", map[string]time.Time{layerLow: active, layerMedium: active, layerHigh: active}, layerMedium, layerMedium},
+		{"low", map[string]time.Time{layerLow: active, layerMedium: active, layerHigh: active}, layerLow, layerLow},
+		{"high stopped", map[string]time.Time{layerLow: active, layerMedium: active, layerHigh: stale}, layerHigh, layerMedium},
+		{"only low left", map[string]time.Time{layerLow: active, layerMedium: stale, layerHigh: stale}, layerHigh, layerLow},
+		{"medium missing", map[string]time.Time{layerLow: active, layerHigh: active}, layerMedium, layerLow},
+		{"low stopped", map[string]time.Time{layerLow: stale, layerMedium: active, layerHigh: active}, layerLow, layerMedium},
+		{"only high left", map[string]time.Time{layerLow: stale, layerMedium: stale, layerHigh: active}, layerLow, layerHigh},
+		{"nothing active", map[string]time.Time{layerLow: stale, layerHigh: stale}, layerHigh, ""},
+	}
+
+	for _, test := range tests {
+		track := &forwardedTrack{layers: make(map[string]*layer)}
+		for rid, lastPacket := range test.layers {
+			l := &layer{}
+			l.lastPacket.Store(lastPacket.UnixNano())
+			track.layers[rid] = l
+		}
+
+		if got := track.resolveLayer(test.target, now); got != test.want {
+			t.Errorf("%s: resolveLayer(%q) = %q, want %q", test.name, test.target, got, test.want)
+		}
+	}
+}
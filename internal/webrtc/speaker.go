@@ -0,0 +1,230 @@
+package webrtc
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"sync"
+	"time"
+	"webserver/internal/protocol"
+)
+
+// audioLevelURI is the RTP header extension in which clients send the level of each audio packet (RFC 6464).
+const audioLevelURI = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+
+// Audio levels are in -dBov, from 0 for the loudest to 127 for silence.
+const (
+	// speakingLevel is the smoothed level below which a peer starts speaking.
+	speakingLevel = 50
+	// silentLevel is the smoothed level above which a speaking peer stops, unless it spoke within speakingHold.
+	silentLevel = 60
+	// levelSmoothing is the weight of a new packet in the smoothed level.
+	levelSmoothing = 0.2
+	// dominantMargin is how much louder than the dominant speaker another peer has to be to take over.
+	dominantMargin = 6
+)
+
+const (
+	// speakerInterval is how often the speaking peers of a channel are evaluated.
+	speakerInterval = 200 * time.Millisecond
+	// speakingHold keeps peers speaking through short pauses and drops peers whose audio stopped arriving.
+	speakingHold = 500 * time.Millisecond
+	// largeChannelSize is the number of audio publishers from which audio of silent peers is no longer forwarded.
+	largeChannelSize = 10
+)
+
+type speakingData struct {
+	ChannelId protocol.ID `json:"channelId"`
+	UserId    protocol.ID `json:"userId"`
+	SocketId  protocol.ID `json:"socketId"`
+	Speaking  bool        `json:"speaking"`
+}
+
+type dominantSpeakerData struct {
+	ChannelId protocol.ID `json:"channelId"`
+	UserId    protocol.ID `json:"userId"`
+	SocketId  protocol.ID `json:"socketId"`
+}
+
+// speakers tracks the audio levels of the publishers of a voice channel, keyed by socket ID.
+type speakers struct {
+	mu     sync.Mutex
+	levels map[int64]*speakerLevel
+	// dominant is the socket ID of the dominant speaker, or 0 before anyone spoke.
+	dominant int64
+}
+
+type speakerLevel struct {
+	smoothed   float64
+	lastPacket time.Time
+	// lastVoice is when the last packet at speaking level arrived.
+	lastVoice time.Time
+	speaking  bool
+}
+
+// newPeerConnection creates the peer connection of a peer, with the default codecs and interceptors,
+// the audio level header extension and the extensions needed to receive simulcast.
+func newPeerConnection() (*webrtc.PeerConnection, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: audioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+	for _, uri := range simulcastExtensions {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptors); err != nil {
+		return nil, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptors))
+	return api.NewPeerConnection(webrtc.Configuration{})
+}
+
+// audioLevelExtensionId returns the ID negotiated for the audio level extension of a receiver, 0 if there is none.
+func audioLevelExtensionId(receiver *webrtc.RTPReceiver) uint8 {
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == audioLevelURI {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
+
+// audioLevel reads the level of an audio packet. ok is false if the packet doesn't carry one.
+func audioLevel(packet *rtp.Packet, extensionId uint8) (level uint8, ok bool) {
+	if extensionId == 0 {
+		return 0, false
+	}
+	payload := packet.GetExtension(extensionId)
+	if payload == nil {
+		return 0, false
+	}
+	var extension rtp.AudioLevelExtension
+	if err := extension.Unmarshal(payload); err != nil {
+		return 0, false
+	}
+	return extension.Level, true
+}
+
+// record adds the level of an audio packet of a peer. It reports whether the packet should be forwarded,
+// which in large channels is only the case while the peer speaks.
+func (s *speakers) record(socketId int64, level uint8) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	speaker, ok := s.levels[socketId]
+	if !ok {
+		speaker = &speakerLevel{smoothed: float64(level)}
+		s.levels[socketId] = speaker
+	}
+	speaker.smoothed += levelSmoothing * (float64(level) - speaker.smoothed)
+	speaker.lastPacket = now
+	if level <= speakingLevel {
+		speaker.lastVoice = now
+	}
+	return len(s.levels) < largeChannelSize || speaker.speaking || level <= speakingLevel
+}
+
+func (s *speakers) remove(socketId int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.levels, socketId)
+	if s.dominant == socketId {
+		s.dominant = 0
+	}
+}
+
+// update reevaluates who is speaking. It returns the peers that started or stopped speaking and
+// whether the dominant speaker changed. The dominant speaker stays until a louder peer takes over,
+// or it stopped speaking and someone else speaks.
+func (s *speakers) update(now time.Time) (changed map[int64]bool, dominant int64, dominantChanged bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed = make(map[int64]bool)
+	var loudest int64
+	for socketId, speaker := range s.levels {
+		var speaking bool
+		switch {
+		case now.Sub(speaker.lastPacket) > speakingHold:
+			// Muted peers, clients that stop sending during silence and peers that left.
+			// They are added again with their next packet.
+			delete(s.levels, socketId)
+		case speaker.smoothed <= speakingLevel:
+			speaking = true
+		case speaker.speaking:
+			speaking = speaker.smoothed <= silentLevel || now.Sub(speaker.lastVoice) < speakingHold
+		}
+		if speaking != speaker.speaking {
+			speaker.speaking = speaking
+			changed[socketId] = speaking
+		}
+		if speaking && (loudest == 0 || speaker.smoothed < s.levels[loudest].smoothed) {
+			loudest = socketId
+		}
+	}
+
+	if loudest == 0 || loudest == s.dominant {
+		return changed, s.dominant, false
+	}
+	if current, ok := s.levels[s.dominant]; ok && current.speaking && current.smoothed-s.levels[loudest].smoothed < dominantMargin {
+		return changed, s.dominant, false
+	}
+	s.dominant = loudest
+	return changed, s.dominant, true
+}
+
+// detectSpeakers sends the speaking and dominant-speaker events of the channel until it is closed.
+func (channel *VoiceChannel) detectSpeakers() {
+	ticker := time.NewTicker(speakerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-channel.ctx.Done():
+			return
+		case now := <-ticker.C:
+			channel.updateSpeakers(now)
+		}
+	}
+}
+
+func (channel *VoiceChannel) updateSpeakers(now time.Time) {
+	changed, dominant, dominantChanged := channel.speakers.update(now)
+	if len(changed) == 0 && !dominantChanged {
+		return
+	}
+
+	var events []protocol.Event
+	channel.mu.Lock()
+	for socketId, speaking := range changed {
+		if peer, ok := channel.peers[socketId]; ok {
+			data := speakingData{ChannelId: protocol.ID(channel.channelId), UserId: protocol.ID(peer.userId), SocketId: protocol.ID(socketId), Speaking: speaking}
+			events = append(events, protocol.Event{Type: "speaking", Data: data})
+		}
+	}
+	if peer, ok := channel.peers[dominant]; ok && dominantChanged {
+		data := dominantSpeakerData{ChannelId: protocol.ID(channel.channelId), UserId: protocol.ID(peer.userId), SocketId: protocol.ID(dominant)}
+		events = append(events, protocol.Event{Type: "dominant-speaker", Data: data})
+	}
+	peers := make([]*Peer, 0, len(channel.peers))
+	for _, peer := range channel.peers {
+		peers = append(peers, peer)
+	}
+	channel.mu.Unlock()
+
+	for _, peer := range peers {
+		for _, event := range events {
+			peer.writeMessageToWebSocket(peer, event)
+		}
+	}
+}
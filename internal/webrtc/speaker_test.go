@@ -0,0 +1,166 @@
+package webrtc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpeakersUpdate(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	// level is a peer that sent a packet just now, at a smoothed level, and last spoke voiceAgo ago.
+	level := func(smoothed float64, speaking bool, voiceAgo time.Duration) *speakerLevel {
+		return &speakerLevel{smoothed: smoothed, lastPacket: now, lastVoice: ago(voiceAgo), speaking: speaking}
+	}
+
+	tests := []struct {
+		name                string
+		levels              map[int64]*speakerLevel
+		dominant            int64
+		wantChanged         map[int64]bool
+		wantDominant        int64
+		wantDominantChanged bool
+		wantLevels          []int64
+	}{
+		{
+			name:        "nobody",
+			levels:      map[int64]*speakerLevel{},
+			wantChanged: map[int64]bool{},
+		},
+		{
+			name:                "peer starts speaking and becomes dominant",
+			levels:              map[int64]*speakerLevel{1: level(30, false, 0)},
+			wantChanged:         map[int64]bool{1: true},
+			wantDominant:        1,
+			wantDominantChanged: true,
+			wantLevels:          []int64{1},
+		},
+		{
+			name:        "quiet peer stays silent",
+			levels:      map[int64]*speakerLevel{1: level(80, false, time.Minute)},
+			wantChanged: map[int64]bool{},
+			wantLevels:  []int64{1},
+		},
+		{
+			name:         "speaking peer between the thresholds keeps speaking",
+			levels:       map[int64]*speakerLevel{1: level(55, true, time.Minute)},
+			dominant:     1,
+			wantChanged:  map[int64]bool{},
+			wantDominant: 1,
+			wantLevels:   []int64{1},
+		},
+		{
+			name:         "short pause is held",
+			levels:       map[int64]*speakerLevel{1: level(70, true, speakingHold/2)},
+			dominant:     1,
+			wantChanged:  map[int64]bool{},
+			wantDominant: 1,
+			wantLevels:   []int64{1},
+		},
+		{
+			name:         "long pause stops speaking, dominance stays",
+			levels:       map[int64]*speakerLevel{1: level(70, true, 2*speakingHold)},
+			dominant:     1,
+			wantChanged:  map[int64]bool{1: false},
+			wantDominant: 1,
+			wantLevels:   []int64{1},
+		},
+		{
+			name:         "peer without packets is dropped",
+			levels:       map[int64]*speakerLevel{1: {smoothed: 30, lastPacket: ago(2 * speakingHold), lastVoice: ago(2 * speakingHold), speaking: true}},
+			dominant:     1,
+			wantChanged:  map[int64]bool{1: false},
+			wantDominant: 1,
+		},
+		{
+			name:                "loudest new speaker becomes dominant",
+			levels:              map[int64]*speakerLevel{1: level(40, false, 0), 2: level(20, false, 0)},
+			wantChanged:         map[int64]bool{1: true, 2: true},
+			wantDominant:        2,
+			wantDominantChanged: true,
+			wantLevels:          []int64{1, 2},
+		},
+		{
+			name:         "dominant speaker keeps a slightly louder peer out",
+			levels:       map[int64]*speakerLevel{1: level(30, true, 0), 2: level(30-dominantMargin+2, true, 0)},
+			dominant:     1,
+			wantChanged:  map[int64]bool{},
+			wantDominant: 1,
+			wantLevels:   []int64{1, 2},
+		},
+		{
+			name:                "peer louder by the margin takes over",
+			levels:              map[int64]*speakerLevel{1: level(30, true, 0), 2: level(30-dominantMargin, true, 0)},
+			dominant:            1,
+			wantChanged:         map[int64]bool{},
+			wantDominant:        2,
+			wantDominantChanged: true,
+			wantLevels:          []int64{1, 2},
+		},
+		{
+			name:                "silent dominant speaker is replaced by any speaker",
+			levels:              map[int64]*speakerLevel{1: level(80, true, time.Minute), 2: level(45, false, 0)},
+			dominant:            1,
+			wantChanged:         map[int64]bool{1: false, 2: true},
+			wantDominant:        2,
+			wantDominantChanged: true,
+			wantLevels:          []int64{1, 2},
+		},
+		{
+			name:                "dropped dominant speaker is replaced",
+			levels:              map[int64]*speakerLevel{2: level(45, true, 0)},
+			dominant:            1,
+			wantChanged:         map[int64]bool{},
+			wantDominant:        2,
+			wantDominantChanged: true,
+			wantLevels:          []int64{2},
+		},
+	}
+
+	for _, test := range tests {
+		s := speakers{levels: test.levels, dominant: test.dominant}
+		changed, dominant, dominantChanged := s.update(now)
+		if !reflect.DeepEqual(changed, test.wantChanged) {
+			t.Errorf("%s: changed = %v, want %v", test.name, changed, test.wantChanged)
+		}
+		if dominant != test.wantDominant || dominantChanged != test.wantDominantChanged {
+			t.Errorf("%s: dominant = %d, %v, want %d, %v", test.name, dominant, dominantChanged, test.wantDominant, test.wantDominantChanged)
+		}
+		for _, socketId := range test.wantLevels {
+			if _, ok := s.levels[socketId]; !ok {
+				t.Errorf("%s: peer %d was dropped", test.name, socketId)
+			}
+		}
+		if len(s.levels) != len(test.wantLevels) {
+			t.Errorf("%s: %d peers are tracked, want %d", test.name, len(s.levels), len(test.wantLevels))
+		}
+	}
+}
+
+func TestSpeakersRecord(t *testing.T) {
+	tests := []struct {
+		name        string
+		others      int
+		speaking    bool
+		level       uint8
+		wantForward bool
+	}{
+		{"small channel forwards silence", 1, false, 127, true},
+		{"large channel drops silence", largeChannelSize, false, 127, false},
+		{"large channel forwards speech", largeChannelSize, false, speakingLevel, true},
+		{"large channel forwards speaking peers", largeChannelSize, true, 127, true},
+	}
+
+	for _, test := range tests {
+		s := speakers{levels: make(map[int64]*speakerLevel)}
+		for i := 0; i < test.others; i++ {
+			s.levels[int64(i+2)] = &speakerLevel{smoothed: 127}
+		}
+		s.levels[1] = &speakerLevel{smoothed: 127, speaking: test.speaking}
+
+		if forward := s.record(1, test.level); forward != test.wantForward {
+			t.Errorf("%s: record(%d) = %v, want %v", test.name, test.level, forward, test.wantForward)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package webrtc
+
+import (
+	"errors"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+	"webserver/internal/websocket"
+)
+
+// VoiceState is the state of a connection to a voice channel. It is pushed over /wss as
+// voice-state-update whenever it changes; ChannelId is null once the connection left.
+type VoiceState struct {
+	UserId     protocol.ID  `json:"userId"`
+	ServerId   protocol.ID  `json:"serverId"`
+	ChannelId  *protocol.ID `json:"channelId"`
+	SocketId   protocol.ID  `json:"socketId"`
+	SelfMute   bool         `json:"selfMute"`
+	SelfDeaf   bool         `json:"selfDeaf"`
+	ServerMute bool         `json:"serverMute"`
+	ServerDeaf bool         `json:"serverDeaf"`
+	Streaming  bool         `json:"streaming"`
+	Video      bool         `json:"video"`
+}
+
+// ServerVoiceFields are set on a member by moderators and stay in effect when the member reconnects.
+// Omitted fields are left unchanged.
+type ServerVoiceFields struct {
+	ServerMute *bool `json:"serverMute"`
+	ServerDeaf *bool `json:"serverDeaf"`
+}
+
+// voiceFlags are the voice state of a peer, set by its client and by moderators.
+type voiceFlags struct {
+	selfMute   bool
+	selfDeaf   bool
+	serverMute bool
+	serverDeaf bool
+	streaming  bool
+	video      bool
+}
+
+// setVoice replaces the voice state of the peer. The channel of the peer must be locked.
+func (peer *Peer) setVoice(voice voiceFlags) {
+	peer.voice = voice
+	peer.muted.Store(voice.selfMute || voice.serverMute)
+	peer.deafened.Store(voice.selfDeaf || voice.serverDeaf)
+}
+
+// voiceState returns the voice state of a peer of the channel. The channel must be locked.
+func (channel *VoiceChannel) voiceState(peer *Peer) VoiceState {
+	channelId := protocol.ID(channel.channelId)
+	return VoiceState{
+		UserId:     protocol.ID(peer.userId),
+		ServerId:   protocol.ID(channel.serverId),
+		ChannelId:  &channelId,
+		SocketId:   protocol.ID(peer.connectionId),
+		SelfMute:   peer.voice.selfMute,
+		SelfDeaf:   peer.voice.selfDeaf,
+		ServerMute: peer.voice.serverMute,
+		ServerDeaf: peer.voice.serverDeaf,
+		Streaming:  peer.voice.streaming,
+		Video:      peer.voice.video,
+	}
+}
+
+// VoiceStates returns the voice states of everyone connected to a voice channel of the server
+// the user may view.
+func VoiceStates(userId int64, serverId int64) ([]VoiceState, error) {
+	db := config.UseDBPool().DB
+	if _, err := permissions.ServerPermissions(db, serverId, userId); err != nil {
+		return nil, err
+	}
+
+	states := []VoiceState{}
+	for _, channel := range serverChannels(serverId) {
+		channelPermissions, _, err := permissions.ChannelPermissions(db, channel.channelId, userId)
+		if errors.Is(err, permissions.ErrChannelNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !channelPermissions.Has(permissions.ViewChannel) {
+			continue
+		}
+
+		channel.mu.Lock()
+		for _, peer := range channel.peers {
+			states = append(states, channel.voiceState(peer))
+		}
+		channel.mu.Unlock()
+	}
+	return states, nil
+}
+
+// UpdateServerVoiceState server mutes or deafens a member. It is applied to the voice connections
+// the member has open right away and to later ones when they are made.
+func UpdateServerVoiceState(moderatorId int64, serverId int64, userId int64, fields ServerVoiceFields) error {
+	var required permissions.Permission
+	if fields.ServerMute != nil {
+		required |= permissions.MuteMembers
+	}
+	if fields.ServerDeaf != nil {
+		required |= permissions.DeafenMembers
+	}
+	db := config.UseDBPool().DB
+	if err := permissions.CheckServerPermission(db, serverId, moderatorId, required); err != nil {
+		return err
+	}
+
+	result, err := db.Exec("UPDATE server_members SET server_mute = COALESCE(?, server_mute), server_deaf = COALESCE(?, server_deaf) WHERE server_id = ? AND user_id = ?",
+		fields.ServerMute, fields.ServerDeaf, serverId, userId)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return websocket.ErrUserNotFound
+	}
+
+	for _, channel := range serverChannels(serverId) {
+		var states []VoiceState
+		channel.mu.Lock()
+		for _, peer := range channel.peers {
+			if peer.userId != userId {
+				continue
+			}
+			voice := peer.voice
+			if fields.ServerMute != nil {
+				voice.serverMute = *fields.ServerMute
+			}
+			if fields.ServerDeaf != nil {
+				voice.serverDeaf = *fields.ServerDeaf
+			}
+			peer.setVoice(voice)
+			states = append(states, channel.voiceState(peer))
+		}
+		channel.mu.Unlock()
+
+		for _, state := range states {
+			publishVoiceState(channel, state)
+		}
+	}
+	return nil
+}
+
+// setSelfVoiceState updates the parts of the voice state of a peer that its client controls.
+func setSelfVoiceState(channelId int64, socketId int64, update protocol.VoiceStateUpdate) error {
+	channel, err := lookupChannel(channelId, socketId)
+	if err != nil {
+		return err
+	}
+	peer, err := lookupPeer(channelId, socketId)
+	if err != nil {
+		return err
+	}
+	if update.Video || update.Streaming {
+		if _, err := permissions.CheckChannelPermission(config.UseDBPool().DB, channelId, peer.userId, permissions.Video); err != nil {
+			return err
+		}
+	}
+
+	channel.mu.Lock()
+	voice := peer.voice
+	voice.selfMute = update.SelfMute
+	voice.selfDeaf = update.SelfDeaf
+	voice.streaming = update.Streaming
+	voice.video = update.Video
+	peer.setVoice(voice)
+	state := channel.voiceState(peer)
+	channel.mu.Unlock()
+
+	publishVoiceState(channel, state)
+	return nil
+}
+
+// serverChannels returns the voice channels of a server that have peers.
+func serverChannels(serverId int64) []*VoiceChannel {
+	channels.Lock()
+	defer channels.Unlock()
+
+	var result []*VoiceChannel
+	for _, channel := range channels.byId {
+		if channel.serverId == serverId {
+			result = append(result, channel)
+		}
+	}
+	return result
+}
+
+// publishVoiceState sends a voice-state-update about a peer of the channel to everyone who may view it,
+// or to the recipients of a DM or group DM call.
+func publishVoiceState(channel *VoiceChannel, state VoiceState) {
+	websocket.BroadcastToChannelViewers(channel.serverId, channel.channelId, "voice-state-update", state)
+}
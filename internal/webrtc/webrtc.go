@@ -1,107 +1,182 @@
 package webrtc
 
 import (
-	"github.com/gorilla/websocket"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
+	"io"
 	"log"
-	//"net/http"
 	"strconv"
 	"sync"
-	"webserver/internal/helper"
+	"sync/atomic"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
 )
 
+// ErrPeerNotFound is returned for requests about a voice channel the connection has not joined.
+var ErrPeerNotFound = errors.New("not connected to this voice channel")
+
+// keyframeInterval is how often publishers of video are asked for a keyframe, so subscribers
+// that were added in between can start decoding.
+const keyframeInterval = 3 * time.Second
+
 type VoiceChannel struct {
 	channelId int64
-	peers     map[int64]*Peer
-	mu        sync.Mutex
+	// serverId is 0 for DMs and group DMs.
+	serverId int64
+	peers    map[int64]*Peer
+	// tracks are the tracks published in the channel, keyed by their ID.
+	tracks   map[string]*forwardedTrack
+	speakers speakers
+	// ctx is cancelled when the last peer left the channel.
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+// forwardedTrack is a track received from a publisher, forwarded to every other peer of the channel.
+type forwardedTrack struct {
+	id        string
+	streamId  string
+	kind      webrtc.RTPCodecType
+	codec     webrtc.RTPCodecCapability
+	socketId  int64
+	userId    int64
+	publisher *Peer
+	// layers are the simulcast layers the publisher sends, keyed by RID.
+	layers map[string]*layer
+	// subscribers are the tracks the packets are written to, one for every peer the track was added to,
+	// keyed by socket ID. Each peer has its own, so forwarding can be stopped or switched to another
+	// layer for single peers.
+	subscribers map[int64]*subscription
+	mu          sync.RWMutex
 }
 
 type Peer struct {
-	writeMessageToWebSocket func(peer *Peer, data webSocketResponse) error
+	writeMessageToWebSocket func(peer *Peer, data protocol.Event) error
 	connectionId            int64
-	ws                      *websocket.Conn
-	mu                      sync.Mutex
-	AudioTrack              *webrtc.TrackLocalStaticRTP
-	VideoTrack              *webrtc.TrackLocalStaticRTP
+	userId                  int64
+	conn                    *conn
 	peerConnection          *webrtc.PeerConnection
-	peerDetails             struct {
+	// ctx is cancelled when the peer leaves, which stops the goroutines working for it.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// renegotiate is set when the tracks of the peer changed while it was negotiating,
+	// so it is sent a new offer once the negotiation completes.
+	renegotiate bool
+	// senders are the tracks of the other publishers sent to the peer, keyed by track ID.
+	senders map[string]*webrtc.RTPSender
+	voice   voiceFlags
+	// muted and deafened are read for every forwarded packet, so they are kept apart from voice.
+	muted       atomic.Bool
+	deafened    atomic.Bool
+	peerDetails struct {
 		name    string
 		isAdmin bool
 	}
 }
 
-var channels = make(map[int64]*VoiceChannel)
-
-func writeMessageToWebSocket(peer *Peer, data webSocketResponse) error {
-	log.Print(&peer.mu)
+// channels holds the voice channels with at least one peer. It is locked before the channel
+// itself when both are needed.
+var channels = struct {
+	sync.Mutex
+	byId map[int64]*VoiceChannel
+}{byId: make(map[int64]*VoiceChannel)}
 
-	peer.mu.Lock()
-	err := peer.ws.WriteJSON(data)
-	peer.mu.Unlock()
-	if err != nil {
+func writeMessageToWebSocket(peer *Peer, data protocol.Event) error {
+	if err := peer.conn.writeJSON(data); err != nil {
 		log.Print("Error writing message to websocket:", err)
 		return err
 	}
 	return nil
 }
 
-func joinChannel(request webSocketRequest, ws *websocket.Conn) error {
-	channelId, _ := strconv.ParseInt(request.Data["channelId"].(string), 10, 64)
-	socketId, _ := strconv.ParseInt(request.Data["socketId"].(string), 10, 64)
+func joinChannel(channelId int64, socketId int64, conn *conn, userId int64) error {
+	db := config.UseDBPool().DB
+	serverId, err := permissions.CheckChannelPermission(db, channelId, userId, permissions.ViewChannel|permissions.Connect)
+	if err != nil {
+		return err
+	}
+
+	var voice voiceFlags
+	if serverId != 0 {
+		err := db.QueryRow("SELECT server_mute, server_deaf FROM server_members WHERE server_id = ? AND user_id = ?", serverId, userId).Scan(&voice.serverMute, &voice.serverDeaf)
+		if err != nil {
+			return err
+		}
+	}
+
+	peerConnection, err := newPeerConnection()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	peer := &Peer{writeMessageToWebSocket: writeMessageToWebSocket, conn: conn, peerConnection: peerConnection, connectionId: socketId, userId: userId, ctx: ctx, cancel: cancel, senders: make(map[string]*webrtc.RTPSender)}
+	peer.setVoice(voice)
 
-	channel, ok := channels[channelId]
+	channels.Lock()
+	channel, ok := channels.byId[channelId]
 	if !ok {
 		channel = &VoiceChannel{
 			channelId: channelId,
+			serverId:  serverId,
 			peers:     make(map[int64]*Peer),
+			tracks:    make(map[string]*forwardedTrack),
+			speakers:  speakers{levels: make(map[int64]*speakerLevel)},
 		}
-
-	} else {
-		channel = channels[channelId]
+		channel.ctx, channel.cancel = context.WithCancel(context.Background())
+		channels.byId[channelId] = channel
+		go channel.detectSpeakers()
 	}
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		return err
+	channel.mu.Lock()
+	_, joined := channel.peers[socketId]
+	if !joined {
+		channel.peers[socketId] = peer
+	}
+	state := channel.voiceState(peer)
+	channel.mu.Unlock()
+	channels.Unlock()
+
+	if joined {
+		cancel()
+		peerConnection.Close()
+		return fmt.Errorf("%w: already connected to this voice channel", protocol.ErrInvalidPayload)
 	}
 
 	iceCandidateChan := make(chan webrtc.ICECandidateInit)
 	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate != nil {
-			iceCandidateChan <- webrtc.ICECandidateInit{
-				Candidate:     candidate.ToJSON().Candidate,
-				SDPMid:        candidate.ToJSON().SDPMid,
-				SDPMLineIndex: candidate.ToJSON().SDPMLineIndex,
+			select {
+			case iceCandidateChan <- candidate.ToJSON():
+			case <-ctx.Done():
 			}
 		}
 	})
 
-	audioCodecs := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "maxaveragebitrate=3072000"}
-	audioTrack, err := webrtc.NewTrackLocalStaticRTP(audioCodecs, strconv.Itoa(int(socketId))+"audio-RTP", "audio")
-	if err != nil {
-		return err
-	}
-
-	videoCodecs := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
-	videoTrack, err := webrtc.NewTrackLocalStaticRTP(videoCodecs, strconv.Itoa(int(socketId))+"video-RTP", "video")
-	if err != nil {
-		return err
-	}
-
-	channel.mu.Lock()
-	channel.peers[socketId] = &Peer{writeMessageToWebSocket: writeMessageToWebSocket, ws: ws, peerConnection: peerConnection, connectionId: socketId, AudioTrack: audioTrack, VideoTrack: videoTrack}
-	channels[channelId] = channel
-	channel.mu.Unlock()
-
-	peerConnection.OnTrack(handleOnTrack(channel.peers[socketId], channelId))
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateDisconnected {
+			log.Println("Peer", socketId, "in voice channel", channelId, "is", state.String()+", removing it")
+			// Callbacks of the peer connection must not block on its Close
+			go channel.removePeer(socketId)
+		}
+	})
 
-	// rethink design pattern
+	peerConnection.OnTrack(handleOnTrack(peer, channel))
+	publishVoiceState(channel, state)
 
 	go func() {
 		for {
 			select {
 			case iceCandidate := <-iceCandidateChan:
-
-				channel.peers[socketId].writeMessageToWebSocket(channel.peers[socketId], webSocketResponse{Type: "ice-candidate", Data: map[string]interface{}{"candidate": iceCandidate}})
+				peer.writeMessageToWebSocket(peer, protocol.Event{Type: "ice-candidate", Data: iceCandidateData{Candidate: iceCandidate}})
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -109,38 +184,21 @@ func joinChannel(request webSocketRequest, ws *websocket.Conn) error {
 	return nil
 }
 
-func processOffer(request webSocketRequest) (webrtc.SessionDescription, error) {
-	channelId, _ := strconv.ParseInt(request.Data["channelId"].(string), 10, 64)
-	socketId, _ := strconv.ParseInt(request.Data["socketId"].(string), 10, 64)
-	var offer webrtc.SessionDescription
-	offerSDP := request.Data["offer"].(map[string]interface{})
-	offer.SDP = offerSDP["sdp"].(string)
-	sdpTypeStr := offerSDP["type"].(string)
-	offerType, err := helper.MapStringToSDPType(sdpTypeStr)
-	offer.Type = offerType
-	peer := channels[channelId].peers[socketId]
+// processOffer answers an offer of the client and then sends it the tracks of the other peers, which
+// are added in a renegotiation started by the server.
+func processOffer(channelId int64, socketId int64, offer webrtc.SessionDescription) error {
+	channel, err := lookupChannel(channelId, socketId)
 	if err != nil {
-		//channels[channelId].peers[socketId].writeMessageToWebSocket(channels[channelId].peers[socketId], webSocketError{Status: http.StatusBadRequest, StatusText: "Invalid request, SDP type is invalid"})
-
-		return webrtc.SessionDescription{}, err
-	}
-
-	peerConnection := channels[channelId].peers[socketId].peerConnection
-	if err := peerConnection.SetRemoteDescription(offer); err != nil {
-		return webrtc.SessionDescription{}, err
+		return err
 	}
-
-	audioTrack := peer.AudioTrack
-	videoTrack := peer.VideoTrack
-
-	_, err = peerConnection.AddTrack(audioTrack)
+	peer, err := lookupPeer(channelId, socketId)
 	if err != nil {
-		return webrtc.SessionDescription{}, err
+		return err
 	}
 
-	_, err = peerConnection.AddTrack(videoTrack)
-	if err != nil {
-		return webrtc.SessionDescription{}, err
+	peerConnection := peer.peerConnection
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return fmt.Errorf("%w: %v", protocol.ErrInvalidPayload, err)
 	}
 
 	answer, err := peerConnection.CreateAnswer(&webrtc.AnswerOptions{
@@ -149,71 +207,418 @@ func processOffer(request webSocketRequest) (webrtc.SessionDescription, error) {
 		},
 	})
 	if err != nil {
-		return webrtc.SessionDescription{}, err
+		return err
 	}
 
 	if err := peerConnection.SetLocalDescription(answer); err != nil {
-		return webrtc.SessionDescription{}, err
+		return err
 	}
 
-	return answer, nil
+	if err := peer.writeMessageToWebSocket(peer, protocol.Event{Type: "answer", Data: answerData{Answer: answer}}); err != nil {
+		return err
+	}
+	channel.signalPeers()
+	return nil
 }
 
-func handleICECandidate(request webSocketRequest, ws *websocket.Conn) error {
-	channelId, _ := strconv.ParseInt(request.Data["channelId"].(string), 10, 64)
-	socketId, _ := strconv.ParseInt(request.Data["socketId"].(string), 10, 64)
-	iceCandidateInit := request.Data["candidate"].(map[string]interface{})
-	candidate := iceCandidateInit["candidate"].(string)
-	sdpMid := iceCandidateInit["sdpMid"].(string)
-	sdpMLineIndex := uint16(iceCandidateInit["sdpMLineIndex"].(float64))
-
-	iceCandidate := webrtc.ICECandidateInit{
-		Candidate:     candidate,
-		SDPMid:        &sdpMid,
-		SDPMLineIndex: &sdpMLineIndex,
+// processAnswer completes a renegotiation started by the server.
+func processAnswer(channelId int64, socketId int64, answer webrtc.SessionDescription) error {
+	channel, err := lookupChannel(channelId, socketId)
+	if err != nil {
+		return err
+	}
+	peer, err := lookupPeer(channelId, socketId)
+	if err != nil {
+		return err
 	}
 
-	channels[channelId].mu.Lock()
-	peer := channels[channelId].peers[socketId]
-	err := peer.peerConnection.AddICECandidate(iceCandidate)
-	channels[channelId].mu.Unlock()
+	if err := peer.peerConnection.SetRemoteDescription(answer); err != nil {
+		return fmt.Errorf("%w: %v", protocol.ErrInvalidPayload, err)
+	}
+	channel.signalPeers()
+	return nil
+}
 
+func handleICECandidate(channelId int64, socketId int64, candidate webrtc.ICECandidateInit) error {
+	peer, err := lookupPeer(channelId, socketId)
 	if err != nil {
 		return err
 	}
+
+	if err := peer.peerConnection.AddICECandidate(candidate); err != nil {
+		return fmt.Errorf("%w: %v", protocol.ErrInvalidPayload, err)
+	}
 	return nil
 }
 
-func handleOnTrack(peer *Peer, channelId int64) func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+// lookupChannel returns the voice channel if the connection with the given socket ID has joined it.
+func lookupChannel(channelId int64, socketId int64) (*VoiceChannel, error) {
+	channels.Lock()
+	channel, ok := channels.byId[channelId]
+	channels.Unlock()
+	if !ok {
+		return nil, ErrPeerNotFound
+	}
+
+	channel.mu.Lock()
+	_, joined := channel.peers[socketId]
+	channel.mu.Unlock()
+	if !joined {
+		return nil, ErrPeerNotFound
+	}
+	return channel, nil
+}
+
+func lookupPeer(channelId int64, socketId int64) (*Peer, error) {
+	channel, err := lookupChannel(channelId, socketId)
+	if err != nil {
+		return nil, err
+	}
+
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	peer, ok := channel.peers[socketId]
+	if !ok {
+		return nil, ErrPeerNotFound
+	}
+	return peer, nil
+}
+
+// removePeer removes a peer and the tracks it published from the channel, closes its peer connection
+// and renegotiates with the others. The channel is dropped once its last peer left. Removing a peer
+// that already left does nothing.
+func (channel *VoiceChannel) removePeer(socketId int64) {
+	channels.Lock()
+	channel.mu.Lock()
+	peer, ok := channel.peers[socketId]
+	var state VoiceState
+	if ok {
+		delete(channel.peers, socketId)
+		for trackId, track := range channel.tracks {
+			if track.socketId == socketId {
+				delete(channel.tracks, trackId)
+				continue
+			}
+			track.mu.Lock()
+			delete(track.subscribers, socketId)
+			track.mu.Unlock()
+		}
+		state = channel.voiceState(peer)
+		state.ChannelId = nil
+	}
+	empty := len(channel.peers) == 0
+	if empty && channels.byId[channel.channelId] == channel {
+		delete(channels.byId, channel.channelId)
+		channel.cancel()
+	}
+	channel.mu.Unlock()
+	channels.Unlock()
+
+	if !ok {
+		return
+	}
+	channel.speakers.remove(socketId)
+	peer.cancel()
+	if err := peer.peerConnection.Close(); err != nil {
+		log.Println("Error closing peer connection:", err)
+	}
+	publishVoiceState(channel, state)
+	if !empty {
+		channel.signalPeers()
+	}
+}
+
+// leaveAllChannels removes the peers of the connection with the given socket ID from every voice channel.
+func leaveAllChannels(socketId int64) {
+	channels.Lock()
+	var joined []*VoiceChannel
+	for _, channel := range channels.byId {
+		channel.mu.Lock()
+		if _, ok := channel.peers[socketId]; ok {
+			joined = append(joined, channel)
+		}
+		channel.mu.Unlock()
+	}
+	channels.Unlock()
+
+	for _, channel := range joined {
+		channel.removePeer(socketId)
+	}
+}
+
+// signalPeers brings the tracks sent to every peer in line with the tracks published in the channel.
+// Peers whose tracks changed are sent the new track-map and an offer to renegotiate.
+func (channel *VoiceChannel) signalPeers() {
+	type signal struct {
+		peer   *Peer
+		events []protocol.Event
+	}
+	var signals []signal
+
+	channel.mu.Lock()
+	for _, peer := range channel.peers {
+		events, err := channel.syncPeer(peer)
+		if err != nil {
+			log.Println("Error renegotiating with peer", peer.connectionId, "in voice channel", channel.channelId, ":", err)
+			continue
+		}
+		if len(events) > 0 {
+			signals = append(signals, signal{peer: peer, events: events})
+		}
+	}
+	channel.mu.Unlock()
+
+	// Messages are sent without holding the channel, so a slow client can't block the others.
+	// A peer has no other offer in flight until it answers this one, so they can't be overtaken.
+	for _, s := range signals {
+		for _, event := range s.events {
+			if err := s.peer.writeMessageToWebSocket(s.peer, event); err != nil {
+				break
+			}
+		}
+	}
+}
+
+// syncPeer adds the tracks of the other publishers to a peer and removes those that are gone.
+// It returns the messages to send to the peer, if any. The channel must be locked.
+func (channel *VoiceChannel) syncPeer(peer *Peer) ([]protocol.Event, error) {
+	peerConnection := peer.peerConnection
+	if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return nil, nil
+	}
+	// The client starts the first negotiation, tracks are only added to peers that went through it
+	if peerConnection.CurrentRemoteDescription() == nil {
+		return nil, nil
+	}
+	// During a negotiation the tracks can't change, so the peer is synced once it completes
+	if peerConnection.SignalingState() != webrtc.SignalingStateStable {
+		peer.renegotiate = true
+		return nil, nil
+	}
+
+	changed := peer.renegotiate
+	for trackId, sender := range peer.senders {
+		if _, ok := channel.tracks[trackId]; ok {
+			continue
+		}
+		if err := peerConnection.RemoveTrack(sender); err != nil {
+			return nil, err
+		}
+		delete(peer.senders, trackId)
+		changed = true
+	}
+
+	for trackId, track := range channel.tracks {
+		if _, ok := peer.senders[trackId]; ok || track.socketId == peer.connectionId {
+			continue
+		}
+		localTrack, err := webrtc.NewTrackLocalStaticRTP(track.codec, track.id, track.streamId)
+		if err != nil {
+			return nil, err
+		}
+		sender, err := peerConnection.AddTrack(localTrack)
+		if err != nil {
+			return nil, err
+		}
+		go readRTCP(sender)
+		peer.senders[trackId] = sender
+		track.mu.Lock()
+		track.subscribers[peer.connectionId] = &subscription{local: localTrack, peer: peer, target: layerHigh, rewriter: sequenceRewriter{clockRate: track.codec.ClockRate}}
+		track.mu.Unlock()
+		changed = true
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	peer.renegotiate = false
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := peerConnection.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+
+	// The track-map goes first, so clients know whose tracks they receive once the offer is applied
+	return []protocol.Event{
+		{Type: "track-map", Data: channel.trackMap(peer.connectionId)},
+		{Type: "offer", Data: offerData{ChannelId: protocol.ID(channel.channelId), Offer: offer}},
+	}, nil
+}
+
+// trackMap returns the tracks of the channel the peer with the given socket ID receives. The channel must be locked.
+func (channel *VoiceChannel) trackMap(socketId int64) trackMapData {
+	data := trackMapData{ChannelId: protocol.ID(channel.channelId), Tracks: []trackMapping{}}
+	for trackId, track := range channel.tracks {
+		if track.socketId == socketId {
+			continue
+		}
+		data.Tracks = append(data.Tracks, trackMapping{
+			TrackId:  trackId,
+			StreamId: track.streamId,
+			Kind:     track.kind.String(),
+			UserId:   protocol.ID(track.userId),
+			SocketId: protocol.ID(track.socketId),
+		})
+	}
+	return data
+}
+
+// readRTCP reads the RTCP packets subscribers send for a track, which is needed for the interceptors
+// (NACK, receiver reports) to process them.
+func readRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func handleOnTrack(peer *Peer, channel *VoiceChannel) func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 	return func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		if track.Kind() == webrtc.RTPCodecTypeAudio {
 			log.Println("Received audio track:", track.ID())
 		} else if track.Kind() == webrtc.RTPCodecTypeVideo {
 			log.Println("Received video track:", track.ID())
 		}
+
+		// Track IDs are chosen by the clients, so they are prefixed with the socket ID to keep them apart.
+		// The stream ID identifies the publisher, so the audio and video of a peer can be synchronized.
+		// With simulcast, this is called for every layer of the track and the layers share the forwarded track.
+		trackId := strconv.FormatInt(peer.connectionId, 10) + "-" + track.ID()
+		rid := track.RID()
+
+		channel.mu.Lock()
+		if channel.peers[peer.connectionId] != peer {
+			// The peer left before its track arrived
+			channel.mu.Unlock()
+			return
+		}
+		forwarded, ok := channel.tracks[trackId]
+		if !ok {
+			forwarded = &forwardedTrack{
+				id:          trackId,
+				streamId:    strconv.FormatInt(peer.connectionId, 10),
+				kind:        track.Kind(),
+				codec:       track.Codec().RTPCodecCapability,
+				socketId:    peer.connectionId,
+				userId:      peer.userId,
+				publisher:   peer,
+				layers:      make(map[string]*layer),
+				subscribers: make(map[int64]*subscription),
+			}
+			channel.tracks[trackId] = forwarded
+		}
+		added := forwarded.addLayer(rid, uint32(track.SSRC()))
+		channel.mu.Unlock()
+		if !added {
+			log.Println("Received layer", rid, "of track", track.ID(), "twice")
+			return
+		}
+		if !ok {
+			channel.signalPeers()
+		}
+
+		audioLevelId := audioLevelExtensionId(receiver)
+		done := make(chan struct{})
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			go requestKeyframes(peer.ctx, peer.peerConnection, track, done)
+		}
+
 		go func() {
+			defer func() {
+				close(done)
+				if forwarded.removeLayer(rid) > 0 {
+					return
+				}
+				channel.mu.Lock()
+				if channel.tracks[trackId] == forwarded {
+					delete(channel.tracks, trackId)
+				}
+				channel.mu.Unlock()
+				channel.signalPeers()
+			}()
+
 			for {
 				rtpPacket, _, err := track.ReadRTP()
 				if err != nil {
-					log.Println("Error reading RTP packet:", err)
-					break
+					if !errors.Is(err, io.EOF) {
+						log.Println("Error reading RTP packet:", err)
+					}
+					return
 				}
 
-				// Forward the RTP packet to other peers in the same channel
-				for _, otherPeer := range channels[channelId].peers {
-					if otherPeer.connectionId != peer.connectionId {
-						if track.Kind() == webrtc.RTPCodecTypeAudio {
-							err = otherPeer.AudioTrack.WriteRTP(rtpPacket)
-						} else if track.Kind() == webrtc.RTPCodecTypeVideo {
-							err = otherPeer.VideoTrack.WriteRTP(rtpPacket)
-						}
-
-						if err != nil {
-							log.Println("Error forwarding RTP packet:", err)
-						}
+				if forwarded.kind == webrtc.RTPCodecTypeAudio {
+					// Audio of muted peers is dropped here, whether or not their client still sends it
+					if peer.muted.Load() {
+						continue
+					}
+					if level, ok := audioLevel(rtpPacket, audioLevelId); ok && !channel.speakers.record(peer.connectionId, level) {
+						continue
 					}
 				}
+				forwarded.forward(rid, rtpPacket)
 			}
 		}()
 	}
 }
+
+// forward writes an RTP packet of a layer to the subscribers of the track that receive that layer.
+// Deafened peers get no audio.
+func (track *forwardedTrack) forward(rid string, packet *rtp.Packet) {
+	track.mu.RLock()
+	defer track.mu.RUnlock()
+
+	now := time.Now()
+	if l, ok := track.layers[rid]; ok {
+		l.lastPacket.Store(now.UnixNano())
+	}
+	keyframe := track.kind == webrtc.RTPCodecTypeVideo && isKeyframe(track.codec, packet)
+
+	for _, sub := range track.subscribers {
+		if track.kind == webrtc.RTPCodecTypeAudio && sub.peer.deafened.Load() {
+			continue
+		}
+
+		sub.mu.Lock()
+		if sub.layer != rid {
+			// Switching is only possible at a keyframe, decoders can't continue another layer otherwise
+			if !keyframe || rid != track.resolveLayer(sub.target, now) {
+				sub.mu.Unlock()
+				continue
+			}
+			sub.layer = rid
+			sub.rewriter.resync = true
+		}
+		out := sub.rewriter.rewrite(packet)
+		sub.mu.Unlock()
+
+		if err := sub.local.WriteRTP(&out); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Println("Error forwarding RTP packet:", err)
+		}
+	}
+}
+
+// requestKeyframes periodically sends the publisher of a video track a picture loss indication,
+// until done is closed or the publisher leaves.
+func requestKeyframes(ctx context.Context, peerConnection *webrtc.PeerConnection, track *webrtc.TrackRemote, done <-chan struct{}) {
+	ticker := time.NewTicker(keyframeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+			if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				log.Println("Error requesting keyframe:", err)
+			}
+		}
+	}
+}
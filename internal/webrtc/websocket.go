@@ -1,26 +1,73 @@
 package webrtc
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"io"
 	"log"
 	"net/http"
-	"strconv"
+	"sync"
+	"time"
+	"webserver/internal/auth"
 	"webserver/internal/helper"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
 )
 
-type webSocketResponse struct {
-	Type string                 `json:"type"`
-	Data map[string]interface{} `json:"data"`
+// closeSessionRevoked is sent as close code when the auth session of a connection has been revoked.
+const closeSessionRevoked = 4001
+
+// writeWait is how long a write may block before the connection is considered dead.
+const writeWait = 10 * time.Second
+
+type connectionData struct {
+	ProtocolVersion int         `json:"protocolVersion"`
+	SocketId        protocol.ID `json:"socketId"`
+}
+
+type answerData struct {
+	Answer webrtc.SessionDescription `json:"answer"`
+}
+
+// offerData is sent when the server renegotiates the tracks of a peer, the client replies with an answer request.
+type offerData struct {
+	ChannelId protocol.ID               `json:"channelId"`
+	Offer     webrtc.SessionDescription `json:"offer"`
+}
+
+// trackMapData tells a client which user each of the tracks it receives belongs to.
+type trackMapData struct {
+	ChannelId protocol.ID    `json:"channelId"`
+	Tracks    []trackMapping `json:"tracks"`
+}
+
+type trackMapping struct {
+	TrackId  string      `json:"trackId"`
+	StreamId string      `json:"streamId"`
+	Kind     string      `json:"kind"`
+	UserId   protocol.ID `json:"userId"`
+	SocketId protocol.ID `json:"socketId"`
 }
 
-type webSocketRequest struct {
-	Type string                 `json:"type"`
-	Data map[string]interface{} `json:"data"`
+type iceCandidateData struct {
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
 }
 
-type webSocketError struct {
-	Status     int16  `json:"status"`
-	StatusText string `json:"statusText"`
+// conn is a /webrtc socket. Writes are made from the request loop and from the goroutines of its peers,
+// so they are serialized.
+type conn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *conn) writeJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteJSON(v)
 }
 
 var upgrader = websocket.Upgrader{
@@ -34,7 +81,24 @@ var upgrader = websocket.Upgrader{
 func HandleWebSocketConnections(w http.ResponseWriter, r *http.Request) {
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	if err := protocol.CheckVersion(r.URL.Query().Get("v")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, subprotocol := auth.TokenFromWebSocketRequest(r)
+	claims, err := auth.Authenticate(token)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var responseHeader http.Header
+	if subprotocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+	}
+
+	ws, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Println(err)
 		return
@@ -43,62 +107,204 @@ func HandleWebSocketConnections(w http.ResponseWriter, r *http.Request) {
 	socketId := helper.GenerateUniqueId()
 	log.Println("Client Connected")
 
-	err = ws.WriteJSON(webSocketResponse{Type: "connection-success", Data: map[string]interface{}{"socketId": strconv.FormatInt(socketId, 10)}})
+	err = ws.WriteJSON(protocol.Event{Type: "connection-success", Data: connectionData{ProtocolVersion: protocol.Version, SocketId: protocol.ID(socketId)}})
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	go handleWebSocket(ws, socketId)
+	trackConnection(claims.SessionID, ws)
+	go func() {
+		defer untrackConnection(claims.SessionID, ws)
+		defer leaveAllChannels(socketId)
+		handleWebSocket(&conn{ws: ws}, socketId, claims.UserID)
+	}()
+}
+
+// connections indexes the open /webrtc sockets by the auth session they were opened with.
+var connections = struct {
+	sync.Mutex
+	bySession map[string]map[*websocket.Conn]bool
+}{bySession: make(map[string]map[*websocket.Conn]bool)}
+
+func trackConnection(sessionId string, ws *websocket.Conn) {
+	connections.Lock()
+	defer connections.Unlock()
+
+	if connections.bySession[sessionId] == nil {
+		connections.bySession[sessionId] = make(map[*websocket.Conn]bool)
+	}
+	connections.bySession[sessionId][ws] = true
+}
+
+func untrackConnection(sessionId string, ws *websocket.Conn) {
+	connections.Lock()
+	defer connections.Unlock()
+
+	delete(connections.bySession[sessionId], ws)
+	if len(connections.bySession[sessionId]) == 0 {
+		delete(connections.bySession, sessionId)
+	}
+}
+
+// CloseSession closes every /webrtc socket that was opened with the given auth session.
+func CloseSession(sessionId string) {
+	connections.Lock()
+	var targets []*websocket.Conn
+	for ws := range connections.bySession[sessionId] {
+		targets = append(targets, ws)
+	}
+	connections.Unlock()
+
+	for _, ws := range targets {
+		err := ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeSessionRevoked, "session revoked"), time.Now().Add(time.Second))
+		if err != nil {
+			log.Println("Error writing close message to websocket:", err)
+		}
+		ws.Close()
+	}
 }
 
-func handleWebSocket(ws *websocket.Conn, socketId int64) {
+func handleWebSocket(c *conn, socketId int64, userId int64) {
 	log.Println("handleWebSocket")
 	for {
-		var request webSocketRequest
-		err := ws.ReadJSON(&request)
+		var request protocol.Request
+		err := c.ws.ReadJSON(&request)
 		if err != nil {
-			log.Println(err, request)
-			ws.WriteJSON(webSocketError{Status: http.StatusBadRequest, StatusText: "Invalid request, make sure data is an object"})
+			var syntaxError *json.SyntaxError
+			var typeError *json.UnmarshalTypeError
+			if errors.As(err, &syntaxError) || errors.As(err, &typeError) || errors.Is(err, io.ErrUnexpectedEOF) {
+				c.writeJSON(protocol.NewError("", http.StatusBadRequest, "Invalid request, make sure it is an object with a type and data"))
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err)
+			}
 			return
 		}
 
-		log.Println("REQUEST:", request)
+		log.Println("REQUEST:", request.Type)
 
-		switch request.Type {
-		case "joinChannel":
-			err := joinChannel(request, ws)
-			if err != nil {
-				log.Fatalln(err)
-				return
+		data, err := handleRequest(c, socketId, userId, request)
+		if err != nil {
+			status := requestErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Println("Error handling", request.Type+":", err)
+				c.writeJSON(protocol.NewError(request.Nonce, status, "Error handling "+request.Type+": the request could not be processed"))
+				continue
 			}
-			ws.WriteJSON(webSocketResponse{Type: "joinedChannel"})
+			c.writeJSON(protocol.NewError(request.Nonce, status, "Error handling "+request.Type+": "+err.Error()))
+			continue
+		}
+		if request.Nonce != "" {
+			c.writeJSON(protocol.NewAck(request.Nonce, data))
+		}
+	}
+}
 
-		case "offer":
-			answer, err := processOffer(request)
-			if err != nil {
-				log.Fatalln(err)
-				return
-			}
-			ws.WriteJSON(webSocketResponse{Type: "answer", Data: map[string]interface{}{"answer": answer}})
-		case "ice-candidate":
-			err := handleICECandidate(request, ws)
-			if err != nil {
-				log.Fatalln("Error adding ICE candidate", err)
-				return
-			}
-		case "disconnect":
-			handleDisconnect(request)
+// handleRequest runs a request of the connection with the given socket ID. The returned data is sent back in the ack.
+func handleRequest(c *conn, socketId int64, userId int64, request protocol.Request) (interface{}, error) {
+	switch request.Type {
+	case "joinChannel":
+		data, err := protocol.Decode[protocol.JoinChannel](request)
+		if err != nil {
+			return nil, err
 		}
+		if err := requireOwnSocket(data.VoiceTarget, socketId); err != nil {
+			return nil, err
+		}
+		if err := joinChannel(int64(data.ChannelId), socketId, c, userId); err != nil {
+			return nil, err
+		}
+		c.writeJSON(protocol.Event{Type: "joinedChannel"})
+		return nil, nil
+	case "offer":
+		data, err := protocol.Decode[protocol.Offer](request)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireOwnSocket(data.VoiceTarget, socketId); err != nil {
+			return nil, err
+		}
+		return nil, processOffer(int64(data.ChannelId), socketId, data.Offer)
+	case "answer":
+		data, err := protocol.Decode[protocol.Answer](request)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireOwnSocket(data.VoiceTarget, socketId); err != nil {
+			return nil, err
+		}
+		return nil, processAnswer(int64(data.ChannelId), socketId, data.Answer)
+	case "ice-candidate":
+		data, err := protocol.Decode[protocol.ICECandidate](request)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireOwnSocket(data.VoiceTarget, socketId); err != nil {
+			return nil, err
+		}
+		return nil, handleICECandidate(int64(data.ChannelId), socketId, data.Candidate)
+	case "voice-state":
+		data, err := protocol.Decode[protocol.VoiceStateUpdate](request)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireOwnSocket(data.VoiceTarget, socketId); err != nil {
+			return nil, err
+		}
+		return nil, setSelfVoiceState(int64(data.ChannelId), socketId, data)
+	case "set-layer":
+		data, err := protocol.Decode[protocol.SetLayer](request)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireOwnSocket(data.VoiceTarget, socketId); err != nil {
+			return nil, err
+		}
+		return nil, setLayer(int64(data.ChannelId), socketId, data.TrackId, data.Layer)
+	case "disconnect":
+		data, err := protocol.Decode[protocol.Disconnect](request)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireOwnSocket(data.VoiceTarget, socketId); err != nil {
+			return nil, err
+		}
+		return nil, handleDisconnect(int64(data.ChannelId), socketId)
+	default:
+		return nil, fmt.Errorf("%w: %q", protocol.ErrUnknownRequest, request.Type)
+	}
+}
 
+// requireOwnSocket makes sure a request only targets the connection it was sent over.
+func requireOwnSocket(target protocol.VoiceTarget, socketId int64) error {
+	if int64(target.SocketId) != socketId {
+		return fmt.Errorf("%w: socketId does not belong to this connection", protocol.ErrInvalidPayload)
 	}
+	return nil
 }
 
-func handleDisconnect(request webSocketRequest) {
-	channelId, _ := strconv.ParseInt(request.Data["channelId"].(string), 10, 64)
-	socketId, _ := strconv.ParseInt(request.Data["socketId"].(string), 10, 64)
+// requestErrorStatus maps the error of a request to a status code.
+func requestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, permissions.ErrNotMember), errors.Is(err, permissions.ErrMissingPermission):
+		return http.StatusForbidden
+	case errors.Is(err, permissions.ErrChannelNotFound), errors.Is(err, ErrPeerNotFound), errors.Is(err, ErrTrackNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, protocol.ErrInvalidPayload), errors.Is(err, protocol.ErrUnknownRequest):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func handleDisconnect(channelId int64, socketId int64) error {
+	channel, err := lookupChannel(channelId, socketId)
+	if err != nil {
+		return err
+	}
 
-	channels[channelId].mu.Lock()
-	delete(channels[channelId].peers, socketId)
-	channels[channelId].mu.Unlock()
+	channel.removePeer(socketId)
+	return nil
 }
@@ -0,0 +1,326 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/helper"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+const (
+	ChannelTypeText     = 1
+	ChannelTypeVoice    = 2
+	ChannelTypeCategory = 3
+	ChannelTypeThread   = 6
+)
+
+var ErrInvalidChannel = errors.New("invalid channel")
+
+type Channel struct {
+	Id        string    `json:"id"`
+	ServerId  string    `json:"serverId"`
+	Type      uint8     `json:"type"`
+	Name      string    `json:"name"`
+	ParentId  *string   `json:"parentId"`
+	Position  int       `json:"position"`
+	Topic     string    `json:"topic"`
+	Nsfw      bool      `json:"nsfw"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ChannelFields holds the fields to set on a channel; nil fields are left untouched.
+// An empty ParentId moves the channel out of its category.
+type ChannelFields struct {
+	Type     *uint8  `json:"type"`
+	Name     *string `json:"name"`
+	ParentId *string `json:"parentId"`
+	Position *int    `json:"position"`
+	Topic    *string `json:"topic"`
+	Nsfw     *bool   `json:"nsfw"`
+}
+
+type ChannelPosition struct {
+	ChannelId string  `json:"channelId"`
+	Position  int     `json:"position"`
+	ParentId  *string `json:"parentId"`
+}
+
+const channelColumns = "SELECT channel_id, server_id, type, channel_name, parent_id, position, COALESCE(topic, ''), nsfw, created_at FROM channels"
+
+// CreateChannel creates a channel on behalf of a member with the manage channels permission.
+// Channels created inside a category inherit its permission overwrites.
+func CreateChannel(userId int64, serverId int64, fields ChannelFields) (channel Channel, err error) {
+	if fields.Type == nil {
+		fields.Type = new(uint8)
+		*fields.Type = ChannelTypeText
+	}
+	if *fields.Type != ChannelTypeText && *fields.Type != ChannelTypeVoice && *fields.Type != ChannelTypeCategory {
+		return Channel{}, fmt.Errorf("%w: unknown channel type %d", ErrInvalidChannel, *fields.Type)
+	}
+	if fields.Name == nil {
+		return Channel{}, fmt.Errorf("%w: a name is required", ErrInvalidChannel)
+	}
+
+	channelId := helper.GenerateUniqueId()
+	err = config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if err := permissions.CheckServerPermission(tx, serverId, userId, permissions.ManageChannels); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec("INSERT INTO channels (channel_id, server_id, type, channel_name, position) VALUES (?, ?, ?, '', (SELECT COALESCE(MAX(position), -1) + 1 FROM channels WHERE server_id = ?))",
+			channelId, serverId, *fields.Type, serverId)
+		if err != nil {
+			return err
+		}
+
+		channel, err = applyChannelFields(tx, serverId, channelId, *fields.Type, fields)
+		if err != nil {
+			return err
+		}
+
+		if channel.ParentId != nil {
+			_, err = tx.Exec(`INSERT INTO channel_overwrites (channel_id, target_id, target_type, allow, deny)
+				SELECT ?, target_id, target_type, allow, deny FROM channel_overwrites WHERE channel_id = ?`, channelId, *channel.ParentId)
+		}
+		return err
+	})
+	if err != nil {
+		return Channel{}, err
+	}
+
+	hub.broadcastToChannelViewers(serverId, channelId, protocol.Event{Type: "channel-created", Data: channel})
+	return channel, nil
+}
+
+// UpdateChannel changes the name, topic, NSFW flag, category or position of a channel.
+func UpdateChannel(userId int64, channelId int64, fields ChannelFields) (channel Channel, err error) {
+	if fields.Type != nil {
+		return Channel{}, fmt.Errorf("%w: the type of a channel cannot be changed", ErrInvalidChannel)
+	}
+
+	var serverId int64
+	err = config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		serverId, err = permissions.CheckChannelPermission(tx, channelId, userId, permissions.ManageChannels)
+		if err != nil {
+			return err
+		}
+
+		current, err := scanChannel(tx.QueryRow(channelColumns+" WHERE channel_id = ?", channelId))
+		if err != nil {
+			return err
+		}
+		if current.Type == ChannelTypeThread {
+			return fmt.Errorf("%w: threads are updated through PATCH /api/threads/{threadId}", ErrInvalidChannel)
+		}
+
+		channel, err = applyChannelFields(tx, serverId, channelId, current.Type, fields)
+		return err
+	})
+	if err != nil {
+		return Channel{}, err
+	}
+
+	hub.broadcastToChannelViewers(serverId, channelId, protocol.Event{Type: "channel-updated", Data: channel})
+	return channel, nil
+}
+
+// DeleteChannel deletes a channel with its messages, overwrites and threads.
+// Channels inside a deleted category are moved out of it.
+func DeleteChannel(userId int64, channelId int64) error {
+	var channel Channel
+	var viewers []*client
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		serverId, err := permissions.CheckChannelPermission(tx, channelId, userId, permissions.ManageChannels)
+		if err != nil {
+			return err
+		}
+		channel, err = scanChannel(tx.QueryRow(channelColumns+" WHERE channel_id = ?", channelId))
+		if err != nil {
+			return err
+		}
+		// Viewers are resolved while the channel and its overwrites still exist
+		viewers = hub.channelViewers(tx, serverId, channelId)
+
+		threadIds, err := channelThreadIds(tx, channelId)
+		if err != nil {
+			return err
+		}
+		for _, id := range append(threadIds, channelId) {
+			if err := deleteChannelRows(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	writeToClients(viewers, protocol.Event{Type: "channel-deleted", Data: channel})
+	return nil
+}
+
+func deleteChannelRows(tx *sql.Tx, channelId int64) error {
+	for _, query := range []string{
+		"UPDATE channels SET parent_id = NULL WHERE parent_id = ?",
+		"DELETE FROM message_edits WHERE message_id IN (SELECT message_id FROM messages WHERE channel_id = ?)",
+		"DELETE FROM message_reactions WHERE message_id IN (SELECT message_id FROM messages WHERE channel_id = ?)",
+		"DELETE FROM message_mentions WHERE message_id IN (SELECT message_id FROM messages WHERE channel_id = ?)",
+		"DELETE FROM messages WHERE channel_id = ?",
+		"DELETE FROM read_states WHERE channel_id = ?",
+		"DELETE FROM channel_overwrites WHERE channel_id = ?",
+		"DELETE FROM thread_members WHERE thread_id = ?",
+		"DELETE FROM threads WHERE thread_id = ?",
+		"DELETE FROM channels WHERE channel_id = ?",
+	} {
+		if _, err := tx.Exec(query, channelId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReorderChannels moves several channels of a server at once, optionally into another category.
+func ReorderChannels(userId int64, serverId int64, positions []ChannelPosition) ([]Channel, error) {
+	var channels []Channel
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if err := permissions.CheckServerPermission(tx, serverId, userId, permissions.ManageChannels); err != nil {
+			return err
+		}
+
+		for _, position := range positions {
+			channelId, err := strconv.ParseInt(position.ChannelId, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: invalid channel ID %q", ErrInvalidChannel, position.ChannelId)
+			}
+			current, err := scanChannel(tx.QueryRow(channelColumns+" WHERE channel_id = ? AND server_id = ?", channelId, serverId))
+			if err != nil {
+				return err
+			}
+			if current.Type == ChannelTypeThread {
+				return fmt.Errorf("%w: threads cannot be reordered", ErrInvalidChannel)
+			}
+
+			pos := position.Position
+			channel, err := applyChannelFields(tx, serverId, channelId, current.Type, ChannelFields{Position: &pos, ParentId: position.ParentId})
+			if err != nil {
+				return err
+			}
+			channels = append(channels, channel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, channel := range channels {
+		channelId, _ := strconv.ParseInt(channel.Id, 10, 64)
+		hub.broadcastToChannelViewers(serverId, channelId, protocol.Event{Type: "channel-updated", Data: channel})
+	}
+	return channels, nil
+}
+
+// saveNewChannel handles the new-channel event, the socket equivalent of POST /api/{serverId}/channels.
+// The new channel is sent back in the ack.
+func saveNewChannel(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.NewChannel](request)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := ChannelFields{Type: data.Type, Name: data.Name, ParentId: data.ParentId, Position: data.Position, Topic: data.Topic, Nsfw: data.Nsfw}
+	return CreateChannel(c.userId, int64(data.ServerId), fields)
+}
+
+func applyChannelFields(tx *sql.Tx, serverId int64, channelId int64, channelType uint8, fields ChannelFields) (Channel, error) {
+	if fields.Name != nil {
+		if len(*fields.Name) == 0 || len(*fields.Name) > 100 {
+			return Channel{}, fmt.Errorf("%w: the name must be between 1 and 100 characters", ErrInvalidChannel)
+		}
+		if _, err := tx.Exec("UPDATE channels SET channel_name = ? WHERE channel_id = ?", *fields.Name, channelId); err != nil {
+			return Channel{}, err
+		}
+	}
+
+	if fields.Topic != nil {
+		if len(*fields.Topic) > 1024 {
+			return Channel{}, fmt.Errorf("%w: the topic must not exceed 1024 characters", ErrInvalidChannel)
+		}
+		if _, err := tx.Exec("UPDATE channels SET topic = ? WHERE channel_id = ?", *fields.Topic, channelId); err != nil {
+			return Channel{}, err
+		}
+	}
+
+	if fields.Nsfw != nil {
+		if _, err := tx.Exec("UPDATE channels SET nsfw = ? WHERE channel_id = ?", *fields.Nsfw, channelId); err != nil {
+			return Channel{}, err
+		}
+	}
+
+	if fields.ParentId != nil {
+		var parentId sql.NullInt64
+		if *fields.ParentId != "" {
+			id, err := strconv.ParseInt(*fields.ParentId, 10, 64)
+			if err != nil {
+				return Channel{}, fmt.Errorf("%w: invalid parent ID", ErrInvalidChannel)
+			}
+			if channelType == ChannelTypeCategory {
+				return Channel{}, fmt.Errorf("%w: categories cannot be nested", ErrInvalidChannel)
+			}
+
+			var isCategory bool
+			err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM channels WHERE channel_id = ? AND server_id = ? AND type = ?)", id, serverId, ChannelTypeCategory).Scan(&isCategory)
+			if err != nil {
+				return Channel{}, err
+			}
+			if !isCategory {
+				return Channel{}, fmt.Errorf("%w: the parent must be a category of the same server", ErrInvalidChannel)
+			}
+			parentId = sql.NullInt64{Int64: id, Valid: true}
+		}
+		if _, err := tx.Exec("UPDATE channels SET parent_id = ? WHERE channel_id = ?", parentId, channelId); err != nil {
+			return Channel{}, err
+		}
+	}
+
+	if fields.Position != nil {
+		if *fields.Position < 0 {
+			return Channel{}, fmt.Errorf("%w: the position must not be negative", ErrInvalidChannel)
+		}
+		if _, err := tx.Exec("UPDATE channels SET position = ? WHERE channel_id = ?", *fields.Position, channelId); err != nil {
+			return Channel{}, err
+		}
+	}
+
+	return scanChannel(tx.QueryRow(channelColumns+" WHERE channel_id = ?", channelId))
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanChannel(row rowScanner) (Channel, error) {
+	var channel Channel
+	var channelId, serverId int64
+	var parentId sql.NullInt64
+	err := row.Scan(&channelId, &serverId, &channel.Type, &channel.Name, &parentId, &channel.Position, &channel.Topic, &channel.Nsfw, &channel.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Channel{}, permissions.ErrChannelNotFound
+	} else if err != nil {
+		return Channel{}, err
+	}
+
+	channel.Id = strconv.FormatInt(channelId, 10)
+	channel.ServerId = strconv.FormatInt(serverId, 10)
+	if parentId.Valid {
+		id := strconv.FormatInt(parentId.Int64, 10)
+		channel.ParentId = &id
+	}
+	return channel, nil
+}
@@ -0,0 +1,436 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/helper"
+	"webserver/internal/permissions"
+)
+
+const (
+	ChannelTypeDm      = 4
+	ChannelTypeGroupDm = 5
+
+	// maxGroupDmRecipients includes the owner.
+	maxGroupDmRecipients = 10
+)
+
+var ErrInvalidRecipient = errors.New("invalid recipient")
+
+// PrivateChannel is a DM between two users or a group DM, which has no server.
+type PrivateChannel struct {
+	Id         string      `json:"id"`
+	Type       uint8       `json:"type"`
+	Name       string      `json:"name"`
+	IconUrl    string      `json:"iconUrl"`
+	OwnerId    *string     `json:"ownerId"`
+	Recipients []Recipient `json:"recipients"`
+	CreatedAt  time.Time   `json:"createdAt"`
+}
+
+type Recipient struct {
+	UserId      string `json:"userId"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Img         string `json:"img"`
+}
+
+type privateChannelRemoved struct {
+	ChannelId string `json:"channelId"`
+}
+
+const privateChannelColumns = "SELECT c.channel_id, c.type, c.channel_name, COALESCE(c.icon_url, ''), c.owner_id, c.created_at FROM channels c"
+
+// ListPrivateChannels returns the DMs and group DMs of a user, most recently active first.
+func ListPrivateChannels(userId int64) ([]PrivateChannel, error) {
+	channels := []PrivateChannel{}
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(privateChannelColumns+` JOIN channel_recipients r ON r.channel_id = c.channel_id
+			WHERE r.user_id = ? AND c.server_id IS NULL
+			ORDER BY COALESCE((SELECT MAX(m.sent_at) FROM messages m WHERE m.channel_id = c.channel_id), c.created_at) DESC, c.channel_id DESC`, userId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		index := make(map[string]int)
+		for rows.Next() {
+			channel, err := scanPrivateChannel(rows)
+			if err != nil {
+				return err
+			}
+			index[channel.Id] = len(channels)
+			channels = append(channels, channel)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		recipients, err := tx.Query(`SELECT r.channel_id, u.user_id, u.username, COALESCE(u.display_name, ''), COALESCE(u.img_url, '')
+			FROM channel_recipients r JOIN users u ON u.user_id = r.user_id
+			WHERE r.channel_id IN (SELECT channel_id FROM channel_recipients WHERE user_id = ?)
+			ORDER BY r.added_at, u.user_id`, userId)
+		if err != nil {
+			return err
+		}
+		defer recipients.Close()
+
+		for recipients.Next() {
+			var channelId int64
+			recipient, err := scanRecipient(recipients, &channelId)
+			if err != nil {
+				return err
+			}
+			if i, ok := index[strconv.FormatInt(channelId, 10)]; ok {
+				channels[i].Recipients = append(channels[i].Recipients, recipient)
+			}
+		}
+		return recipients.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+// CreatePrivateChannel opens a DM with a single recipient, returning the existing one if there is one,
+// or creates a group DM owned by the user for several recipients. Users can only start conversations
+// with users they share a server with. The returned bool reports whether a new channel was created.
+func CreatePrivateChannel(userId int64, recipientIds []int64, name string) (PrivateChannel, bool, error) {
+	recipients := make([]int64, 0, len(recipientIds))
+	seen := map[int64]bool{userId: true}
+	for _, recipientId := range recipientIds {
+		if !seen[recipientId] {
+			seen[recipientId] = true
+			recipients = append(recipients, recipientId)
+		}
+	}
+	if len(recipients) == 0 {
+		return PrivateChannel{}, false, fmt.Errorf("%w: at least one other user is required", ErrInvalidRecipient)
+	}
+	if len(recipients)+1 > maxGroupDmRecipients {
+		return PrivateChannel{}, false, fmt.Errorf("%w: a group DM can have at most %d recipients", ErrInvalidRecipient, maxGroupDmRecipients)
+	}
+	if len(name) > 100 {
+		return PrivateChannel{}, false, fmt.Errorf("%w: the name must not exceed 100 characters", ErrInvalidChannel)
+	}
+
+	var channel PrivateChannel
+	created := false
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		for _, recipientId := range recipients {
+			if err := requireSharedServer(tx, userId, recipientId); err != nil {
+				return err
+			}
+		}
+
+		var channelId int64
+		if len(recipients) == 1 {
+			err := tx.QueryRow(`SELECT c.channel_id FROM channels c
+				JOIN channel_recipients a ON a.channel_id = c.channel_id AND a.user_id = ?
+				JOIN channel_recipients b ON b.channel_id = c.channel_id AND b.user_id = ?
+				WHERE c.type = ?`, userId, recipients[0], ChannelTypeDm).Scan(&channelId)
+			if err == nil {
+				channel, err = loadPrivateChannel(tx, channelId)
+				return err
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+
+			channelId = helper.GenerateUniqueId()
+			_, err = tx.Exec("INSERT INTO channels (channel_id, type, channel_name) VALUES (?, ?, '')", channelId, ChannelTypeDm)
+			if err != nil {
+				return err
+			}
+		} else {
+			channelId = helper.GenerateUniqueId()
+			_, err := tx.Exec("INSERT INTO channels (channel_id, type, channel_name, owner_id) VALUES (?, ?, ?, ?)", channelId, ChannelTypeGroupDm, name, userId)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, recipientId := range append([]int64{userId}, recipients...) {
+			if _, err := tx.Exec("INSERT INTO channel_recipients (channel_id, user_id) VALUES (?, ?)", channelId, recipientId); err != nil {
+				return err
+			}
+		}
+
+		created = true
+		var err error
+		channel, err = loadPrivateChannel(tx, channelId)
+		return err
+	})
+	if err != nil {
+		return PrivateChannel{}, false, err
+	}
+
+	if created {
+		sendToRecipients(channel, "dm-created", channel)
+	}
+	return channel, created, nil
+}
+
+// UpdateGroupDm renames a group DM or changes its icon. Every recipient may do so; nil fields are left untouched.
+func UpdateGroupDm(userId int64, channelId int64, name *string, iconUrl *string) (PrivateChannel, error) {
+	if name != nil && len(*name) > 100 {
+		return PrivateChannel{}, fmt.Errorf("%w: the name must not exceed 100 characters", ErrInvalidChannel)
+	}
+
+	var channel PrivateChannel
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if err := requireGroupDmRecipient(tx, channelId, userId); err != nil {
+			return err
+		}
+		if name != nil {
+			if _, err := tx.Exec("UPDATE channels SET channel_name = ? WHERE channel_id = ?", *name, channelId); err != nil {
+				return err
+			}
+		}
+		if iconUrl != nil {
+			if _, err := tx.Exec("UPDATE channels SET icon_url = ? WHERE channel_id = ?", *iconUrl, channelId); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		channel, err = loadPrivateChannel(tx, channelId)
+		return err
+	})
+	if err != nil {
+		return PrivateChannel{}, err
+	}
+
+	sendToRecipients(channel, "dm-updated", channel)
+	return channel, nil
+}
+
+// AddRecipient adds a user the actor shares a server with to a group DM the actor is part of.
+func AddRecipient(userId int64, channelId int64, recipientId int64) (PrivateChannel, error) {
+	var channel PrivateChannel
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if err := requireGroupDmRecipient(tx, channelId, userId); err != nil {
+			return err
+		}
+		if err := requireSharedServer(tx, userId, recipientId); err != nil {
+			return err
+		}
+
+		var count int
+		var alreadyAdded bool
+		err := tx.QueryRow("SELECT COUNT(*), COALESCE(SUM(user_id = ?), 0) > 0 FROM channel_recipients WHERE channel_id = ?", recipientId, channelId).Scan(&count, &alreadyAdded)
+		if err != nil {
+			return err
+		}
+		if alreadyAdded {
+			return fmt.Errorf("%w: the user is already a recipient", ErrInvalidRecipient)
+		}
+		if count >= maxGroupDmRecipients {
+			return fmt.Errorf("%w: a group DM can have at most %d recipients", ErrInvalidRecipient, maxGroupDmRecipients)
+		}
+
+		if _, err := tx.Exec("INSERT INTO channel_recipients (channel_id, user_id) VALUES (?, ?)", channelId, recipientId); err != nil {
+			return err
+		}
+
+		channel, err = loadPrivateChannel(tx, channelId)
+		return err
+	})
+	if err != nil {
+		return PrivateChannel{}, err
+	}
+
+	recipientIdStr := strconv.FormatInt(recipientId, 10)
+	for _, recipient := range channel.Recipients {
+		recipientUserId, _ := strconv.ParseInt(recipient.UserId, 10, 64)
+		if recipient.UserId == recipientIdStr {
+			SendToUser(recipientUserId, "dm-created", channel)
+		} else {
+			SendToUser(recipientUserId, "dm-updated", channel)
+		}
+	}
+	return channel, nil
+}
+
+// RemoveRecipient removes a user from a group DM. The owner can remove anyone, every other
+// recipient can only remove themselves. When the owner leaves, the longest-standing recipient
+// becomes the new owner; a group DM without recipients is deleted with its messages.
+func RemoveRecipient(userId int64, channelId int64, recipientId int64) error {
+	var channel PrivateChannel
+	var remaining int
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if err := requireGroupDmRecipient(tx, channelId, userId); err != nil {
+			return err
+		}
+
+		var ownerId sql.NullInt64
+		if err := tx.QueryRow("SELECT owner_id FROM channels WHERE channel_id = ?", channelId).Scan(&ownerId); err != nil {
+			return err
+		}
+		if recipientId != userId && ownerId.Int64 != userId {
+			return fmt.Errorf("%w: only the owner can remove other recipients", permissions.ErrMissingPermission)
+		}
+
+		res, err := tx.Exec("DELETE FROM channel_recipients WHERE channel_id = ? AND user_id = ?", channelId, recipientId)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return fmt.Errorf("%w: the user is not a recipient", ErrInvalidRecipient)
+		}
+		if _, err := tx.Exec("DELETE FROM read_states WHERE channel_id = ? AND user_id = ?", channelId, recipientId); err != nil {
+			return err
+		}
+
+		if err := tx.QueryRow("SELECT COUNT(*) FROM channel_recipients WHERE channel_id = ?", channelId).Scan(&remaining); err != nil {
+			return err
+		}
+		if remaining == 0 {
+			for _, query := range []string{
+				"DELETE FROM message_edits WHERE message_id IN (SELECT message_id FROM messages WHERE channel_id = ?)",
+				"DELETE FROM message_reactions WHERE message_id IN (SELECT message_id FROM messages WHERE channel_id = ?)",
+				"DELETE FROM message_mentions WHERE message_id IN (SELECT message_id FROM messages WHERE channel_id = ?)",
+				"DELETE FROM messages WHERE channel_id = ?",
+				"DELETE FROM read_states WHERE channel_id = ?",
+				"DELETE FROM channels WHERE channel_id = ?",
+			} {
+				if _, err := tx.Exec(query, channelId); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if ownerId.Int64 == recipientId {
+			_, err = tx.Exec(`UPDATE channels SET owner_id = (SELECT user_id FROM channel_recipients WHERE channel_id = ? ORDER BY added_at, user_id LIMIT 1)
+				WHERE channel_id = ?`, channelId, channelId)
+			if err != nil {
+				return err
+			}
+		}
+
+		channel, err = loadPrivateChannel(tx, channelId)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	SendToUser(recipientId, "dm-removed", privateChannelRemoved{ChannelId: strconv.FormatInt(channelId, 10)})
+	if remaining > 0 {
+		sendToRecipients(channel, "dm-updated", channel)
+	}
+	return nil
+}
+
+func requireSharedServer(tx *sql.Tx, userId int64, otherUserId int64) error {
+	var shared bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM server_members a JOIN server_members b ON a.server_id = b.server_id
+		WHERE a.user_id = ? AND b.user_id = ?)`, userId, otherUserId).Scan(&shared)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		return fmt.Errorf("%w: you can only message users you share a server with", permissions.ErrMissingPermission)
+	}
+	return nil
+}
+
+func requireGroupDmRecipient(tx *sql.Tx, channelId int64, userId int64) error {
+	var channelType sql.NullInt64
+	err := tx.QueryRow("SELECT type FROM channels WHERE channel_id = ? AND server_id IS NULL", channelId).Scan(&channelType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return permissions.ErrChannelNotFound
+	} else if err != nil {
+		return err
+	}
+	if channelType.Int64 != ChannelTypeGroupDm {
+		return fmt.Errorf("%w: only group DMs can be changed", ErrInvalidChannel)
+	}
+
+	_, err = permissions.CheckChannelPermission(tx, channelId, userId, permissions.ViewChannel)
+	return err
+}
+
+func loadPrivateChannel(tx *sql.Tx, channelId int64) (PrivateChannel, error) {
+	channel, err := scanPrivateChannel(tx.QueryRow(privateChannelColumns+" WHERE c.channel_id = ? AND c.server_id IS NULL", channelId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return PrivateChannel{}, permissions.ErrChannelNotFound
+	} else if err != nil {
+		return PrivateChannel{}, err
+	}
+
+	rows, err := tx.Query(`SELECT r.channel_id, u.user_id, u.username, COALESCE(u.display_name, ''), COALESCE(u.img_url, '')
+		FROM channel_recipients r JOIN users u ON u.user_id = r.user_id
+		WHERE r.channel_id = ? ORDER BY r.added_at, u.user_id`, channelId)
+	if err != nil {
+		return PrivateChannel{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		recipient, err := scanRecipient(rows, new(int64))
+		if err != nil {
+			return PrivateChannel{}, err
+		}
+		channel.Recipients = append(channel.Recipients, recipient)
+	}
+	return channel, rows.Err()
+}
+
+func scanPrivateChannel(row rowScanner) (PrivateChannel, error) {
+	var channel PrivateChannel
+	var channelId int64
+	var ownerId sql.NullInt64
+	err := row.Scan(&channelId, &channel.Type, &channel.Name, &channel.IconUrl, &ownerId, &channel.CreatedAt)
+	if err != nil {
+		return PrivateChannel{}, err
+	}
+
+	channel.Id = strconv.FormatInt(channelId, 10)
+	channel.Recipients = []Recipient{}
+	if ownerId.Valid {
+		id := strconv.FormatInt(ownerId.Int64, 10)
+		channel.OwnerId = &id
+	}
+	return channel, nil
+}
+
+func scanRecipient(row rowScanner, channelId *int64) (Recipient, error) {
+	var recipient Recipient
+	var userId int64
+	err := row.Scan(channelId, &userId, &recipient.Username, &recipient.DisplayName, &recipient.Img)
+	recipient.UserId = strconv.FormatInt(userId, 10)
+	return recipient, err
+}
+
+func sendToRecipients(channel PrivateChannel, eventType string, data interface{}) {
+	for _, recipient := range channel.Recipients {
+		userId, _ := strconv.ParseInt(recipient.UserId, 10, 64)
+		SendToUser(userId, eventType, data)
+	}
+}
+
+func channelRecipientIds(q permissions.Querier, channelId int64) ([]int64, error) {
+	rows, err := q.Query("SELECT user_id FROM channel_recipients WHERE channel_id = ?", channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIds []int64
+	for rows.Next() {
+		var userId int64
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+	return userIds, rows.Err()
+}
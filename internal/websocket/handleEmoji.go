@@ -0,0 +1,210 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+// maxServerEmojis is how many custom emoji a server can have.
+const maxServerEmojis = 50
+
+var ErrEmojiNotFound = errors.New("emoji not found")
+
+var (
+	emojiNamePattern = regexp.MustCompile(`^\w{2,32}$`)
+	// emojiTokenPattern matches custom emoji in message text: <:name:id>, or <a:name:id> if animated.
+	emojiTokenPattern = regexp.MustCompile(`<a?:\w{2,32}:(-?\d+)>`)
+)
+
+// CustomEmoji is an emoji uploaded to a server.
+type CustomEmoji struct {
+	Id       string `json:"id"`
+	ServerId string `json:"serverId"`
+	Name     string `json:"name"`
+	Url      string `json:"url"`
+	Animated bool   `json:"animated"`
+}
+
+type emojiDeleteData struct {
+	Id       string `json:"id"`
+	ServerId string `json:"serverId"`
+}
+
+const emojiColumns = "SELECT emoji_id, server_id, name, img_url, animated FROM emojis"
+
+// ListEmojis returns the custom emoji of a server to its members, ordered by name.
+func ListEmojis(userId int64, serverId int64) ([]CustomEmoji, error) {
+	emojis := []CustomEmoji{}
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if err := permissions.CheckServerPermission(tx, serverId, userId, 0); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(emojiColumns+" WHERE server_id = ? ORDER BY name", serverId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			emoji, err := scanEmoji(rows)
+			if err != nil {
+				return err
+			}
+			emojis = append(emojis, emoji)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return emojis, nil
+}
+
+// ValidateEmojiName checks the name of a custom emoji: 2 to 32 letters, digits or underscores.
+func ValidateEmojiName(name string) error {
+	if !emojiNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: the name must be 2 to 32 letters, digits or underscores", ErrInvalidEmoji)
+	}
+	return nil
+}
+
+// CreateEmoji adds a custom emoji whose image has already been stored at url.
+// Names are unique per server and a server has at most maxServerEmojis emoji.
+func CreateEmoji(userId int64, serverId int64, emojiId int64, name string, url string, animated bool) (CustomEmoji, error) {
+	if err := ValidateEmojiName(name); err != nil {
+		return CustomEmoji{}, err
+	}
+
+	var emoji CustomEmoji
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if err := permissions.CheckServerPermission(tx, serverId, userId, permissions.ManageEmojis); err != nil {
+			return err
+		}
+
+		var count int
+		var taken bool
+		err := tx.QueryRow("SELECT COUNT(*), COALESCE(MAX(name = ?), false) FROM emojis WHERE server_id = ?", name, serverId).Scan(&count, &taken)
+		if err != nil {
+			return err
+		}
+		if count >= maxServerEmojis {
+			return fmt.Errorf("%w: a server can have at most %d emoji", ErrInvalidEmoji, maxServerEmojis)
+		}
+		if taken {
+			return fmt.Errorf("%w: the name %q is already taken", ErrInvalidEmoji, name)
+		}
+
+		_, err = tx.Exec("INSERT INTO emojis (emoji_id, server_id, name, img_url, animated, user_id) VALUES (?, ?, ?, ?, ?, ?)",
+			emojiId, serverId, name, url, animated, userId)
+		if err != nil {
+			return err
+		}
+
+		emoji, err = scanEmoji(tx.QueryRow(emojiColumns+" WHERE emoji_id = ?", emojiId))
+		return err
+	})
+	if err != nil {
+		return CustomEmoji{}, err
+	}
+
+	hub.broadcastToServer(serverId, protocol.Event{Type: "emoji-created", Data: emoji})
+	return emoji, nil
+}
+
+// DeleteEmoji removes a custom emoji and every reaction with it. The deleted emoji is returned
+// so its image can be removed.
+func DeleteEmoji(userId int64, serverId int64, emojiId int64) (CustomEmoji, error) {
+	var emoji CustomEmoji
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if err := permissions.CheckServerPermission(tx, serverId, userId, permissions.ManageEmojis); err != nil {
+			return err
+		}
+
+		var err error
+		emoji, err = scanEmoji(tx.QueryRow(emojiColumns+" WHERE emoji_id = ? AND server_id = ?", emojiId, serverId))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrEmojiNotFound
+		} else if err != nil {
+			return err
+		}
+
+		for _, query := range []string{
+			"DELETE FROM message_reactions WHERE emoji_id = ?",
+			"DELETE FROM emojis WHERE emoji_id = ?",
+		} {
+			if _, err := tx.Exec(query, emojiId); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return CustomEmoji{}, err
+	}
+
+	data := emojiDeleteData{Id: emoji.Id, ServerId: emoji.ServerId}
+	hub.broadcastToServer(serverId, protocol.Event{Type: "emoji-deleted", Data: data})
+	return emoji, nil
+}
+
+// ParseEmojiTokens returns the IDs of the custom emoji used in a message text, without duplicates.
+func ParseEmojiTokens(text string) []int64 {
+	var emojiIds []int64
+	seen := make(map[int64]bool)
+	for _, match := range emojiTokenPattern.FindAllStringSubmatch(text, -1) {
+		emojiId, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || seen[emojiId] {
+			continue
+		}
+		seen[emojiId] = true
+		emojiIds = append(emojiIds, emojiId)
+	}
+	return emojiIds
+}
+
+// ResolveEmojis looks up custom emoji by ID, keyed by ID. Unknown IDs are left out.
+func ResolveEmojis(q permissions.Querier, emojiIds []int64) (map[int64]CustomEmoji, error) {
+	emojis := make(map[int64]CustomEmoji)
+	if len(emojiIds) == 0 {
+		return emojis, nil
+	}
+
+	args := make([]interface{}, len(emojiIds))
+	for i, emojiId := range emojiIds {
+		args[i] = emojiId
+	}
+	rows, err := q.Query(emojiColumns+" WHERE emoji_id IN (?"+strings.Repeat(", ?", len(emojiIds)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		emoji, err := scanEmoji(rows)
+		if err != nil {
+			return nil, err
+		}
+		emojiId, _ := strconv.ParseInt(emoji.Id, 10, 64)
+		emojis[emojiId] = emoji
+	}
+	return emojis, rows.Err()
+}
+
+func scanEmoji(row rowScanner) (CustomEmoji, error) {
+	var emoji CustomEmoji
+	var emojiId, serverId int64
+	if err := row.Scan(&emojiId, &serverId, &emoji.Name, &emoji.Url, &emoji.Animated); err != nil {
+		return CustomEmoji{}, err
+	}
+	emoji.Id = strconv.FormatInt(emojiId, 10)
+	emoji.ServerId = strconv.FormatInt(serverId, 10)
+	return emoji, nil
+}
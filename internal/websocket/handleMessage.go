@@ -1,24 +1,107 @@
 package websocket
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 	"webserver/internal/config"
 	"webserver/internal/helper"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
 )
 
-func saveMessage(request webSocketRequest) error {
-	var userId, _ = strconv.ParseInt(request.Data["userId"].(string), 10, 64)
-	message := request.Data["message"].(string)
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrInvalidMessage  = errors.New("invalid message")
+)
+
+type messageAuthor struct {
+	UserId      string `json:"userId"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Img         string `json:"img"`
+}
+
+type messageData struct {
+	MessageId string        `json:"messageId"`
+	ChannelId string        `json:"channelId"`
+	ServerId  string        `json:"serverId,omitempty"`
+	Author    messageAuthor `json:"author"`
+	Message   string        `json:"message"`
+	SentAt    time.Time     `json:"sentAt"`
+	EditedAt  *time.Time    `json:"editedAt"`
+	Deleted   bool          `json:"deleted"`
+
+	ReplyTo  *MessageReference `json:"replyTo"`
+	Mentions Mentions          `json:"mentions"`
+}
+
+// MessageReference is the message a reply refers to. The text of deleted messages is empty.
+type MessageReference struct {
+	MessageId string        `json:"messageId"`
+	Author    messageAuthor `json:"author"`
+	Message   string        `json:"message"`
+	Deleted   bool          `json:"deleted"`
+}
+
+type messageDeleteData struct {
+	MessageId string `json:"messageId"`
+	ChannelId string `json:"channelId"`
+	ServerId  string `json:"serverId,omitempty"`
+}
+
+// MessageEdit is a previous version of an edited message.
+type MessageEdit struct {
+	Message  string    `json:"message"`
+	EditedAt time.Time `json:"editedAt"`
+}
+
+// sendMessage handles the onmessage event. The new message is sent back in the ack.
+func sendMessage(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.SendMessage](request)
+	if err != nil {
+		return nil, err
+	}
+
+	channelId := int64(data.ChannelId)
+	message, serverId, err := saveMessage(c.userId, channelId, data.Message, int64(data.ReplyToMessageId))
+	if err != nil {
+		return nil, err
+	}
+	hub.broadcastToChannelViewers(serverId, channelId, protocol.Event{Type: "message-create", Data: message})
+	notifyMentions(serverId, channelId, c.userId, message)
+	return message, nil
+}
+
+// saveMessage stores a new message together with its mentions. A non-zero replyToId
+// must be a message of the same channel.
+func saveMessage(userId int64, channelId int64, message string, replyToId int64) (messageData, int64, error) {
 	messageId := helper.GenerateUniqueId()
-	var channelId, _ = strconv.ParseInt(request.Data["channelId"].(string), 10, 64)
+	sentAt := time.Now().UTC()
+	var serverId int64
+	var author messageAuthor
+	var thread *Thread
 
 	tx, err := config.UseDBPool().DB.Begin()
 	if err != nil {
 		log.Println(err)
-		return err
+		return messageData{}, 0, err
 	}
 
+	// Deferred first so it runs after the commit below
+	defer func() {
+		if err == nil {
+			typing.stop(userId, channelId)
+			if thread != nil {
+				publishThread("thread-updated", *thread)
+			}
+		}
+	}()
+
 	defer func() {
 		if err := config.UseDBPool().RollbackOrCommit(tx, err == nil); err != nil {
 			log.Println("Error rolling back transaction:", err)
@@ -26,11 +109,325 @@ func saveMessage(request webSocketRequest) error {
 		}
 	}()
 
-	_, err = tx.Exec("INSERT INTO messages (message_id, channel_id, user_id, message_text) VALUES (?,?,?,?)", messageId, channelId, userId, message)
+	serverId, err = permissions.CheckChannelPermission(tx, channelId, userId, permissions.ViewChannel|permissions.SendMessages)
+	if err != nil {
+		return messageData{}, 0, err
+	}
+
+	var replyTo *MessageReference
+	var replyToMessageId sql.NullInt64
+	if replyToId != 0 {
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM messages WHERE message_id = ? AND channel_id = ? AND deleted_at IS NULL)", replyToId, channelId).Scan(&exists)
+		if err == nil && !exists {
+			err = fmt.Errorf("%w: the message replied to is not in this channel", ErrInvalidMessage)
+		}
+		if err == nil {
+			replyTo, err = loadMessageReference(tx, replyToId)
+		}
+		if err != nil {
+			return messageData{}, 0, err
+		}
+		replyToMessageId = sql.NullInt64{Int64: replyToId, Valid: true}
+	}
+
+	_, err = tx.Exec("INSERT INTO messages (message_id, channel_id, user_id, message_text, sent_at, reply_to_message_id) VALUES (?,?,?,?,?,?)",
+		messageId, channelId, userId, message, sentAt, replyToMessageId)
 	if err != nil {
 		log.Println("Failed add message into db:", err)
+		return messageData{}, 0, err
+	}
+
+	mentions, err := saveMentions(tx, serverId, channelId, userId, messageId, message)
+	if err != nil {
+		log.Println("Failed to save mentions:", err)
+		return messageData{}, 0, err
+	}
+
+	thread, err = touchThread(tx, channelId, userId, sentAt)
+	if err != nil {
+		log.Println("Failed to update thread:", err)
+		return messageData{}, 0, err
+	}
+
+	err = tx.QueryRow("SELECT username, COALESCE(display_name, ''), COALESCE(img_url, '') FROM users WHERE user_id = ?", userId).Scan(&author.Username, &author.DisplayName, &author.Img)
+	if err != nil {
+		log.Println("Failed to look up message author:", err)
+		return messageData{}, 0, err
+	}
+	author.UserId = strconv.FormatInt(userId, 10)
+
+	data := messageData{
+		MessageId: strconv.FormatInt(messageId, 10),
+		ChannelId: strconv.FormatInt(channelId, 10),
+		ServerId:  formatServerId(serverId),
+		Author:    author,
+		Message:   message,
+		SentAt:    sentAt,
+		ReplyTo:   replyTo,
+		Mentions:  mentions,
+	}
+
+	return data, serverId, nil
+}
+
+// EditMessage replaces the text of a message. Only the author can edit a message;
+// the previous text is kept in the edit history.
+func EditMessage(userId int64, messageId int64, text string) error {
+	if err := protocol.ValidateMessageText(text); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+
+	var message messageData
+	var serverId int64
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		var err error
+		message, err = loadMessage(tx, messageId)
+		if err != nil {
+			return err
+		}
+		channelId, _ := strconv.ParseInt(message.ChannelId, 10, 64)
+		serverId, err = permissions.CheckChannelPermission(tx, channelId, userId, permissions.ViewChannel)
+		if err != nil {
+			return err
+		}
+		if message.Author.UserId != strconv.FormatInt(userId, 10) {
+			return fmt.Errorf("%w: only the author can edit a message", permissions.ErrMissingPermission)
+		}
+
+		editedAt := time.Now().UTC()
+		_, err = tx.Exec("INSERT INTO message_edits (message_id, message_text, edited_at) VALUES (?, ?, ?)", messageId, message.Message, editedAt)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE messages SET message_text = ?, edited_at = ? WHERE message_id = ?", text, editedAt, messageId)
+		if err != nil {
+			return err
+		}
+		message.Mentions, err = saveMentions(tx, serverId, channelId, userId, messageId, text)
+		if err != nil {
+			return err
+		}
+
+		message.Message = text
+		message.EditedAt = &editedAt
+		message.ServerId = formatServerId(serverId)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	channelId, _ := strconv.ParseInt(message.ChannelId, 10, 64)
+	hub.broadcastToChannelViewers(serverId, channelId, protocol.Event{Type: "message-update", Data: message})
+	return nil
+}
+
+// DeleteMessage soft-deletes a message, leaving a tombstone without text in the channel history.
+// Besides the author, members with the manage messages permission can delete any message.
+func DeleteMessage(userId int64, messageId int64) error {
+	var message messageData
+	var serverId int64
+	var thread *Thread
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		var err error
+		message, err = loadMessage(tx, messageId)
+		if err != nil {
+			return err
+		}
+		channelId, _ := strconv.ParseInt(message.ChannelId, 10, 64)
+		flags := permissions.ViewChannel
+		if message.Author.UserId != strconv.FormatInt(userId, 10) {
+			flags |= permissions.ManageMessages
+		}
+		serverId, err = permissions.CheckChannelPermission(tx, channelId, userId, flags)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE messages SET message_text = '', deleted_at = ? WHERE message_id = ?", time.Now().UTC(), messageId)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM message_edits WHERE message_id = ?", messageId)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM message_reactions WHERE message_id = ?", messageId)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM message_mentions WHERE message_id = ?", messageId)
+		if err != nil {
+			return err
+		}
+
+		// The reply count of a thread changes with its messages
+		current, err := loadThread(tx, channelId)
+		if err == nil {
+			thread = &current
+		} else if !errors.Is(err, permissions.ErrChannelNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
+	channelId, _ := strconv.ParseInt(message.ChannelId, 10, 64)
+	data := messageDeleteData{MessageId: message.MessageId, ChannelId: message.ChannelId, ServerId: formatServerId(serverId)}
+	hub.broadcastToChannelViewers(serverId, channelId, protocol.Event{Type: "message-delete", Data: data})
+	if thread != nil {
+		publishThread("thread-updated", *thread)
+	}
 	return nil
 }
+
+// MessageEdits returns the previous versions of a message, oldest first.
+// They are visible to the author and to members with the manage messages permission.
+func MessageEdits(userId int64, messageId int64) ([]MessageEdit, error) {
+	edits := []MessageEdit{}
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		message, err := loadMessage(tx, messageId)
+		if err != nil {
+			return err
+		}
+		channelId, _ := strconv.ParseInt(message.ChannelId, 10, 64)
+		flags := permissions.ViewChannel | permissions.ReadMessageHistory
+		if message.Author.UserId != strconv.FormatInt(userId, 10) {
+			flags |= permissions.ManageMessages
+		}
+		if _, err := permissions.CheckChannelPermission(tx, channelId, userId, flags); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query("SELECT message_text, edited_at FROM message_edits WHERE message_id = ? ORDER BY edited_at, edit_id", messageId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var edit MessageEdit
+			if err := rows.Scan(&edit.Message, &edit.EditedAt); err != nil {
+				return err
+			}
+			edits = append(edits, edit)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return edits, nil
+}
+
+// editMessage handles the edit-message event, the socket equivalent of PATCH /api/messages/{messageId}.
+func editMessage(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.EditMessage](request)
+	if err != nil {
+		return nil, err
+	}
+	return nil, EditMessage(c.userId, int64(data.MessageId), data.Message)
+}
+
+// deleteMessage handles the delete-message event, the socket equivalent of DELETE /api/messages/{messageId}.
+func deleteMessage(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.DeleteMessage](request)
+	if err != nil {
+		return nil, err
+	}
+	return nil, DeleteMessage(c.userId, int64(data.MessageId))
+}
+
+// loadMessage looks up a message that has not been deleted, with the message it replies to.
+// Its mentions are not loaded.
+func loadMessage(tx *sql.Tx, messageId int64) (messageData, error) {
+	var message messageData
+	var channelId, authorId int64
+	var editedAt sql.NullTime
+	var replyToId sql.NullInt64
+	err := tx.QueryRow(`SELECT m.message_id, m.channel_id, m.user_id, COALESCE(u.username, ''), COALESCE(u.display_name, ''), COALESCE(u.img_url, ''), m.message_text, m.sent_at, m.edited_at, m.reply_to_message_id
+		FROM messages m LEFT JOIN users u ON u.user_id = m.user_id WHERE m.message_id = ? AND m.deleted_at IS NULL`, messageId).
+		Scan(&messageId, &channelId, &authorId, &message.Author.Username, &message.Author.DisplayName, &message.Author.Img, &message.Message, &message.SentAt, &editedAt, &replyToId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return messageData{}, ErrMessageNotFound
+	} else if err != nil {
+		return messageData{}, err
+	}
+
+	message.MessageId = strconv.FormatInt(messageId, 10)
+	message.ChannelId = strconv.FormatInt(channelId, 10)
+	message.Author.UserId = strconv.FormatInt(authorId, 10)
+	message.Mentions = newMentions()
+	if editedAt.Valid {
+		message.EditedAt = &editedAt.Time
+	}
+	if replyToId.Valid {
+		message.ReplyTo, err = loadMessageReference(tx, replyToId.Int64)
+		if err != nil && !errors.Is(err, ErrMessageNotFound) {
+			return messageData{}, err
+		}
+	}
+	return message, nil
+}
+
+const messageReferenceColumns = `SELECT m.message_id, m.user_id, COALESCE(u.username, ''), COALESCE(u.display_name, ''), COALESCE(u.img_url, ''), m.message_text, m.deleted_at IS NOT NULL
+	FROM messages m LEFT JOIN users u ON u.user_id = m.user_id`
+
+// MessageReferences looks up the messages replied to, keyed by message ID. Deleted messages are included.
+func MessageReferences(q permissions.Querier, messageIds []int64) (map[int64]*MessageReference, error) {
+	references := make(map[int64]*MessageReference)
+	if len(messageIds) == 0 {
+		return references, nil
+	}
+
+	args := make([]interface{}, len(messageIds))
+	for i, messageId := range messageIds {
+		args[i] = messageId
+	}
+	rows, err := q.Query(messageReferenceColumns+" WHERE m.message_id IN (?"+strings.Repeat(", ?", len(messageIds)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		reference, err := scanMessageReference(rows)
+		if err != nil {
+			return nil, err
+		}
+		messageId, _ := strconv.ParseInt(reference.MessageId, 10, 64)
+		references[messageId] = reference
+	}
+	return references, rows.Err()
+}
+
+func loadMessageReference(q permissions.Querier, messageId int64) (*MessageReference, error) {
+	reference, err := scanMessageReference(q.QueryRow(messageReferenceColumns+" WHERE m.message_id = ?", messageId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	return reference, err
+}
+
+func scanMessageReference(row rowScanner) (*MessageReference, error) {
+	var reference MessageReference
+	var messageId, authorId int64
+	err := row.Scan(&messageId, &authorId, &reference.Author.Username, &reference.Author.DisplayName, &reference.Author.Img, &reference.Message, &reference.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	reference.MessageId = strconv.FormatInt(messageId, 10)
+	reference.Author.UserId = strconv.FormatInt(authorId, 10)
+	return &reference, nil
+}
+
+// formatServerId formats the server ID of a channel, which is 0 for DMs and group DMs.
+func formatServerId(serverId int64) string {
+	if serverId == 0 {
+		return ""
+	}
+	return strconv.FormatInt(serverId, 10)
+}
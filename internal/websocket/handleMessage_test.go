@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+)
+
+const (
+	testServerId  = 10
+	testChannelId = 100
+	// otherChannelId is a channel of the same server the message was not sent in.
+	otherChannelId = 101
+	messageId      = 1000
+	// Users 1 and 2 are members, but user 2 may not add reactions in the channel. User 3 is no member.
+	memberId     = 1
+	restrictedId = 2
+	outsiderId   = 3
+)
+
+// newMessageTestDB creates a server with a custom emoji whose channel has a message of memberId.
+func newMessageTestDB(t *testing.T) *config.DatabasePool {
+	t.Helper()
+	pool := newTestDB(t)
+	exec(t, pool, "INSERT INTO users (user_id, username) VALUES (?, 'member'), (?, 'restricted'), (?, 'outsider')", memberId, restrictedId, outsiderId)
+	exec(t, pool, "INSERT INTO servers (server_id, server_name) VALUES (?, 's')", testServerId)
+	exec(t, pool, "INSERT INTO roles (role_id, server_id, role_name, permissions, position) VALUES (?, ?, '@everyone', ?, 0)",
+		testServerId, testServerId, int64(permissions.Default))
+	exec(t, pool, "INSERT INTO server_members (server_id, user_id, server_owner) VALUES (?, ?, false), (?, ?, false)",
+		testServerId, memberId, testServerId, restrictedId)
+	exec(t, pool, "INSERT INTO channels (channel_id, server_id, channel_name, type) VALUES (?, ?, 'general', 1), (?, ?, 'other', 1)",
+		testChannelId, testServerId, otherChannelId, testServerId)
+	exec(t, pool, "INSERT INTO channel_overwrites (channel_id, target_id, target_type, allow, deny) VALUES (?, ?, ?, 0, ?)",
+		testChannelId, restrictedId, permissions.OverwriteMember, int64(permissions.AddReactions))
+	exec(t, pool, "INSERT INTO emojis (emoji_id, server_id, name, img_url) VALUES (42, ?, 'party', '')", testServerId)
+	exec(t, pool, "INSERT INTO messages (message_id, channel_id, user_id, message_text) VALUES (?, ?, ?, 'hi')", messageId, testChannelId, memberId)
+	return pool
+}
+
+func TestEditMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		userId  int64
+		text    string
+		wantErr error
+	}{
+		{"by the author", memberId, "edited", nil},
+		{"of maximum length", memberId, strings.Repeat("a", 4000), nil},
+		{"too long", memberId, strings.Repeat("a", 4001), ErrInvalidMessage},
+		{"empty", memberId, "", ErrInvalidMessage},
+		{"by another member", restrictedId, "edited", permissions.ErrMissingPermission},
+		{"not a member", outsiderId, "edited", permissions.ErrNotMember},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newMessageTestDB(t)
+			_, viewer := registerClient(t, memberId)
+
+			if err := EditMessage(test.userId, messageId, test.text); !errors.Is(err, test.wantErr) {
+				t.Fatalf("EditMessage() = %v, want %v", err, test.wantErr)
+			}
+
+			want := "hi"
+			if test.wantErr == nil {
+				want = test.text
+			}
+			var text string
+			var edits int
+			if err := pool.DB.QueryRow("SELECT message_text, (SELECT COUNT(*) FROM message_edits WHERE message_id = ?) FROM messages WHERE message_id = ?", messageId, messageId).Scan(&text, &edits); err != nil {
+				t.Fatal(err)
+			}
+			if text != want {
+				t.Errorf("message text is %.20q, want %.20q", text, want)
+			}
+			if (edits == 1) != (test.wantErr == nil) {
+				t.Errorf("%d edits were recorded", edits)
+			}
+			if event := receive(t, viewer); (event == "message-update") != (test.wantErr == nil) {
+				t.Errorf("channel viewer received %q", event)
+			}
+		})
+	}
+}
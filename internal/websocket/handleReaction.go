@@ -0,0 +1,243 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+const maxEmojiLength = 64
+
+var ErrInvalidEmoji = errors.New("invalid emoji")
+
+// customEmojiPattern matches a custom server emoji given as its ID or as name:id.
+var customEmojiPattern = regexp.MustCompile(`^(?:\w{2,32}:)?(-?\d+)$`)
+
+// Emoji is either a custom server emoji, identified by Id, or a Unicode emoji in Name.
+// For custom emoji Name holds the name they have on their server.
+type Emoji struct {
+	Id   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Reaction is the number of users who reacted to a message with an emoji.
+// Me tells whether the requesting user is one of them.
+type Reaction struct {
+	Emoji Emoji `json:"emoji"`
+	Count int   `json:"count"`
+	Me    bool  `json:"me"`
+}
+
+type reactionData struct {
+	MessageId string `json:"messageId"`
+	ChannelId string `json:"channelId"`
+	ServerId  string `json:"serverId,omitempty"`
+	UserId    string `json:"userId"`
+	Emoji     Emoji  `json:"emoji"`
+}
+
+// AddReaction reacts to a message. Members need the add reactions permission to use an emoji
+// nobody has reacted with yet; joining an existing reaction only requires reading the channel.
+func AddReaction(userId int64, channelId int64, messageId int64, value string) error {
+	emojiId, emojiName, err := parseEmoji(value)
+	if err != nil {
+		return err
+	}
+
+	var serverId int64
+	var added bool
+	emoji := formatEmoji(emojiId, emojiName)
+	err = config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		var err error
+		serverId, err = requireReactableMessage(tx, userId, channelId, messageId)
+		if err != nil {
+			return err
+		}
+		if emojiId != 0 {
+			if emoji.Name, err = customEmojiName(tx, emojiId); err != nil {
+				return err
+			}
+		}
+
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM message_reactions WHERE message_id = ? AND emoji_id = ? AND emoji_name = ?)", messageId, emojiId, emojiName).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := permissions.CheckChannelPermission(tx, channelId, userId, permissions.AddReactions); err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.Exec("INSERT OR IGNORE INTO message_reactions (message_id, user_id, emoji_id, emoji_name, created_at) VALUES (?, ?, ?, ?, ?)",
+			messageId, userId, emojiId, emojiName, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		added = affected > 0
+		return err
+	})
+	if err != nil || !added {
+		return err
+	}
+
+	publishReaction("reaction-add", serverId, channelId, messageId, userId, emoji)
+	return nil
+}
+
+// RemoveReaction removes the reaction of the user with an emoji from a message.
+func RemoveReaction(userId int64, channelId int64, messageId int64, value string) error {
+	emojiId, emojiName, err := parseEmoji(value)
+	if err != nil {
+		return err
+	}
+
+	var serverId int64
+	var removed bool
+	emoji := formatEmoji(emojiId, emojiName)
+	err = config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		var err error
+		serverId, err = requireReactableMessage(tx, userId, channelId, messageId)
+		if err != nil {
+			return err
+		}
+		if emojiId != 0 {
+			if emoji.Name, err = customEmojiName(tx, emojiId); err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.Exec("DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji_id = ? AND emoji_name = ?", messageId, userId, emojiId, emojiName)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		removed = affected > 0
+		return err
+	})
+	if err != nil || !removed {
+		return err
+	}
+
+	publishReaction("reaction-remove", serverId, channelId, messageId, userId, emoji)
+	return nil
+}
+
+// MessageReactions returns the reactions of the given messages as seen by userId, keyed by message ID.
+// The reactions of a message are ordered by when their emoji was first used.
+func MessageReactions(q permissions.Querier, userId int64, messageIds []int64) (map[int64][]Reaction, error) {
+	reactions := make(map[int64][]Reaction)
+	if len(messageIds) == 0 {
+		return reactions, nil
+	}
+
+	args := []interface{}{userId}
+	for _, messageId := range messageIds {
+		args = append(args, messageId)
+	}
+	rows, err := q.Query(`SELECT r.message_id, r.emoji_id, COALESCE(e.name, r.emoji_name), COUNT(*), MAX(r.user_id = ?)
+		FROM message_reactions r LEFT JOIN emojis e ON e.emoji_id = r.emoji_id AND r.emoji_id != 0
+		WHERE r.message_id IN (?`+strings.Repeat(", ?", len(messageIds)-1)+`)
+		GROUP BY r.message_id, r.emoji_id, r.emoji_name ORDER BY r.message_id, MIN(r.created_at)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageId, emojiId int64
+		var emojiName string
+		var reaction Reaction
+		if err := rows.Scan(&messageId, &emojiId, &emojiName, &reaction.Count, &reaction.Me); err != nil {
+			return nil, err
+		}
+		reaction.Emoji = formatEmoji(emojiId, emojiName)
+		reactions[messageId] = append(reactions[messageId], reaction)
+	}
+	return reactions, rows.Err()
+}
+
+// requireReactableMessage makes sure the message exists in the channel and the user can read it.
+func requireReactableMessage(tx *sql.Tx, userId int64, channelId int64, messageId int64) (int64, error) {
+	serverId, err := permissions.CheckChannelPermission(tx, channelId, userId, permissions.ViewChannel|permissions.ReadMessageHistory)
+	if err != nil {
+		return 0, err
+	}
+
+	message, err := loadMessage(tx, messageId)
+	if err != nil {
+		return 0, err
+	}
+	if message.ChannelId != strconv.FormatInt(channelId, 10) {
+		return 0, ErrMessageNotFound
+	}
+	return serverId, nil
+}
+
+// parseEmoji splits an emoji into the ID of a custom emoji or the name of a Unicode emoji.
+func parseEmoji(value string) (int64, string, error) {
+	if match := customEmojiPattern.FindStringSubmatch(value); match != nil {
+		emojiId, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || emojiId == 0 {
+			return 0, "", fmt.Errorf("%w: %q is not a valid emoji ID", ErrInvalidEmoji, match[1])
+		}
+		return emojiId, "", nil
+	}
+
+	if value == "" || len(value) > maxEmojiLength || !utf8.ValidString(value) {
+		return 0, "", fmt.Errorf("%w: %q", ErrInvalidEmoji, value)
+	}
+	// Emoji sequences may contain ASCII, like keycaps, but never consist of it alone
+	symbol := false
+	for _, r := range value {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return 0, "", fmt.Errorf("%w: %q", ErrInvalidEmoji, value)
+		}
+		if r >= utf8.RuneSelf && !unicode.IsLetter(r) {
+			symbol = true
+		}
+	}
+	if !symbol {
+		return 0, "", fmt.Errorf("%w: %q", ErrInvalidEmoji, value)
+	}
+	return 0, value, nil
+}
+
+// formatEmoji formats the emoji of a reaction. The name of a custom emoji is its name on its server.
+func formatEmoji(emojiId int64, name string) Emoji {
+	if emojiId != 0 {
+		return Emoji{Id: strconv.FormatInt(emojiId, 10), Name: name}
+	}
+	return Emoji{Name: name}
+}
+
+func customEmojiName(tx *sql.Tx, emojiId int64) (string, error) {
+	var name string
+	err := tx.QueryRow("SELECT name FROM emojis WHERE emoji_id = ?", emojiId).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: unknown custom emoji %d", ErrInvalidEmoji, emojiId)
+	}
+	return name, err
+}
+
+func publishReaction(eventType string, serverId int64, channelId int64, messageId int64, userId int64, emoji Emoji) {
+	data := reactionData{
+		MessageId: strconv.FormatInt(messageId, 10),
+		ChannelId: strconv.FormatInt(channelId, 10),
+		ServerId:  formatServerId(serverId),
+		UserId:    strconv.FormatInt(userId, 10),
+		Emoji:     emoji,
+	}
+	hub.broadcastToChannelViewers(serverId, channelId, protocol.Event{Type: eventType, Data: data})
+}
@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"errors"
+	"testing"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+)
+
+// reactionCount returns how many users reacted to the message with the emoji.
+func reactionCount(t *testing.T, pool *config.DatabasePool, emoji Emoji) int {
+	t.Helper()
+	reactions, err := MessageReactions(pool.DB, memberId, []int64{messageId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reaction := range reactions[messageId] {
+		if reaction.Emoji == emoji {
+			return reaction.Count
+		}
+	}
+	return 0
+}
+
+func TestAddReaction(t *testing.T) {
+	thumbsUp := Emoji{Name: "👍"}
+
+	tests := []struct {
+		name string
+		// reacted tells whether the member already reacted with the emoji.
+		reacted   bool
+		userId    int64
+		channelId int64
+		emoji     string
+		wantErr   error
+		wantEmoji Emoji
+		wantCount int
+		wantEvent bool
+	}{
+		{"new emoji", false, memberId, testChannelId, "👍", nil, thumbsUp, 1, true},
+		{"custom emoji", false, memberId, testChannelId, "party:42", nil, Emoji{Id: "42", Name: "party"}, 1, true},
+		{"unknown custom emoji", false, memberId, testChannelId, "43", ErrInvalidEmoji, Emoji{Id: "43"}, 0, false},
+		{"twice", true, memberId, testChannelId, "👍", nil, thumbsUp, 1, false},
+		{"new emoji without AddReactions", false, restrictedId, testChannelId, "👍", permissions.ErrMissingPermission, thumbsUp, 0, false},
+		{"existing emoji without AddReactions", true, restrictedId, testChannelId, "👍", nil, thumbsUp, 2, true},
+		{"not a member", true, outsiderId, testChannelId, "👍", permissions.ErrNotMember, thumbsUp, 1, false},
+		{"message of another channel", false, memberId, otherChannelId, "👍", ErrMessageNotFound, thumbsUp, 0, false},
+		{"invalid emoji", false, memberId, testChannelId, "abc", ErrInvalidEmoji, Emoji{Name: "abc"}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newMessageTestDB(t)
+			if test.reacted {
+				exec(t, pool, "INSERT INTO message_reactions (message_id, user_id, emoji_name, created_at) VALUES (?, ?, '👍', CURRENT_TIMESTAMP)", messageId, memberId)
+			}
+			_, viewer := registerClient(t, memberId)
+
+			if err := AddReaction(test.userId, test.channelId, messageId, test.emoji); !errors.Is(err, test.wantErr) {
+				t.Fatalf("AddReaction() = %v, want %v", err, test.wantErr)
+			}
+			if count := reactionCount(t, pool, test.wantEmoji); count != test.wantCount {
+				t.Errorf("%d users reacted, want %d", count, test.wantCount)
+			}
+			if event := receive(t, viewer); (event == "reaction-add") != test.wantEvent {
+				t.Errorf("channel viewer received %q, want reaction-add: %v", event, test.wantEvent)
+			}
+		})
+	}
+}
+
+func TestRemoveReaction(t *testing.T) {
+	thumbsUp := Emoji{Name: "👍"}
+
+	tests := []struct {
+		name      string
+		userId    int64
+		emoji     string
+		wantErr   error
+		wantCount int
+		wantEvent bool
+	}{
+		{"own reaction", memberId, "👍", nil, 1, true},
+		{"own reaction without AddReactions", restrictedId, "👍", nil, 1, true},
+		{"emoji not reacted with", memberId, "🎉", nil, 2, false},
+		{"not a member", outsiderId, "👍", permissions.ErrNotMember, 2, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newMessageTestDB(t)
+			exec(t, pool, "INSERT INTO message_reactions (message_id, user_id, emoji_name, created_at) VALUES (?, ?, '👍', CURRENT_TIMESTAMP), (?, ?, '👍', CURRENT_TIMESTAMP)",
+				messageId, memberId, messageId, restrictedId)
+			_, viewer := registerClient(t, memberId)
+
+			if err := RemoveReaction(test.userId, testChannelId, messageId, test.emoji); !errors.Is(err, test.wantErr) {
+				t.Fatalf("RemoveReaction() = %v, want %v", err, test.wantErr)
+			}
+			if count := reactionCount(t, pool, thumbsUp); count != test.wantCount {
+				t.Errorf("%d users reacted, want %d", count, test.wantCount)
+			}
+			if event := receive(t, viewer); (event == "reaction-remove") != test.wantEvent {
+				t.Errorf("channel viewer received %q, want reaction-remove: %v", event, test.wantEvent)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+// updateRole handles the role-update event, the socket equivalent of PATCH /api/{serverId}/roles/{roleId}.
+// The updated role is sent back in the ack.
+func updateRole(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.UpdateRole](request)
+	if err != nil {
+		return nil, err
+	}
+
+	serverId := int64(data.ServerId)
+	role, err := permissions.UpdateRole(c.userId, serverId, int64(data.RoleId), data.RoleUpdate)
+	if err != nil {
+		return nil, err
+	}
+	hub.broadcastToServer(serverId, protocol.Event{Type: "role-updated", Data: role})
+	return role, nil
+}
+
+// ErrorStatus maps the errors of requests to a status code. It is shared by the socket
+// and the REST API, so both answer the same failure with the same status.
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, permissions.ErrNotMember), errors.Is(err, permissions.ErrMissingPermission), errors.Is(err, permissions.ErrRoleHierarchy):
+		return http.StatusForbidden
+	case errors.Is(err, permissions.ErrRoleNotFound), errors.Is(err, permissions.ErrChannelNotFound), errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrUserNotFound), errors.Is(err, ErrEmojiNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, permissions.ErrInvalidRole), errors.Is(err, permissions.ErrInvalidOverwrite), errors.Is(err, ErrInvalidChannel), errors.Is(err, ErrInvalidMessage), errors.Is(err, ErrInvalidRecipient), errors.Is(err, ErrInvalidEmoji),
+		errors.Is(err, protocol.ErrInvalidPayload), errors.Is(err, protocol.ErrUnknownRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
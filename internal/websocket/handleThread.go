@@ -0,0 +1,507 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/helper"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+// defaultAutoArchiveMinutes is used for threads created without an auto-archive duration.
+const defaultAutoArchiveMinutes = 1440
+
+// autoArchiveMinutes are the durations of inactivity after which a thread can be archived:
+// an hour, a day, three days or a week.
+var autoArchiveMinutes = map[int]bool{60: true, 1440: true, 4320: true, 10080: true}
+
+// Thread is a channel anchored to a message of a server text channel. It has its own
+// message history and member list, and inherits the permissions of its parent channel.
+type Thread struct {
+	Id                 string     `json:"id"`
+	ServerId           string     `json:"serverId"`
+	ParentChannelId    string     `json:"parentChannelId"`
+	ParentMessageId    string     `json:"parentMessageId"`
+	OwnerId            string     `json:"ownerId"`
+	Name               string     `json:"name"`
+	MessageCount       int        `json:"messageCount"`
+	MemberCount        int        `json:"memberCount"`
+	AutoArchiveMinutes int        `json:"autoArchiveMinutes"`
+	Archived           bool       `json:"archived"`
+	ArchivedAt         *time.Time `json:"archivedAt"`
+	LastActivityAt     time.Time  `json:"lastActivityAt"`
+	CreatedAt          time.Time  `json:"createdAt"`
+}
+
+// ThreadFields holds the fields to set on a thread; nil fields are left untouched.
+type ThreadFields struct {
+	Name               *string `json:"name"`
+	Archived           *bool   `json:"archived"`
+	AutoArchiveMinutes *int    `json:"autoArchiveMinutes"`
+}
+
+type ThreadMember struct {
+	UserId   string    `json:"userId"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+type threadMembersData struct {
+	ThreadId      string `json:"threadId"`
+	ServerId      string `json:"serverId"`
+	MemberCount   int    `json:"memberCount"`
+	AddedUserId   string `json:"addedUserId,omitempty"`
+	RemovedUserId string `json:"removedUserId,omitempty"`
+}
+
+const threadColumns = `SELECT t.thread_id, c.server_id, t.parent_channel_id, t.parent_message_id, t.owner_id, c.channel_name,
+		(SELECT COUNT(*) FROM messages m WHERE m.channel_id = t.thread_id AND m.deleted_at IS NULL),
+		(SELECT COUNT(*) FROM thread_members tm WHERE tm.thread_id = t.thread_id),
+		t.auto_archive_minutes, t.archived, t.archived_at, t.last_activity_at, c.created_at
+	FROM threads t JOIN channels c ON c.channel_id = t.thread_id`
+
+// CreateThread starts a thread on a message of a server text channel. Members who can send
+// messages in the channel can start threads; the creator is the first member of the thread.
+// A message has at most one thread.
+func CreateThread(userId int64, channelId int64, messageId int64, name string, archiveMinutes int) (Thread, error) {
+	if err := validateThreadName(name); err != nil {
+		return Thread{}, err
+	}
+	if archiveMinutes == 0 {
+		archiveMinutes = defaultAutoArchiveMinutes
+	}
+	if err := validateAutoArchiveMinutes(archiveMinutes); err != nil {
+		return Thread{}, err
+	}
+
+	threadId := helper.GenerateUniqueId()
+	var thread Thread
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		serverId, err := permissions.CheckChannelPermission(tx, channelId, userId, permissions.ViewChannel|permissions.SendMessages|permissions.ReadMessageHistory)
+		if err != nil {
+			return err
+		}
+
+		parent, err := scanChannel(tx.QueryRow(channelColumns+" WHERE channel_id = ? AND server_id IS NOT NULL", channelId))
+		if errors.Is(err, permissions.ErrChannelNotFound) {
+			return fmt.Errorf("%w: threads can only be started in server channels", ErrInvalidChannel)
+		} else if err != nil {
+			return err
+		}
+		if parent.Type != ChannelTypeText {
+			return fmt.Errorf("%w: threads can only be started in text channels", ErrInvalidChannel)
+		}
+
+		message, err := loadMessage(tx, messageId)
+		if err != nil {
+			return err
+		}
+		if message.ChannelId != parent.Id {
+			return ErrMessageNotFound
+		}
+
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM threads WHERE parent_message_id = ?)", messageId).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: the message already has a thread", ErrInvalidChannel)
+		}
+
+		now := time.Now().UTC()
+		_, err = tx.Exec("INSERT INTO channels (channel_id, server_id, type, channel_name, position, created_at) VALUES (?, ?, ?, ?, 0, ?)",
+			threadId, serverId, ChannelTypeThread, name, now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO threads (thread_id, parent_channel_id, parent_message_id, owner_id, auto_archive_minutes, last_activity_at) VALUES (?, ?, ?, ?, ?, ?)",
+			threadId, channelId, messageId, userId, archiveMinutes, now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO thread_members (thread_id, user_id, joined_at) VALUES (?, ?, ?)", threadId, userId, now)
+		if err != nil {
+			return err
+		}
+
+		thread, err = loadThread(tx, threadId)
+		return err
+	})
+	if err != nil {
+		return Thread{}, err
+	}
+
+	publishThread("thread-created", thread)
+	return thread, nil
+}
+
+// UpdateThread renames a thread, changes its auto-archive duration or (un)archives it.
+// Besides the creator of the thread, members with the manage channels permission can do so.
+func UpdateThread(userId int64, threadId int64, fields ThreadFields) (Thread, error) {
+	if fields.Name != nil {
+		if err := validateThreadName(*fields.Name); err != nil {
+			return Thread{}, err
+		}
+	}
+	if fields.AutoArchiveMinutes != nil {
+		if err := validateAutoArchiveMinutes(*fields.AutoArchiveMinutes); err != nil {
+			return Thread{}, err
+		}
+	}
+
+	var thread Thread
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		current, err := loadThread(tx, threadId)
+		if err != nil {
+			return err
+		}
+		flags := permissions.ViewChannel
+		if current.OwnerId != strconv.FormatInt(userId, 10) {
+			flags |= permissions.ManageChannels
+		}
+		if _, err := permissions.CheckChannelPermission(tx, threadId, userId, flags); err != nil {
+			return err
+		}
+
+		if fields.Name != nil {
+			if _, err := tx.Exec("UPDATE channels SET channel_name = ? WHERE channel_id = ?", *fields.Name, threadId); err != nil {
+				return err
+			}
+		}
+		if fields.AutoArchiveMinutes != nil {
+			if _, err := tx.Exec("UPDATE threads SET auto_archive_minutes = ? WHERE thread_id = ?", *fields.AutoArchiveMinutes, threadId); err != nil {
+				return err
+			}
+		}
+		if fields.Archived != nil && *fields.Archived != current.Archived {
+			// Unarchiving counts as activity, so the thread is not archived again right away
+			now := time.Now().UTC()
+			query, args := "UPDATE threads SET archived = true, archived_at = ? WHERE thread_id = ?", []interface{}{now, threadId}
+			if !*fields.Archived {
+				query, args = "UPDATE threads SET archived = false, archived_at = NULL, last_activity_at = ? WHERE thread_id = ?", []interface{}{now, threadId}
+			}
+			if _, err := tx.Exec(query, args...); err != nil {
+				return err
+			}
+		}
+
+		thread, err = loadThread(tx, threadId)
+		return err
+	})
+	if err != nil {
+		return Thread{}, err
+	}
+
+	publishThread("thread-updated", thread)
+	return thread, nil
+}
+
+// ListThreads returns the threads of a channel, most recently active first.
+// Archived threads are only included if archived is set, and then exclusively.
+func ListThreads(userId int64, channelId int64, archived bool) ([]Thread, error) {
+	threads := []Thread{}
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		_, err := permissions.CheckChannelPermission(tx, channelId, userId, permissions.ViewChannel|permissions.ReadMessageHistory)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(threadColumns+" WHERE t.parent_channel_id = ? AND t.archived = ? ORDER BY t.last_activity_at DESC, t.thread_id", channelId, archived)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			thread, err := scanThread(rows)
+			if err != nil {
+				return err
+			}
+			threads = append(threads, thread)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return threads, nil
+}
+
+// MessageThreads returns the threads started on the given messages, keyed by message ID.
+func MessageThreads(q permissions.Querier, messageIds []int64) (map[int64]Thread, error) {
+	threads := make(map[int64]Thread)
+	if len(messageIds) == 0 {
+		return threads, nil
+	}
+
+	args := make([]interface{}, len(messageIds))
+	for i, messageId := range messageIds {
+		args[i] = messageId
+	}
+	rows, err := q.Query(threadColumns+" WHERE t.parent_message_id IN (?"+strings.Repeat(", ?", len(messageIds)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		thread, err := scanThread(rows)
+		if err != nil {
+			return nil, err
+		}
+		messageId, _ := strconv.ParseInt(thread.ParentMessageId, 10, 64)
+		threads[messageId] = thread
+	}
+	return threads, rows.Err()
+}
+
+// ThreadMembers returns the members of a thread in the order they joined.
+func ThreadMembers(userId int64, threadId int64) ([]ThreadMember, error) {
+	members := []ThreadMember{}
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if _, err := requireThread(tx, userId, threadId); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query("SELECT user_id, joined_at FROM thread_members WHERE thread_id = ? ORDER BY joined_at, user_id", threadId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var member ThreadMember
+			var memberId int64
+			if err := rows.Scan(&memberId, &member.JoinedAt); err != nil {
+				return err
+			}
+			member.UserId = strconv.FormatInt(memberId, 10)
+			members = append(members, member)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// JoinThread adds the user to the members of a thread. Sending a message in a thread joins it as well.
+func JoinThread(userId int64, threadId int64) error {
+	return setThreadMember(userId, threadId, true)
+}
+
+// LeaveThread removes the user from the members of a thread.
+func LeaveThread(userId int64, threadId int64) error {
+	return setThreadMember(userId, threadId, false)
+}
+
+func setThreadMember(userId int64, threadId int64, join bool) error {
+	var serverId int64
+	var changed bool
+	var memberCount int
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		var err error
+		serverId, err = requireThread(tx, userId, threadId)
+		if err != nil {
+			return err
+		}
+
+		query := "INSERT OR IGNORE INTO thread_members (thread_id, user_id, joined_at) VALUES (?, ?, ?)"
+		args := []interface{}{threadId, userId, time.Now().UTC()}
+		if !join {
+			query, args = "DELETE FROM thread_members WHERE thread_id = ? AND user_id = ?", args[:2]
+		}
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		changed = affected > 0
+
+		return tx.QueryRow("SELECT COUNT(*) FROM thread_members WHERE thread_id = ?", threadId).Scan(&memberCount)
+	})
+	if err != nil || !changed {
+		return err
+	}
+
+	data := threadMembersData{ThreadId: strconv.FormatInt(threadId, 10), ServerId: strconv.FormatInt(serverId, 10), MemberCount: memberCount}
+	if join {
+		data.AddedUserId = strconv.FormatInt(userId, 10)
+	} else {
+		data.RemovedUserId = strconv.FormatInt(userId, 10)
+	}
+	hub.broadcastToChannelViewers(serverId, threadId, protocol.Event{Type: "thread-members-update", Data: data})
+	return nil
+}
+
+// ArchiveInactiveThreads archives every thread without a new message for its auto-archive duration.
+// It is run periodically by the scheduler in package croc.
+func ArchiveInactiveThreads() {
+	var archived []Thread
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(threadColumns + " WHERE t.archived = false")
+		if err != nil {
+			return err
+		}
+		var inactive []int64
+		now := time.Now().UTC()
+		for rows.Next() {
+			thread, err := scanThread(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if now.Sub(thread.LastActivityAt) >= time.Duration(thread.AutoArchiveMinutes)*time.Minute {
+				threadId, _ := strconv.ParseInt(thread.Id, 10, 64)
+				inactive = append(inactive, threadId)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, threadId := range inactive {
+			if _, err := tx.Exec("UPDATE threads SET archived = true, archived_at = ? WHERE thread_id = ?", now, threadId); err != nil {
+				return err
+			}
+			thread, err := loadThread(tx, threadId)
+			if err != nil {
+				return err
+			}
+			archived = append(archived, thread)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error archiving inactive threads:", err)
+		return
+	}
+
+	for _, thread := range archived {
+		publishThread("thread-updated", thread)
+	}
+}
+
+// saveNewThread handles the new-thread event, the socket equivalent of
+// POST /api/channels/{channelId}/messages/{messageId}/threads. The new thread is sent back in the ack.
+func saveNewThread(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.NewThread](request)
+	if err != nil {
+		return nil, err
+	}
+	return CreateThread(c.userId, int64(data.ChannelId), int64(data.MessageId), data.Name, data.AutoArchiveMinutes)
+}
+
+// touchThread records a new message of userId in a channel if it is a thread: the thread is
+// unarchived and the author joins it. The updated thread is returned, or nil for other channels.
+func touchThread(tx *sql.Tx, channelId int64, userId int64, sentAt time.Time) (*Thread, error) {
+	res, err := tx.Exec("UPDATE threads SET archived = false, archived_at = NULL, last_activity_at = ? WHERE thread_id = ?", sentAt, channelId)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return nil, err
+	}
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO thread_members (thread_id, user_id, joined_at) VALUES (?, ?, ?)", channelId, userId, sentAt)
+	if err != nil {
+		return nil, err
+	}
+	thread, err := loadThread(tx, channelId)
+	if err != nil {
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// requireThread makes sure the thread exists and the user can view it.
+func requireThread(tx *sql.Tx, userId int64, threadId int64) (int64, error) {
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM threads WHERE thread_id = ?)", threadId).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, permissions.ErrChannelNotFound
+	}
+	return permissions.CheckChannelPermission(tx, threadId, userId, permissions.ViewChannel)
+}
+
+// channelThreadIds returns the IDs of the threads started in a channel.
+func channelThreadIds(tx *sql.Tx, channelId int64) ([]int64, error) {
+	rows, err := tx.Query("SELECT thread_id FROM threads WHERE parent_channel_id = ?", channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var threadIds []int64
+	for rows.Next() {
+		var threadId int64
+		if err := rows.Scan(&threadId); err != nil {
+			return nil, err
+		}
+		threadIds = append(threadIds, threadId)
+	}
+	return threadIds, rows.Err()
+}
+
+func validateThreadName(name string) error {
+	if len(name) == 0 || len(name) > 100 {
+		return fmt.Errorf("%w: the name must be between 1 and 100 characters", ErrInvalidChannel)
+	}
+	return nil
+}
+
+func validateAutoArchiveMinutes(minutes int) error {
+	if !autoArchiveMinutes[minutes] {
+		return fmt.Errorf("%w: the auto-archive duration must be 60, 1440, 4320 or 10080 minutes", ErrInvalidChannel)
+	}
+	return nil
+}
+
+// publishThread sends a thread event to everyone who can view the parent channel,
+// so clients can show the thread and its reply count on the parent message.
+func publishThread(eventType string, thread Thread) {
+	serverId, _ := strconv.ParseInt(thread.ServerId, 10, 64)
+	threadId, _ := strconv.ParseInt(thread.Id, 10, 64)
+	hub.broadcastToChannelViewers(serverId, threadId, protocol.Event{Type: eventType, Data: thread})
+}
+
+func loadThread(q permissions.Querier, threadId int64) (Thread, error) {
+	thread, err := scanThread(q.QueryRow(threadColumns+" WHERE t.thread_id = ?", threadId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Thread{}, permissions.ErrChannelNotFound
+	}
+	return thread, err
+}
+
+func scanThread(row rowScanner) (Thread, error) {
+	var thread Thread
+	var threadId, serverId, parentChannelId, parentMessageId, ownerId int64
+	var archivedAt sql.NullTime
+	err := row.Scan(&threadId, &serverId, &parentChannelId, &parentMessageId, &ownerId, &thread.Name, &thread.MessageCount, &thread.MemberCount,
+		&thread.AutoArchiveMinutes, &thread.Archived, &archivedAt, &thread.LastActivityAt, &thread.CreatedAt)
+	if err != nil {
+		return Thread{}, err
+	}
+
+	thread.Id = strconv.FormatInt(threadId, 10)
+	thread.ServerId = strconv.FormatInt(serverId, 10)
+	thread.ParentChannelId = strconv.FormatInt(parentChannelId, 10)
+	thread.ParentMessageId = strconv.FormatInt(parentMessageId, 10)
+	thread.OwnerId = strconv.FormatInt(ownerId, 10)
+	if archivedAt.Valid {
+		thread.ArchivedAt = &archivedAt.Time
+	}
+	return thread, nil
+}
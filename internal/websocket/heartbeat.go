@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"time"
+	"webserver/internal/protocol"
+)
+
+const (
+	// heartbeatInterval is announced to clients in the hello event; they have to send
+	// a heartbeat event at least this often.
+	heartbeatInterval = 30 * time.Second
+	// maxMissedHeartbeats is how many heartbeats in a row may be missed before the connection is closed.
+	maxMissedHeartbeats = 2
+	// readTimeout is how long a connection may stay silent, neither sending messages nor answering pings.
+	readTimeout = heartbeatInterval * (maxMissedHeartbeats + 1)
+	writeWait   = 10 * time.Second
+
+	closeHeartbeatTimeout = 4000
+)
+
+// startHeartbeat arms the read deadline of a connection and starts pinging it.
+// The returned function stops the pings and must be called once the connection is closed.
+func (c *client) startHeartbeat(ws *websocket.Conn) func() {
+	c.mu.Lock()
+	c.lastHeartbeat = time.Now()
+	c.mu.Unlock()
+
+	ws.SetReadDeadline(time.Now().Add(readTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+
+	done := make(chan struct{})
+	go c.pingLoop(ws, done)
+	return func() { close(done) }
+}
+
+// heartbeat records a heartbeat of the client and acknowledges it.
+func (c *client) heartbeat(ws *websocket.Conn) {
+	c.mu.Lock()
+	c.lastHeartbeat = time.Now()
+	c.mu.Unlock()
+
+	ws.SetReadDeadline(time.Now().Add(readTimeout))
+	if err := c.writeJSON(protocol.Event{Type: "heartbeat-ack"}); err != nil {
+		log.Println("Error writing heartbeat ack to websocket:", err)
+	}
+}
+
+// pingLoop pings the connection every heartbeat interval and closes it once the client missed
+// too many heartbeats. Closing the connection ends its read loop, which suspends the session.
+func (c *client) pingLoop(ws *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			missed := time.Since(c.lastHeartbeat) > heartbeatInterval*maxMissedHeartbeats
+			c.mu.Unlock()
+
+			if missed {
+				log.Println(c.userId, "missed too many heartbeats, closing connection")
+				ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeHeartbeatTimeout, "heartbeat timeout"), time.Now().Add(writeWait))
+				ws.Close()
+				return
+			}
+
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				log.Println("Error pinging websocket:", err)
+				ws.Close()
+				return
+			}
+		}
+	}
+}
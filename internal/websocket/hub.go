@@ -0,0 +1,336 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+// closeSessionRevoked is sent as close code when the auth session of a connection has been revoked.
+const closeSessionRevoked = 4001
+
+// client is a /wss session of a user. It outlives its connection for a while, so a client
+// whose connection dropped can resume it without losing events, see session.go.
+type client struct {
+	id        string
+	userId    int64
+	sessionId string
+
+	mu sync.Mutex
+	// ws is nil while the session is suspended
+	ws *websocket.Conn
+	// generation is increased every time a connection is attached
+	generation    int
+	seq           int64
+	events        []protocol.Event
+	lastHeartbeat time.Time
+	expireTimer   *time.Timer
+	expired       bool
+}
+
+// writeJSON writes data that is not part of the event sequence, like errors and acks.
+// It is dropped while the session is suspended.
+func (c *client) writeJSON(data interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ws == nil {
+		return errSuspended
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteJSON(data)
+}
+
+// send numbers an event, keeps it for replays and writes it if the session is connected.
+func (c *client) send(event protocol.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return
+	}
+
+	c.seq++
+	event.Seq = c.seq
+	c.events = append(c.events, event)
+	if len(c.events) > maxReplayEvents {
+		c.events = c.events[len(c.events)-maxReplayEvents:]
+	}
+
+	if c.ws == nil {
+		return
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.ws.WriteJSON(event); err != nil {
+		log.Println("Error writing message to websocket:", err)
+	}
+}
+
+// close sends a close frame and closes the connection, which ends its read loop.
+func (c *client) close(code int, reason string) {
+	c.mu.Lock()
+	ws := c.ws
+	c.mu.Unlock()
+	if ws == nil {
+		return
+	}
+
+	err := ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	if err != nil {
+		log.Println("Error writing close message to websocket:", err)
+	}
+	ws.Close()
+}
+
+// Hub keeps track of every live connection, indexed by user and by the
+// servers the connection is subscribed to.
+type Hub struct {
+	mu       sync.RWMutex
+	sessions map[string]*client
+	users    map[int64]map[*client]bool
+	servers  map[int64]map[*client]bool
+}
+
+var hub = &Hub{
+	sessions: make(map[string]*client),
+	users:    make(map[int64]map[*client]bool),
+	servers:  make(map[int64]map[*client]bool),
+}
+
+// register adds the client to the hub and subscribes it to every server the user is a member of.
+func (h *Hub) register(c *client) error {
+	serverIds, err := memberServerIds(c.userId)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sessions[c.id] = c
+	addClient(h.users, c.userId, c)
+	for _, serverId := range serverIds {
+		addClient(h.servers, serverId, c)
+	}
+	return nil
+}
+
+// unregister removes the client from the hub and all of its subscriptions.
+func (h *Hub) unregister(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.sessions, c.id)
+	removeClient(h.users, c.userId, c)
+	for serverId := range h.servers {
+		removeClient(h.servers, serverId, c)
+	}
+}
+
+// broadcastToServer sends data to every connection subscribed to the server.
+func (h *Hub) broadcastToServer(serverId int64, data protocol.Event) {
+	h.mu.RLock()
+	targets := collectClients(h.servers[serverId])
+	h.mu.RUnlock()
+
+	writeToClients(targets, data)
+}
+
+// broadcastToServers sends data once to every connection subscribed to any of the servers
+// and to every connection of the given user.
+func (h *Hub) broadcastToServers(serverIds []int64, userId int64, data protocol.Event) {
+	h.mu.RLock()
+	set := make(map[*client]bool)
+	for _, serverId := range serverIds {
+		for c := range h.servers[serverId] {
+			set[c] = true
+		}
+	}
+	for c := range h.users[userId] {
+		set[c] = true
+	}
+	h.mu.RUnlock()
+
+	writeToClients(collectClients(set), data)
+}
+
+// broadcastToChannelViewers sends data to every connection whose user is allowed to view the channel.
+func (h *Hub) broadcastToChannelViewers(serverId int64, channelId int64, data protocol.Event) {
+	writeToClients(h.channelViewers(config.UseDBPool().DB, serverId, channelId), data)
+}
+
+// broadcastToOtherViewers is like broadcastToChannelViewers, but skips the connections of the given user.
+func (h *Hub) broadcastToOtherViewers(serverId int64, channelId int64, userId int64, data protocol.Event) {
+	viewers := h.channelViewers(config.UseDBPool().DB, serverId, channelId)
+	others := viewers[:0]
+	for _, c := range viewers {
+		if c.userId != userId {
+			others = append(others, c)
+		}
+	}
+	writeToClients(others, data)
+}
+
+// channelViewers returns the connections subscribed to the server whose user is allowed
+// to view the channel. For DMs and group DMs, which have no server (serverId 0),
+// every connection of the recipients is returned instead. Permissions are read through q,
+// so viewers can be resolved inside a transaction.
+func (h *Hub) channelViewers(q permissions.Querier, serverId int64, channelId int64) []*client {
+	if serverId == 0 {
+		return h.recipientClients(q, channelId)
+	}
+
+	h.mu.RLock()
+	targets := collectClients(h.servers[serverId])
+	h.mu.RUnlock()
+
+	canView := make(map[int64]bool)
+	viewers := targets[:0]
+	for _, c := range targets {
+		allowed, ok := canView[c.userId]
+		if !ok {
+			channelPermissions, _, err := permissions.ChannelPermissions(q, channelId, c.userId)
+			if err != nil && !errors.Is(err, permissions.ErrNotMember) {
+				log.Println("Error resolving channel permissions:", err)
+			}
+			allowed = err == nil && channelPermissions.Has(permissions.ViewChannel)
+			canView[c.userId] = allowed
+		}
+		if allowed {
+			viewers = append(viewers, c)
+		}
+	}
+	return viewers
+}
+
+// recipientClients returns every connection of the recipients of a private channel.
+func (h *Hub) recipientClients(q permissions.Querier, channelId int64) []*client {
+	recipients, err := channelRecipientIds(q, channelId)
+	if err != nil {
+		log.Println("Error looking up channel recipients:", err)
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var targets []*client
+	for _, userId := range recipients {
+		targets = append(targets, collectClients(h.users[userId])...)
+	}
+	return targets
+}
+
+// sendToUser sends data to every open connection of the user.
+func (h *Hub) sendToUser(userId int64, data protocol.Event) {
+	h.mu.RLock()
+	targets := collectClients(h.users[userId])
+	h.mu.RUnlock()
+
+	writeToClients(targets, data)
+}
+
+// BroadcastToServer sends an event to every connection subscribed to the server.
+func BroadcastToServer(serverId int64, eventType string, data interface{}) {
+	hub.broadcastToServer(serverId, protocol.Event{Type: eventType, Data: data})
+}
+
+// BroadcastToChannelViewers sends an event to every connection whose user may view the channel,
+// or to the recipients of a DM or group DM when serverId is 0.
+func BroadcastToChannelViewers(serverId int64, channelId int64, eventType string, data interface{}) {
+	hub.broadcastToChannelViewers(serverId, channelId, protocol.Event{Type: eventType, Data: data})
+}
+
+// SubscribeUserToServer subscribes all open connections of a user to a server,
+// e.g. after the user created or joined it.
+func SubscribeUserToServer(userId int64, serverId int64) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for c := range hub.users[userId] {
+		addClient(hub.servers, serverId, c)
+	}
+}
+
+// SendToUser sends an event to every open connection of a user.
+func SendToUser(userId int64, eventType string, data interface{}) {
+	hub.sendToUser(userId, protocol.Event{Type: eventType, Data: data})
+}
+
+// CloseSession closes every connection that was opened with the given auth session.
+// Their /wss sessions end right away and cannot be resumed.
+func CloseSession(sessionId string) {
+	hub.mu.RLock()
+	var targets []*client
+	for _, clients := range hub.users {
+		for c := range clients {
+			if c.sessionId == sessionId {
+				targets = append(targets, c)
+			}
+		}
+	}
+	hub.mu.RUnlock()
+
+	for _, c := range targets {
+		c.close(closeSessionRevoked, "session revoked")
+		c.expire()
+	}
+}
+
+func addClient(index map[int64]map[*client]bool, key int64, c *client) {
+	if index[key] == nil {
+		index[key] = make(map[*client]bool)
+	}
+	index[key][c] = true
+}
+
+func removeClient(index map[int64]map[*client]bool, key int64, c *client) {
+	if _, ok := index[key][c]; !ok {
+		return
+	}
+	delete(index[key], c)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+func collectClients(set map[*client]bool) []*client {
+	targets := make([]*client, 0, len(set))
+	for c := range set {
+		targets = append(targets, c)
+	}
+	return targets
+}
+
+func writeToClients(targets []*client, event protocol.Event) {
+	for _, c := range targets {
+		c.send(event)
+	}
+}
+
+func memberServerIds(userId int64) ([]int64, error) {
+	rows, err := config.UseDBPool().DB.Query("SELECT server_id FROM server_members WHERE user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}(rows)
+
+	var serverIds []int64
+	for rows.Next() {
+		var serverId int64
+		if err := rows.Scan(&serverId); err != nil {
+			return nil, err
+		}
+		serverIds = append(serverIds, serverId)
+	}
+	return serverIds, rows.Err()
+}
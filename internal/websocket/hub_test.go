@@ -0,0 +1,188 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+// newTestDB creates a migrated database and makes it the one the package uses.
+func newTestDB(t *testing.T) *config.DatabasePool {
+	t.Helper()
+	pool, err := config.NewDatabasePool(config.DatabaseConfig{Driver: "sqlite3", Source: filepath.Join(t.TempDir(), "test.sqlite"), MaxConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.DB.Close() })
+	if err := pool.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	config.InitDatabase(pool)
+	return pool
+}
+
+// exec runs setup statements for a test.
+func exec(t *testing.T, pool *config.DatabasePool, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := pool.DB.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connect opens a websocket to an in-process server and returns the server end and the client end.
+func connect(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- ws
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := <-accepted
+	t.Cleanup(func() {
+		peer.Close()
+		ws.Close()
+	})
+	return ws, peer
+}
+
+// registerClient connects a client of the user and registers it with the hub.
+func registerClient(t *testing.T, userId int64) (*client, *websocket.Conn) {
+	t.Helper()
+	ws, peer := connect(t)
+	c := &client{ws: ws, userId: userId}
+	if err := hub.register(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hub.unregister(c) })
+	return c, peer
+}
+
+// receive returns the type of the next message on the connection, or "" if none arrives in time.
+// The connection can't be read from anymore after nothing arrived.
+func receive(t *testing.T, peer *websocket.Conn) string {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	var message protocol.Event
+	if err := peer.ReadJSON(&message); err != nil {
+		return ""
+	}
+	return message.Type
+}
+
+func TestHubFanOut(t *testing.T) {
+	// Connections are named after their user; user 1 has two of them.
+	members := map[string]int64{"1a": 1, "1b": 1, "2": 2, "3": 3, "4": 4}
+
+	tests := []struct {
+		name    string
+		send    func()
+		receive []string
+	}{
+		{"server", func() { hub.broadcastToServer(10, protocol.Event{Type: "server"}) }, []string{"1a", "1b", "2"}},
+		{"other server", func() { hub.broadcastToServer(11, protocol.Event{Type: "other server"}) }, []string{"1a", "1b", "3"}},
+		{"server without connections", func() { hub.broadcastToServer(12, protocol.Event{Type: "server without connections"}) }, nil},
+		{"user", func() { hub.sendToUser(1, protocol.Event{Type: "user"}) }, []string{"1a", "1b"}},
+		{"user without servers", func() { hub.sendToUser(4, protocol.Event{Type: "user without servers"}) }, []string{"4"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestDB(t)
+			exec(t, pool, "INSERT INTO server_members (server_id, user_id) VALUES (10, 1), (11, 1), (10, 2), (11, 3)")
+			peers := make(map[string]*websocket.Conn)
+			for name, userId := range members {
+				_, peers[name] = registerClient(t, userId)
+			}
+
+			test.send()
+
+			var received []string
+			for name, peer := range peers {
+				switch messageType := receive(t, peer); messageType {
+				case "":
+				case test.name:
+					received = append(received, name)
+				default:
+					t.Errorf("%s received %q", name, messageType)
+				}
+			}
+			sort.Strings(received)
+			if strings.Join(received, ",") != strings.Join(test.receive, ",") {
+				t.Errorf("received by %v, want %v", received, test.receive)
+			}
+		})
+	}
+}
+
+func TestHubUnregister(t *testing.T) {
+	pool := newTestDB(t)
+	exec(t, pool, "INSERT INTO server_members (server_id, user_id) VALUES (10, 1)")
+	gone, gonePeer := registerClient(t, 1)
+	_, stayingPeer := registerClient(t, 1)
+
+	hub.unregister(gone)
+	hub.broadcastToServer(10, protocol.Event{Type: "server"})
+	hub.sendToUser(1, protocol.Event{Type: "user"})
+
+	if got := receive(t, stayingPeer); got != "server" {
+		t.Errorf("staying connection received %q, want server", got)
+	}
+	if got := receive(t, stayingPeer); got != "user" {
+		t.Errorf("staying connection received %q, want user", got)
+	}
+	if got := receive(t, gonePeer); got != "" {
+		t.Errorf("unregistered connection received %q", got)
+	}
+}
+
+func TestSubscribeUserToServer(t *testing.T) {
+	pool := newTestDB(t)
+	_, joinedPeer := registerClient(t, 1)
+	_, otherPeer := registerClient(t, 2)
+
+	// The user joined the server after connecting
+	exec(t, pool, "INSERT INTO server_members (server_id, user_id) VALUES (10, 1)")
+	SubscribeUserToServer(1, 10)
+	hub.broadcastToServer(10, protocol.Event{Type: "server"})
+
+	if got := receive(t, joinedPeer); got != "server" {
+		t.Errorf("joined user received %q, want server", got)
+	}
+	if got := receive(t, otherPeer); got != "" {
+		t.Errorf("other user received %q", got)
+	}
+}
+
+func TestBroadcastToChannelViewers(t *testing.T) {
+	pool := newMessageTestDB(t)
+	exec(t, pool, "UPDATE channel_overwrites SET deny = ? WHERE channel_id = ? AND target_id = ?", int64(permissions.ViewChannel), testChannelId, restrictedId)
+	_, memberPeer := registerClient(t, memberId)
+	_, restrictedPeer := registerClient(t, restrictedId)
+
+	BroadcastToChannelViewers(testServerId, testChannelId, "voice-state-update", nil)
+	if event := receive(t, memberPeer); event != "voice-state-update" {
+		t.Errorf("member received %q, want voice-state-update", event)
+	}
+	if event := receive(t, restrictedPeer); event != "" {
+		t.Errorf("member who may not view the channel received %q", event)
+	}
+}
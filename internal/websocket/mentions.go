@@ -0,0 +1,244 @@
+package websocket
+
+import (
+	"database/sql"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+// Types of the mentions stored in message_mentions.
+const (
+	mentionUser = iota
+	mentionRole
+	mentionChannel
+	mentionEveryone
+	mentionHere
+)
+
+// mentionPattern matches <@userId> (or <@!userId>), <@&roleId>, <#channelId>, @everyone and @here.
+var mentionPattern = regexp.MustCompile(`<@!?(-?\d+)>|<@&(-?\d+)>|<#(-?\d+)>|@(everyone|here)\b`)
+
+// Mentions are the users, roles and channels a message mentions. Only mentions that resolved
+// when the message was sent or edited are included: users must be able to see the conversation,
+// roles and channels must belong to its server, and @everyone, @here and roles that are not
+// mentionable need the mention everyone permission. Other mention syntax is left in the text as is.
+type Mentions struct {
+	Users    []string `json:"users"`
+	Roles    []string `json:"roles"`
+	Channels []string `json:"channels"`
+	Everyone bool     `json:"everyone"`
+	Here     bool     `json:"here"`
+}
+
+type mention struct {
+	mentionType int
+	targetId    int64
+}
+
+type mentionNotification struct {
+	MessageId string `json:"messageId"`
+	ChannelId string `json:"channelId"`
+	ServerId  string `json:"serverId"`
+	AuthorId  string `json:"authorId"`
+}
+
+func newMentions() Mentions {
+	return Mentions{Users: []string{}, Roles: []string{}, Channels: []string{}}
+}
+
+// parseMentions returns the mentions in a message text without duplicates, in order of appearance.
+func parseMentions(text string) []mention {
+	var mentions []mention
+	seen := make(map[mention]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		var m mention
+		switch {
+		case match[1] != "":
+			m.mentionType = mentionUser
+			m.targetId, _ = strconv.ParseInt(match[1], 10, 64)
+		case match[2] != "":
+			m.mentionType = mentionRole
+			m.targetId, _ = strconv.ParseInt(match[2], 10, 64)
+		case match[3] != "":
+			m.mentionType = mentionChannel
+			m.targetId, _ = strconv.ParseInt(match[3], 10, 64)
+		case match[4] == "everyone":
+			m.mentionType = mentionEveryone
+		default:
+			m.mentionType = mentionHere
+		}
+		if !seen[m] {
+			seen[m] = true
+			mentions = append(mentions, m)
+		}
+	}
+	return mentions
+}
+
+// saveMentions parses the mentions of a message, stores those the author may make and returns them.
+// Mentions stored for the message before are replaced.
+func saveMentions(tx *sql.Tx, serverId int64, channelId int64, authorId int64, messageId int64, text string) (Mentions, error) {
+	mentions := newMentions()
+	if _, err := tx.Exec("DELETE FROM message_mentions WHERE message_id = ?", messageId); err != nil {
+		return Mentions{}, err
+	}
+
+	candidates := parseMentions(text)
+	if len(candidates) == 0 {
+		return mentions, nil
+	}
+	authorPermissions, _, err := permissions.ChannelPermissions(tx, channelId, authorId)
+	if err != nil {
+		return Mentions{}, err
+	}
+	// DMs and group DMs have no roles, channels or @everyone to mention
+	canMentionEveryone := serverId != 0 && authorPermissions.Has(permissions.MentionEveryone)
+
+	for _, m := range candidates {
+		var valid bool
+		switch m.mentionType {
+		case mentionUser:
+			query := "SELECT EXISTS(SELECT 1 FROM server_members WHERE server_id = ? AND user_id = ?)"
+			args := []interface{}{serverId, m.targetId}
+			if serverId == 0 {
+				query, args = "SELECT EXISTS(SELECT 1 FROM channel_recipients WHERE channel_id = ? AND user_id = ?)", []interface{}{channelId, m.targetId}
+			}
+			err = tx.QueryRow(query, args...).Scan(&valid)
+		case mentionRole:
+			// The @everyone role shares the ID of its server and is mentioned as @everyone instead.
+			// Roles that are not mentionable can only be mentioned with the mention everyone permission
+			if serverId != 0 && m.targetId != serverId {
+				err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM roles WHERE role_id = ? AND server_id = ? AND (mentionable OR ?))", m.targetId, serverId, canMentionEveryone).Scan(&valid)
+			}
+		case mentionChannel:
+			if serverId != 0 {
+				err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM channels WHERE channel_id = ? AND server_id = ?)", m.targetId, serverId).Scan(&valid)
+			}
+		default:
+			valid = canMentionEveryone
+		}
+		if err != nil {
+			return Mentions{}, err
+		}
+		if !valid {
+			continue
+		}
+
+		_, err = tx.Exec("INSERT INTO message_mentions (message_id, mention_type, target_id) VALUES (?, ?, ?)", messageId, m.mentionType, m.targetId)
+		if err != nil {
+			return Mentions{}, err
+		}
+		mentions.add(m)
+	}
+	return mentions, nil
+}
+
+// MessageMentions returns the stored mentions of the given messages, keyed by message ID.
+// Every message has an entry, even without mentions.
+func MessageMentions(q permissions.Querier, messageIds []int64) (map[int64]Mentions, error) {
+	mentions := make(map[int64]Mentions)
+	if len(messageIds) == 0 {
+		return mentions, nil
+	}
+
+	args := make([]interface{}, len(messageIds))
+	for i, messageId := range messageIds {
+		args[i] = messageId
+		mentions[messageId] = newMentions()
+	}
+	rows, err := q.Query("SELECT message_id, mention_type, target_id FROM message_mentions WHERE message_id IN (?"+strings.Repeat(", ?", len(messageIds)-1)+") ORDER BY rowid", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageId int64
+		var m mention
+		if err := rows.Scan(&messageId, &m.mentionType, &m.targetId); err != nil {
+			return nil, err
+		}
+		messageMentions := mentions[messageId]
+		messageMentions.add(m)
+		mentions[messageId] = messageMentions
+	}
+	return mentions, rows.Err()
+}
+
+func (m *Mentions) add(mention mention) {
+	id := strconv.FormatInt(mention.targetId, 10)
+	switch mention.mentionType {
+	case mentionUser:
+		m.Users = append(m.Users, id)
+	case mentionRole:
+		m.Roles = append(m.Roles, id)
+	case mentionChannel:
+		m.Channels = append(m.Channels, id)
+	case mentionEveryone:
+		m.Everyone = true
+	case mentionHere:
+		m.Here = true
+	}
+}
+
+// notifyMentions sends a message-mention event to the connected users a server message mentions,
+// directly, through one of their roles or with @everyone or @here. The author is never notified.
+// In DMs and group DMs every message reaches the recipients anyway, so nothing is sent.
+func notifyMentions(serverId int64, channelId int64, authorId int64, message messageData) {
+	mentions := message.Mentions
+	if serverId == 0 || (len(mentions.Users) == 0 && len(mentions.Roles) == 0 && !mentions.Everyone && !mentions.Here) {
+		return
+	}
+
+	mentioned := make(map[int64]bool)
+	for _, userId := range mentions.Users {
+		id, _ := strconv.ParseInt(userId, 10, 64)
+		mentioned[id] = true
+	}
+	if len(mentions.Roles) > 0 {
+		roleMembers, err := roleMemberIds(config.UseDBPool().DB, mentions.Roles)
+		if err != nil {
+			log.Println("Error resolving mentioned roles:", err)
+		}
+		for _, userId := range roleMembers {
+			mentioned[userId] = true
+		}
+	}
+
+	var targets []*client
+	for _, c := range hub.channelViewers(config.UseDBPool().DB, serverId, channelId) {
+		if c.userId != authorId && (mentions.Everyone || mentions.Here || mentioned[c.userId]) {
+			targets = append(targets, c)
+		}
+	}
+
+	data := mentionNotification{MessageId: message.MessageId, ChannelId: message.ChannelId, ServerId: message.ServerId, AuthorId: message.Author.UserId}
+	writeToClients(targets, protocol.Event{Type: "message-mention", Data: data})
+}
+
+func roleMemberIds(q permissions.Querier, roleIds []string) ([]int64, error) {
+	args := make([]interface{}, len(roleIds))
+	for i, roleId := range roleIds {
+		args[i], _ = strconv.ParseInt(roleId, 10, 64)
+	}
+	rows, err := q.Query("SELECT DISTINCT user_id FROM member_roles WHERE role_id IN (?"+strings.Repeat(", ?", len(roleIds)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIds []int64
+	for rows.Next() {
+		var userId int64
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+	return userIds, rows.Err()
+}
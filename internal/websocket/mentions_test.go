@@ -0,0 +1,48 @@
+package websocket
+
+import (
+	"strings"
+	"testing"
+	"webserver/internal/permissions"
+)
+
+func TestRoleMentions(t *testing.T) {
+	const (
+		mentionableRoleId = 20
+		roleId            = 21
+		otherServerRoleId = 30
+	)
+
+	tests := []struct {
+		name            string
+		mentionEveryone bool
+		text            string
+		want            []string
+	}{
+		{"mentionable role", false, "<@&20>", []string{"20"}},
+		{"role that is not mentionable", false, "<@&21>", nil},
+		{"with mention everyone", true, "<@&20> <@&21>", []string{"20", "21"}},
+		{"@everyone role", true, "<@&10>", nil},
+		{"role of another server", true, "<@&30>", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newMessageTestDB(t)
+			exec(t, pool, "INSERT INTO servers (server_id, server_name) VALUES (11, 'other')")
+			exec(t, pool, "INSERT INTO roles (role_id, server_id, role_name, position, mentionable) VALUES (?, ?, 'mentionable', 1, true), (?, ?, 'role', 2, false), (?, 11, 'other', 1, true)",
+				mentionableRoleId, testServerId, roleId, testServerId, otherServerRoleId)
+			if test.mentionEveryone {
+				exec(t, pool, "UPDATE roles SET permissions = ? WHERE role_id = ?", int64(permissions.Default|permissions.MentionEveryone), testServerId)
+			}
+
+			message, _, err := saveMessage(memberId, testChannelId, test.text, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(message.Mentions.Roles, ","); got != strings.Join(test.want, ",") {
+				t.Errorf("mentioned roles %v, want %v", message.Mentions.Roles, test.want)
+			}
+		})
+	}
+}
@@ -6,8 +6,7 @@ import (
 	"webserver/internal/config"
 )
 
-func setUserOnline(request webSocketRequest) error {
-	userId := request.Data["userId"]
+func setUserOnline(userId int64) error {
 	tx, err := config.UseDBPool().DB.Begin()
 	if err != nil {
 		return err
@@ -0,0 +1,229 @@
+package websocket
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/protocol"
+)
+
+// Appearance is the status a user picked for themselves, stored in users.appearance.
+const (
+	AppearanceOnline    = 1
+	AppearanceIdle      = 2
+	AppearanceDnd       = 3
+	AppearanceInvisible = 4
+)
+
+// Presence statuses as seen by other users. Invisible users appear offline.
+const (
+	StatusOnline  = "online"
+	StatusIdle    = "idle"
+	StatusDnd     = "dnd"
+	StatusOffline = "offline"
+)
+
+const (
+	// idleAfter is how long a user may go without any activity before appearing idle.
+	idleAfter         = 5 * time.Minute
+	idleCheckInterval = 30 * time.Second
+)
+
+type presenceData struct {
+	UserId string `json:"userId"`
+	Status string `json:"status"`
+}
+
+type userPresence struct {
+	connections  int
+	appearance   uint8
+	lastActivity time.Time
+	status       string
+}
+
+// presenceService tracks the users with at least one open /wss connection in memory
+// and tells everyone who shares a server with them when their status changes.
+type presenceService struct {
+	mu    sync.Mutex
+	users map[int64]*userPresence
+}
+
+var presence = &presenceService{users: make(map[int64]*userPresence)}
+
+// StartPresence resets the online flag of every user, which is stale after a crash or
+// restart since no connections survive it, and starts the idle detection.
+func StartPresence() error {
+	_, err := config.UseDBPool().DB.Exec("UPDATE users SET online = false, last_seen = ? WHERE online = true", time.Now())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(idleCheckInterval) {
+			presence.checkIdle()
+		}
+	}()
+	return nil
+}
+
+// PresenceOf returns the status of a user as seen by other users.
+func PresenceOf(userId int64) string {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+
+	if p, ok := presence.users[userId]; ok {
+		return p.status
+	}
+	return StatusOffline
+}
+
+// connect registers a new connection of the user. The first connection marks the user online.
+func (s *presenceService) connect(userId int64) error {
+	s.mu.Lock()
+	p, ok := s.users[userId]
+	if ok {
+		p.connections++
+		p.lastActivity = time.Now()
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	var appearance sql.NullInt64
+	err := config.UseDBPool().DB.QueryRow("SELECT appearance FROM users WHERE user_id = ?", userId).Scan(&appearance)
+	if err != nil {
+		return err
+	}
+	if err := setUserOnline(userId); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	p, ok = s.users[userId]
+	if !ok {
+		p = &userPresence{appearance: uint8(appearance.Int64), status: StatusOffline}
+		s.users[userId] = p
+	}
+	p.connections++
+	p.lastActivity = time.Now()
+	update := s.refresh(userId, p)
+	s.mu.Unlock()
+
+	publishPresence(userId, update)
+	return nil
+}
+
+// disconnect removes a connection of the user. Closing the last one marks the user offline.
+func (s *presenceService) disconnect(userId int64) error {
+	s.mu.Lock()
+	p, ok := s.users[userId]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	p.connections--
+	if p.connections > 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.users, userId)
+	wasVisible := p.status != StatusOffline
+	s.mu.Unlock()
+
+	if wasVisible {
+		publishPresence(userId, StatusOffline)
+	}
+	return setUserOffline(userId)
+}
+
+// touch records activity of the user, which ends an automatic idle status.
+func (s *presenceService) touch(userId int64) {
+	s.mu.Lock()
+	p, ok := s.users[userId]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	p.lastActivity = time.Now()
+	update := s.refresh(userId, p)
+	s.mu.Unlock()
+
+	publishPresence(userId, update)
+}
+
+// setAppearance applies a new appearance picked by the user.
+func (s *presenceService) setAppearance(userId int64, appearance uint8) {
+	s.mu.Lock()
+	p, ok := s.users[userId]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	p.appearance = appearance
+	p.lastActivity = time.Now()
+	update := s.refresh(userId, p)
+	s.mu.Unlock()
+
+	publishPresence(userId, update)
+}
+
+func (s *presenceService) checkIdle() {
+	s.mu.Lock()
+	updates := make(map[int64]string)
+	for userId, p := range s.users {
+		if update := s.refresh(userId, p); update != "" {
+			updates[userId] = update
+		}
+	}
+	s.mu.Unlock()
+
+	for userId, update := range updates {
+		publishPresence(userId, update)
+	}
+}
+
+// refresh recomputes the status of a user and returns it if it changed, or "" otherwise.
+// The caller must hold s.mu.
+func (s *presenceService) refresh(userId int64, p *userPresence) string {
+	status := deriveStatus(p.appearance, p.lastActivity)
+	if status == p.status {
+		return ""
+	}
+	p.status = status
+	return status
+}
+
+func deriveStatus(appearance uint8, lastActivity time.Time) string {
+	switch appearance {
+	case AppearanceInvisible:
+		return StatusOffline
+	case AppearanceDnd:
+		return StatusDnd
+	case AppearanceIdle:
+		return StatusIdle
+	}
+	if time.Since(lastActivity) > idleAfter {
+		return StatusIdle
+	}
+	return StatusOnline
+}
+
+// publishPresence sends a presence-update to every connection that shares a server with the
+// user, including the user's own connections. An empty status means nothing changed.
+func publishPresence(userId int64, status string) {
+	if status == "" {
+		return
+	}
+
+	serverIds, err := memberServerIds(userId)
+	if err != nil {
+		log.Println("Error looking up servers for presence update:", err)
+		return
+	}
+
+	data := protocol.Event{Type: "presence-update", Data: presenceData{UserId: strconv.FormatInt(userId, 10), Status: status}}
+	hub.broadcastToServers(serverIds, userId, data)
+}
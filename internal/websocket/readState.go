@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+// ReadState tells a user how far they have read a channel.
+type ReadState struct {
+	ChannelId         string `json:"channelId"`
+	LastReadMessageId string `json:"lastReadMessageId,omitempty"`
+	UnreadCount       int    `json:"unreadCount"`
+	MentionCount      int    `json:"mentionCount"`
+}
+
+// readStateQuery counts the messages of other users after the last read message. Messages that
+// mention the user, directly, through one of their roles or with @everyone or @here, count as
+// mentions; in DMs and group DMs every message does. Without a read state every message of
+// the channel is unread. It takes the user ID four times, followed by its own arguments.
+const readStateQuery = `SELECT c.channel_id, rs.last_message_id, COUNT(m.message_id),
+		COUNT(CASE WHEN c.server_id IS NULL OR EXISTS(SELECT 1 FROM message_mentions mm WHERE mm.message_id = m.message_id AND (
+			mm.mention_type IN (3, 4)
+			OR (mm.mention_type = 0 AND mm.target_id = ?)
+			OR (mm.mention_type = 1 AND mm.target_id IN (SELECT role_id FROM member_roles WHERE user_id = ?)))) THEN m.message_id END)
+	FROM channels c
+	LEFT JOIN read_states rs ON rs.channel_id = c.channel_id AND rs.user_id = ?
+	LEFT JOIN messages m ON m.channel_id = c.channel_id AND m.user_id != ? AND m.deleted_at IS NULL
+		AND (rs.last_message_id IS NULL OR (m.sent_at, m.message_id) > (SELECT sent_at, message_id FROM messages WHERE message_id = rs.last_message_id))`
+
+// AckMessage marks the messages of a channel up to and including messageId as read.
+// Acking an older message marks the messages after it as unread again.
+// The new read state is sent to every connection of the user.
+func AckMessage(userId int64, channelId int64, messageId int64) (ReadState, error) {
+	var state ReadState
+	err := config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		_, err := permissions.CheckChannelPermission(tx, channelId, userId, permissions.ViewChannel|permissions.ReadMessageHistory)
+		if err != nil {
+			return err
+		}
+
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM messages WHERE message_id = ? AND channel_id = ?)", messageId, channelId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrMessageNotFound
+		}
+
+		_, err = tx.Exec(`INSERT INTO read_states (user_id, channel_id, last_message_id, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, channel_id) DO UPDATE SET last_message_id = excluded.last_message_id, updated_at = excluded.updated_at`,
+			userId, channelId, messageId, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		state, err = scanReadState(tx.QueryRow(readStateQuery+" WHERE c.channel_id = ? GROUP BY c.channel_id", userId, userId, userId, userId, channelId))
+		return err
+	})
+	if err != nil {
+		return ReadState{}, err
+	}
+
+	hub.sendToUser(userId, protocol.Event{Type: "read-state-update", Data: state})
+	return state, nil
+}
+
+// ServerReadStates returns the read states of the user for every channel of a server, keyed by channel ID.
+// It does not check which channels the user can view.
+func ServerReadStates(q permissions.Querier, userId int64, serverId int64) (map[int64]ReadState, error) {
+	rows, err := q.Query(readStateQuery+" WHERE c.server_id = ? GROUP BY c.channel_id", userId, userId, userId, userId, serverId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[int64]ReadState)
+	for rows.Next() {
+		state, err := scanReadState(rows)
+		if err != nil {
+			return nil, err
+		}
+		channelId, _ := strconv.ParseInt(state.ChannelId, 10, 64)
+		states[channelId] = state
+	}
+	return states, rows.Err()
+}
+
+// ackMessage handles the ack event, the socket equivalent of POST /api/channels/{channelId}/messages/{messageId}/ack.
+func ackMessage(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.AckMessage](request)
+	if err != nil {
+		return nil, err
+	}
+	return AckMessage(c.userId, int64(data.ChannelId), int64(data.MessageId))
+}
+
+func scanReadState(row rowScanner) (ReadState, error) {
+	var state ReadState
+	var channelId int64
+	var lastMessageId sql.NullInt64
+	if err := row.Scan(&channelId, &lastMessageId, &state.UnreadCount, &state.MentionCount); err != nil {
+		return ReadState{}, err
+	}
+	state.ChannelId = strconv.FormatInt(channelId, 10)
+	if lastMessageId.Valid {
+		state.LastReadMessageId = strconv.FormatInt(lastMessageId.Int64, 10)
+	}
+	return state, nil
+}
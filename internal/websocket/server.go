@@ -1,3 +0,0 @@
-package websocket
-
-//func saveNewChannel
@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"log"
+	"time"
+	"webserver/internal/protocol"
+)
+
+const (
+	// maxReplayEvents is how many events a session keeps for replaying them on resume.
+	maxReplayEvents = 500
+	// resumeTimeout is how long a session whose connection dropped can be resumed.
+	resumeTimeout = 2 * time.Minute
+)
+
+var errSuspended = errors.New("session is suspended")
+
+type helloData struct {
+	ProtocolVersion   int    `json:"protocolVersion"`
+	HeartbeatInterval int64  `json:"heartbeatInterval"`
+	SessionId         string `json:"sessionId"`
+	Resumed           bool   `json:"resumed"`
+}
+
+type invalidSessionData struct {
+	Reason string `json:"reason"`
+}
+
+// newClient starts a /wss session for a user, greets the connection and marks the user online.
+func newClient(ws *websocket.Conn, userId int64, sessionId string) (*client, error) {
+	c := &client{id: uuid.NewString(), userId: userId, sessionId: sessionId, ws: ws, generation: 1}
+	if err := hub.register(c); err != nil {
+		return nil, err
+	}
+	if err := c.hello(false); err != nil {
+		hub.unregister(c)
+		return nil, err
+	}
+	if err := presence.connect(userId); err != nil {
+		hub.unregister(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// hello greets a new connection with the protocol version, the heartbeat interval and the ID to resume its session with.
+func (c *client) hello(resumed bool) error {
+	return c.writeJSON(protocol.Event{Type: "hello", Data: c.helloData(resumed)})
+}
+
+func (c *client) helloData(resumed bool) helloData {
+	return helloData{ProtocolVersion: protocol.Version, HeartbeatInterval: heartbeatInterval.Milliseconds(), SessionId: c.id, Resumed: resumed}
+}
+
+// resume attaches a new connection to a suspended session and replays every event after lastSeq.
+// If the session is still connected, the old connection is replaced. An error is returned if
+// the session expired, belongs to another login session, the missed events are no longer
+// buffered or they could not be written; the client then has to re-sync.
+func (c *client) resume(ws *websocket.Conn, userId int64, sessionId string, lastSeq int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Sessions are only resumed by the login session that started them, so logging out
+	// ends them through CloseSession.
+	if c.expired || c.userId != userId || c.sessionId != sessionId {
+		return 0, errors.New("the session has expired")
+	}
+	firstBuffered := c.seq - int64(len(c.events)) + 1
+	if lastSeq > c.seq || lastSeq+1 < firstBuffered {
+		return 0, fmt.Errorf("the events after %d are no longer available", lastSeq)
+	}
+
+	// The session is only changed once the new connection received the hello and the replay,
+	// so a connection that breaks right away leaves it connected or suspended as it was
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := ws.WriteJSON(protocol.Event{Type: "hello", Data: c.helloData(true)}); err != nil {
+		return 0, err
+	}
+	for _, event := range c.events {
+		if event.Seq <= lastSeq {
+			continue
+		}
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := ws.WriteJSON(event); err != nil {
+			return 0, err
+		}
+	}
+
+	if c.ws != nil {
+		c.ws.Close()
+	}
+	if c.expireTimer != nil {
+		c.expireTimer.Stop()
+		c.expireTimer = nil
+	}
+	c.ws = ws
+	c.generation++
+	c.lastHeartbeat = time.Now()
+	return c.generation, nil
+}
+
+// suspend detaches the connection of the given generation. A resumable session keeps
+// collecting events until it is resumed or resumeTimeout has passed; any other ends right away.
+func (c *client) suspend(generation int, resumable bool) {
+	c.mu.Lock()
+	if c.generation != generation || c.expired {
+		c.mu.Unlock()
+		return
+	}
+	c.ws = nil
+	if resumable {
+		c.expireTimer = time.AfterFunc(resumeTimeout, func() { c.expireSuspended(generation) })
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	c.expire()
+}
+
+func (c *client) expireSuspended(generation int) {
+	c.mu.Lock()
+	suspended := c.ws == nil && c.generation == generation
+	c.mu.Unlock()
+
+	if suspended {
+		c.expire()
+	}
+}
+
+// expire ends the session: it is removed from the hub and the user's presence.
+func (c *client) expire() {
+	c.mu.Lock()
+	if c.expired {
+		c.mu.Unlock()
+		return
+	}
+	c.expired = true
+	c.events = nil
+	if c.expireTimer != nil {
+		c.expireTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	hub.unregister(c)
+	if err := presence.disconnect(c.userId); err != nil {
+		log.Println("Error updating presence:", err)
+	}
+}
+
+func (h *Hub) session(id string) *client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sessions[id]
+}
@@ -0,0 +1,227 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"webserver/internal/protocol"
+)
+
+// startServer serves /wss sessions of the user and login session given in the query, without authentication.
+// Every session still in the hub is expired when the test ends.
+func startServer(t *testing.T) string {
+	t.Helper()
+	t.Cleanup(func() {
+		hub.mu.RLock()
+		sessions := collectSessions(hub.sessions)
+		hub.mu.RUnlock()
+		for _, c := range sessions {
+			c.expire()
+		}
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		userId, _ := strconv.ParseInt(r.URL.Query().Get("user"), 10, 64)
+		lastSeq, _ := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+		handleWebSocket(ws, userId, "login session "+r.URL.Query().Get("login"), r.URL.Query().Get("resume"), lastSeq)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func collectSessions(sessions map[string]*client) []*client {
+	clients := make([]*client, 0, len(sessions))
+	for _, c := range sessions {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// dial opens a /wss connection of the user and returns it after it was greeted.
+func dial(t *testing.T, url string, userId int64, query string) (*websocket.Conn, helloData) {
+	t.Helper()
+	peer, _, err := websocket.DefaultDialer.Dial(url+"?user="+strconv.FormatInt(userId, 10)+"&"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	var hello struct {
+		Type string    `json:"type"`
+		Data helloData `json:"data"`
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if err := peer.ReadJSON(&hello); err != nil || hello.Type != "hello" {
+		t.Fatalf("first message = %q, %v, want hello", hello.Type, err)
+	}
+	return peer, hello.Data
+}
+
+// next returns the next message on the connection and fails the test if none arrives.
+func next(t *testing.T, peer *websocket.Conn) protocol.Event {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var message protocol.Event
+	if err := peer.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestResume(t *testing.T) {
+	// Before the connection drops the session received the presence update of
+	// the user (1) and two events (2, 3); it missed two more (4, 5) afterwards.
+	tests := []struct {
+		name   string
+		userId int64
+		// login is the login session the resuming connection was opened with, "" is the one that started the session.
+		login    string
+		resumeId string
+		lastSeq  int64
+		replay   []int64
+		resumed  bool
+	}{
+		{"missed events", 1, "", "", 3, []int64{4, 5}, true},
+		{"received events again", 1, "", "", 1, []int64{2, 3, 4, 5}, true},
+		{"nothing missed", 1, "", "", 5, nil, true},
+		{"seq ahead of the session", 1, "", "", 6, nil, false},
+		{"session of another user", 2, "", "", 3, nil, false},
+		{"session of another login session", 1, "other", "", 3, nil, false},
+		{"unknown session", 1, "", "unknown", 3, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestDB(t)
+			exec(t, pool, "INSERT INTO users (user_id, username) VALUES (1, 'one'), (2, 'two')")
+			url := startServer(t)
+
+			peer, hello := dial(t, url, 1, "")
+			if message := next(t, peer); message.Type != "presence-update" || message.Seq != 1 {
+				t.Fatalf("received %q with seq %d, want presence-update with seq 1", message.Type, message.Seq)
+			}
+			SendToUser(1, "before", nil)
+			SendToUser(1, "before", nil)
+			for seq := int64(2); seq <= 3; seq++ {
+				if message := next(t, peer); message.Seq != seq {
+					t.Fatalf("received seq %d, want %d", message.Seq, seq)
+				}
+			}
+			peer.Close()
+			SendToUser(1, "missed", nil)
+			SendToUser(1, "missed", nil)
+
+			resumeId := test.resumeId
+			if resumeId == "" {
+				resumeId = hello.SessionId
+			}
+			resumedPeer, resumedHello := dial(t, url, test.userId, "login="+test.login+"&resume="+resumeId+"&seq="+strconv.FormatInt(test.lastSeq, 10))
+			if resumedHello.Resumed != test.resumed || (resumedHello.SessionId == hello.SessionId) != test.resumed {
+				t.Fatalf("hello = %+v, want resumed %v of session %s", resumedHello, test.resumed, hello.SessionId)
+			}
+
+			if !test.resumed {
+				// A new session is started, which is told to re-sync
+				message := next(t, resumedPeer)
+				if message.Type == "presence-update" {
+					message = next(t, resumedPeer)
+				}
+				if message.Type != "invalid-session" {
+					t.Errorf("received %q, want invalid-session", message.Type)
+				}
+				return
+			}
+			for _, seq := range test.replay {
+				if message := next(t, resumedPeer); message.Seq != seq {
+					t.Fatalf("replayed seq %d, want %d", message.Seq, seq)
+				}
+			}
+			SendToUser(1, "after", nil)
+			if message := next(t, resumedPeer); message.Type != "after" || message.Seq != 6 {
+				t.Errorf("received %q with seq %d after resuming, want after with seq 6", message.Type, message.Seq)
+			}
+		})
+	}
+}
+
+func TestResumeReplacesConnection(t *testing.T) {
+	pool := newTestDB(t)
+	exec(t, pool, "INSERT INTO users (user_id, username) VALUES (1, 'one')")
+	url := startServer(t)
+
+	oldPeer, hello := dial(t, url, 1, "")
+	next(t, oldPeer) // presence-update
+	newPeer, resumedHello := dial(t, url, 1, "resume="+hello.SessionId+"&seq=1")
+	if !resumedHello.Resumed {
+		t.Fatalf("hello = %+v, want resumed", resumedHello)
+	}
+
+	// The session lives on in the new connection while the old one is closed
+	oldPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := oldPeer.ReadMessage(); err == nil {
+		t.Error("old connection is still open")
+	}
+	SendToUser(1, "event", nil)
+	if message := next(t, newPeer); message.Type != "event" || message.Seq != 2 {
+		t.Errorf("received %q with seq %d, want event with seq 2", message.Type, message.Seq)
+	}
+}
+
+func TestResumeWriteFails(t *testing.T) {
+	tests := []struct {
+		name      string
+		suspended bool
+	}{
+		{"connected session", false},
+		{"suspended session", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestDB(t)
+			exec(t, pool, "INSERT INTO users (user_id, username) VALUES (1, 'one')")
+			ws, peer := connect(t)
+			c, err := newClient(ws, 1, "login session")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(c.expire)
+			if test.suspended {
+				c.suspend(1, true)
+			}
+
+			broken, _ := connect(t)
+			broken.Close()
+			if _, err := c.resume(broken, 1, "login session", 0); err == nil {
+				t.Fatal("resume() on a broken connection succeeded")
+			}
+
+			c.mu.Lock()
+			generation, attached, expiring, expired := c.generation, c.ws, c.expireTimer != nil, c.expired
+			c.mu.Unlock()
+			if generation != 1 || expired || hub.session(c.id) != c {
+				t.Fatalf("session has generation %d, expired %v and is registered %v after a failed resume", generation, expired, hub.session(c.id) == c)
+			}
+			if test.suspended {
+				if attached != nil || !expiring {
+					t.Error("suspended session lost its connection state or expiry")
+				}
+				return
+			}
+			if attached != ws {
+				t.Fatal("connected session lost its connection")
+			}
+			SendToUser(1, "event", nil)
+			for message := next(t, peer); message.Type != "event"; message = next(t, peer) {
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package websocket
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
+)
+
+const (
+	// typingTimeout is how long a user is shown as typing unless they send another typing-start.
+	typingTimeout = 10 * time.Second
+	// A user may send at most maxTypingStarts typing-start requests per typingRateWindow.
+	typingRateWindow = 10 * time.Second
+	maxTypingStarts  = 5
+)
+
+var ErrRateLimited = errors.New("you are sending requests too fast")
+
+type typingData struct {
+	ChannelId string `json:"channelId"`
+	ServerId  string `json:"serverId,omitempty"`
+	UserId    string `json:"userId"`
+}
+
+type typingKey struct {
+	userId    int64
+	channelId int64
+}
+
+type typingState struct {
+	serverId int64
+	timer    *time.Timer
+}
+
+// typingService tracks who is typing in which channel. Like presence it only lives in memory,
+// typing indicators are never written to the database.
+type typingService struct {
+	mu     sync.Mutex
+	typing map[typingKey]*typingState
+	// starts counts the typing-start requests of each user in the current rate window
+	starts map[int64]int
+}
+
+var typing = &typingService{typing: make(map[typingKey]*typingState), starts: make(map[int64]int)}
+
+// startTyping handles the typing-start event. The other viewers of the channel are told that
+// the user is typing until typingTimeout passes, the user sends a message or starts typing again.
+func startTyping(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.TypingStart](request)
+	if err != nil {
+		return nil, err
+	}
+	if !typing.allow(c.userId) {
+		return nil, ErrRateLimited
+	}
+
+	channelId := int64(data.ChannelId)
+	serverId, err := permissions.CheckChannelPermission(config.UseDBPool().DB, channelId, c.userId, permissions.ViewChannel|permissions.SendMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	typing.start(c.userId, channelId, serverId)
+	return nil, nil
+}
+
+// allow counts a typing-start request of the user and reports whether it is within the rate limit.
+func (s *typingService) allow(userId int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := s.starts[userId]
+	if count >= maxTypingStarts {
+		return false
+	}
+	if count == 0 {
+		time.AfterFunc(typingRateWindow, func() {
+			s.mu.Lock()
+			delete(s.starts, userId)
+			s.mu.Unlock()
+		})
+	}
+	s.starts[userId] = count + 1
+	return true
+}
+
+// start marks the user as typing in the channel, or extends it if they already are.
+func (s *typingService) start(userId int64, channelId int64, serverId int64) {
+	key := typingKey{userId: userId, channelId: channelId}
+	state := &typingState{serverId: serverId}
+
+	s.mu.Lock()
+	if previous, ok := s.typing[key]; ok {
+		previous.timer.Stop()
+	}
+	state.timer = time.AfterFunc(typingTimeout, func() { s.expire(key, state) })
+	s.typing[key] = state
+	s.mu.Unlock()
+
+	publishTyping("typing-start", key, serverId)
+}
+
+// stop clears the typing indicator of the user in the channel, e.g. because they sent their message.
+func (s *typingService) stop(userId int64, channelId int64) {
+	key := typingKey{userId: userId, channelId: channelId}
+
+	s.mu.Lock()
+	state, ok := s.typing[key]
+	if ok {
+		state.timer.Stop()
+		delete(s.typing, key)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		publishTyping("typing-stop", key, state.serverId)
+	}
+}
+
+func (s *typingService) expire(key typingKey, state *typingState) {
+	s.mu.Lock()
+	current := s.typing[key] == state
+	if current {
+		delete(s.typing, key)
+	}
+	s.mu.Unlock()
+
+	if current {
+		publishTyping("typing-stop", key, state.serverId)
+	}
+}
+
+func publishTyping(eventType string, key typingKey, serverId int64) {
+	data := typingData{
+		ChannelId: strconv.FormatInt(key.channelId, 10),
+		ServerId:  formatServerId(serverId),
+		UserId:    strconv.FormatInt(key.userId, 10),
+	}
+	hub.broadcastToOtherViewers(serverId, key.channelId, key.userId, protocol.Event{Type: eventType, Data: data})
+}
@@ -1,41 +1,71 @@
 package websocket
 
 import (
+	"database/sql"
 	"errors"
 	"log"
-	"net/http"
 	"strconv"
+	"time"
 	"webserver/internal/config"
+	"webserver/internal/permissions"
+	"webserver/internal/protocol"
 )
 
-func setAppearance(request webSocketRequest) error {
-	var userId, _ = strconv.ParseInt(request.Data["userId"].(string), 10, 64)
-	appearance := request.Data["appearance"].(int8)
+var ErrUserNotFound = errors.New("user not found")
+
+type userProfile struct {
+	UserId      string    `json:"userId"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"displayName"`
+	Bio         string    `json:"bio"`
+	Status      string    `json:"status"`
+	Pronouns    string    `json:"pronouns"`
+	Img         string    `json:"img"`
+	JoinedAt    time.Time `json:"joinedAt"`
+	Presence    string    `json:"presence"`
+}
+
+func setAppearance(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.UpdateAppearance](request)
+	if err != nil {
+		return nil, err
+	}
+
 	tx, err := config.UseDBPool().DB.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// Deferred first so it runs after the commit below
+	defer func() {
+		if err == nil {
+			presence.setAppearance(c.userId, data.Appearance)
+		}
+	}()
+
 	defer func() {
 		if err := config.UseDBPool().RollbackOrCommit(tx, err == nil); err != nil {
 			log.Println("Error rolling back transaction:", err)
 		}
 	}()
 
-	_, err = tx.Exec("UPDATE users SET appearance = ? WHERE user_id == ?", userId, appearance)
+	_, err = tx.Exec("UPDATE users SET appearance = ? WHERE user_id == ?", data.Appearance, c.userId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return nil, nil
 }
 
-func setStatus(request webSocketRequest) (error, int) {
-	var userId, _ = strconv.ParseInt(request.Data["userId"].(string), 10, 64)
-	status := request.Data["status"].(string)
+func setStatus(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.UpdateStatus](request)
+	if err != nil {
+		return nil, err
+	}
+
 	tx, err := config.UseDBPool().DB.Begin()
 	if err != nil {
-		return err, http.StatusInternalServerError
+		return nil, err
 	}
 
 	defer func() {
@@ -44,48 +74,23 @@ func setStatus(request webSocketRequest) (error, int) {
 		}
 	}()
 
-	if len(status) <= 128 {
-		_, err = tx.Exec("UPDATE users SET status = ? WHERE user_id == ?", userId, status)
-		if err != nil {
-			return err, http.StatusInternalServerError
-		}
-	} else {
-		return errors.New("status message exceeds the amount of 128 characters"), http.StatusBadRequest
+	_, err = tx.Exec("UPDATE users SET status = ? WHERE user_id == ?", data.Status, c.userId)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, http.StatusOK
+	return nil, nil
 }
 
-func setPronouns(request webSocketRequest) (error, int) {
-	var userId, _ = strconv.ParseInt(request.Data["userId"].(string), 10, 64)
-	pronouns := request.Data["pronouns"].(string)
-	tx, err := config.UseDBPool().DB.Begin()
+func setPronouns(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.UpdatePronouns](request)
 	if err != nil {
-		return err, http.StatusInternalServerError
+		return nil, err
 	}
 
-	defer func() {
-		if err := config.UseDBPool().RollbackOrCommit(tx, err == nil); err != nil {
-			log.Println("Error rolling back transaction:", err)
-		}
-	}()
-	if len(pronouns) <= 40 {
-		_, err = tx.Exec("UPDATE users SET pronouns = ? WHERE user_id == ?", userId, pronouns)
-		if err != nil {
-			return err, http.StatusInternalServerError
-		}
-	} else {
-		return errors.New("pronouns exceed the number of 40 characters"), http.StatusBadRequest
-	}
-	return nil, http.StatusOK
-}
-
-func getUserProfile(request webSocketRequest) error {
-	var userId, _ = strconv.ParseInt(request.Data["userId"].(string), 10, 64)
-
 	tx, err := config.UseDBPool().DB.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer func() {
@@ -94,27 +99,46 @@ func getUserProfile(request webSocketRequest) error {
 		}
 	}()
 
-	row, err := tx.Query("SELECT * FROM users WHERE user_id = ?", userId)
+	_, err = tx.Exec("UPDATE users SET pronouns = ? WHERE user_id == ?", data.Pronouns, c.userId)
+	if err != nil {
+		return nil, err
+	}
 
-	defer func() {
-		err := row.Close()
-		if err != nil {
-			log.Println(err)
-			return
+	return nil, nil
+}
+
+// getUserProfile handles the user-profile event. The profile is sent back in the ack;
+// users can only look up themselves and users they share a server with.
+func getUserProfile(c *client, request protocol.Request) (interface{}, error) {
+	data, err := protocol.Decode[protocol.UserProfile](request)
+	if err != nil {
+		return nil, err
+	}
+	userId := int64(data.UserId)
+
+	var profile userProfile
+	err = config.UseDBPool().WithTx(func(tx *sql.Tx) error {
+		if userId != c.userId {
+			if err := requireSharedServer(tx, c.userId, userId); err != nil {
+				if errors.Is(err, permissions.ErrMissingPermission) {
+					return ErrUserNotFound
+				}
+				return err
+			}
 		}
-	}()
 
-	/*if row.Next() {
-		var username string
-		var pronouns string
-		var bio string
-		var joinedAt string
-		row.Scan()
-		if err != nil {
-			log.Println(err)
-			return err, http.StatusInternalServerError
+		err := tx.QueryRow("SELECT username, COALESCE(display_name, ''), COALESCE(bio, ''), COALESCE(status, ''), COALESCE(pronouns, ''), COALESCE(img_url, ''), joined_at FROM users WHERE user_id = ?", userId).
+			Scan(&profile.Username, &profile.DisplayName, &profile.Bio, &profile.Status, &profile.Pronouns, &profile.Img, &profile.JoinedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
 		}
-	}*/
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	profile.UserId = strconv.FormatInt(userId, 10)
+	profile.Presence = PresenceOf(userId)
+	return profile, nil
 }
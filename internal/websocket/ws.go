@@ -1,20 +1,37 @@
 package websocket
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
+	"webserver/internal/auth"
+	"webserver/internal/protocol"
 )
 
-type webSocketRequest struct {
-	Type string                 `json:"type"`
-	Data map[string]interface{} `json:"data"`
-}
+// handlerFunc handles a request of a client. The returned data is sent back in the ack.
+type handlerFunc func(c *client, request protocol.Request) (interface{}, error)
 
-type webSocketError struct {
-	Status     int    `json:"status"`
-	StatusText string `json:"statusText"`
+var handlers = map[string]handlerFunc{
+	// Sent by clients on user input without anything else to send, see handleRequest
+	"alive":             func(*client, protocol.Request) (interface{}, error) { return nil, nil },
+	"update-appearance": setAppearance,
+	"update-status":     setStatus,
+	"update-pronouns":   setPronouns,
+	"onmessage":         sendMessage,
+	"edit-message":      editMessage,
+	"delete-message":    deleteMessage,
+	"role-update":       updateRole,
+	"new-channel":       saveNewChannel,
+	"new-thread":        saveNewThread,
+	"user-profile":      getUserProfile,
+	"typing-start":      startTyping,
+	"ack":               ackMessage,
 }
 
 var upgrader = websocket.Upgrader{
@@ -28,110 +45,129 @@ var upgrader = websocket.Upgrader{
 func HandleWebSocketConnections(w http.ResponseWriter, r *http.Request) {
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	if err := protocol.CheckVersion(r.URL.Query().Get("v")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, subprotocol := auth.TokenFromWebSocketRequest(r)
+	claims, err := auth.Authenticate(token)
 	if err != nil {
-		log.Println(err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	var request webSocketRequest
-	ws.ReadJSON(&request)
-	log.Println(request)
-	var userId, ok = strconv.ParseInt(request.Data["userId"].(string), 10, 64)
-	if ok != nil {
-		log.Println("no userId send")
+	var responseHeader http.Header
+	if subprotocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+	}
+
+	ws, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		log.Println(err)
 		return
 	}
-	go handleWebSocket(ws, userId)
+
+	resumeId := r.URL.Query().Get("resume")
+	lastSeq, _ := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+
+	go handleWebSocket(ws, claims.UserID, claims.SessionID, resumeId, lastSeq)
 }
 
-func handleWebSocket(ws *websocket.Conn, userId int64) {
+// handleWebSocket serves a connection until it closes. With a resumeId, the connection
+// resumes that session and receives the events after lastSeq; if that is not possible,
+// a new session is started and the client is told to re-sync with an invalid-session event.
+func handleWebSocket(ws *websocket.Conn, userId int64, sessionId string, resumeId string, lastSeq int64) {
+	var c *client
+	var generation int
+	var resumeError error
+	if resumeId != "" {
+		resumeError = errors.New("unknown session")
+		if c = hub.session(resumeId); c != nil {
+			generation, resumeError = c.resume(ws, userId, sessionId, lastSeq)
+		}
+		if resumeError != nil {
+			c = nil
+		}
+	}
 
-	defer func() {
-		err := setUserOffline(userId)
-		log.Println(userId, "now offline")
+	if c == nil {
+		var err error
+		c, err = newClient(ws, userId, sessionId)
 		if err != nil {
-			ws.WriteJSON(webSocketError{Status: http.StatusInternalServerError, StatusText: "Database operation could not be executed"})
+			log.Println("Error registering websocket connection:", err)
+			ws.WriteJSON(protocol.NewError("", http.StatusInternalServerError, "Database operation could not be executed"))
+			ws.Close()
 			return
 		}
+		generation = 1
+		if resumeError != nil {
+			c.writeJSON(protocol.Event{Type: "invalid-session", Data: invalidSessionData{Reason: resumeError.Error()}})
+		}
+	}
+
+	stopHeartbeat := c.startHeartbeat(ws)
+	resumable := false
+	defer func() {
+		stopHeartbeat()
+		ws.Close()
+		c.suspend(generation, resumable)
 	}()
 
 	for {
-		var request webSocketRequest
+		var request protocol.Request
 		if err := ws.ReadJSON(&request); err != nil {
-			ws.WriteJSON(webSocketError{Status: http.StatusBadRequest, StatusText: "Invalid request, make sure data is an object"})
+			var syntaxError *json.SyntaxError
+			var typeError *json.UnmarshalTypeError
+			if errors.As(err, &syntaxError) || errors.As(err, &typeError) || errors.Is(err, io.ErrUnexpectedEOF) {
+				c.writeJSON(protocol.NewError("", http.StatusBadRequest, "Invalid request, make sure it is an object with a type and data"))
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				// Read deadline exceeded or the connection broke, the client may come back
+				log.Println(userId, "connection lost:", err)
+				resumable = true
+			}
 			return
 		}
 
-		log.Println(request)
+		log.Println("REQUEST:", request.Type)
 
-		switch request.Type {
-		case "alive":
-			err := setUserOnline(request)
-			if err != nil {
-				log.Println(err)
-				ws.WriteJSON(webSocketError{Status: http.StatusInternalServerError, StatusText: "Error setting websocket status: Database operation could not be executed"})
-				return
-			}
-		case "update-appearance":
-			err := setAppearance(request)
-			if err != nil {
-				log.Println(err)
-				ws.WriteJSON(webSocketError{Status: http.StatusInternalServerError, StatusText: "Error changing websocket appearance: Database operation could not be executed"})
-				return
-			}
-		case "update-status":
-			err, statusCode := setStatus(request)
-			if err != nil {
-				if statusCode == http.StatusInternalServerError {
-					log.Println(err)
-					ws.WriteJSON(webSocketError{Status: statusCode, StatusText: "Error changing websocket status: Database operation could not be executed"})
-				} else if statusCode == http.StatusBadRequest {
-					log.Println(err)
-					ws.WriteJSON(webSocketError{Status: statusCode, StatusText: "Error changing websocket status: Status message exceeds the amount of 128 characters"})
-				}
-				return
-			}
-		case "update-pronouns":
-			err, statusCode := setPronouns(request)
-			if err != nil {
-				if err != nil {
-					if statusCode == http.StatusInternalServerError {
-						log.Println(err)
-						ws.WriteJSON(webSocketError{Status: statusCode, StatusText: "Error changing websocket pronouns: Database operation could not be executed"})
-					} else if statusCode == http.StatusBadRequest {
-						log.Println(err)
-						ws.WriteJSON(webSocketError{Status: statusCode, StatusText: "Error changing websocket pronouns: Pronouns exceed the amount of 40 characters"})
-					}
-					return
-				}
-				return
-			}
-		case "onmessage":
-			err := saveMessage(request)
-			if err != nil {
-				ws.WriteJSON(webSocketError{Status: http.StatusInternalServerError, StatusText: "Error processing message: database operation could not be executed"})
-				return
-			}
-		case "user-profile":
-			err := getUserProfile(request)
-			if err != nil {
-				ws.WriteJSON(webSocketError{Status: http.StatusInternalServerError, StatusText: "Error fetching user profile: database operation could not be executed"})
-				return
-			}
-			/*case "bio-update":
-				err := setBio(request)
-				if err != nil {
-					ws.WriteJSON(webSocketError{Status: http.StatusInternalServerError, StatusText: "Error updating bio: database operation could not be executed"})
-					return
-				}
-			case"custom-status-update":
-			case"new-channel":
-			case"server-settings-update":
-			case"websocket-role-update":
-			case"new-thread":
-			case"role-update":*/
+		if request.Type == "heartbeat" {
+			c.heartbeat(ws)
+			continue
 		}
 
+		// Every other request counts as user activity
+		ws.SetReadDeadline(time.Now().Add(readTimeout))
+		presence.touch(userId)
+
+		c.handleRequest(request)
+	}
+}
+
+// handleRequest runs the handler of a request and answers it. Requests with a nonce are
+// acknowledged on success; failed requests are answered with an error, which leaves the connection open.
+func (c *client) handleRequest(request protocol.Request) {
+	var data interface{}
+	var err error
+	if handler, ok := handlers[request.Type]; ok {
+		data, err = handler(c, request)
+	} else {
+		err = fmt.Errorf("%w: %q", protocol.ErrUnknownRequest, request.Type)
+	}
+	if err != nil {
+		status := ErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Println("Error handling", request.Type+":", err)
+			c.writeJSON(protocol.NewError(request.Nonce, status, "Error handling "+request.Type+": database operation could not be executed"))
+			return
+		}
+		c.writeJSON(protocol.NewError(request.Nonce, status, "Error handling "+request.Type+": "+err.Error()))
+		return
+	}
+
+	if request.Nonce != "" {
+		c.writeJSON(protocol.NewAck(request.Nonce, data))
 	}
 }